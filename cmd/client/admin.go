@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	hellopb "mygrpc/pkg/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// adminUsage はadminのサブコマンドの一覧を表示する
+func adminUsage() {
+	fmt.Fprint(os.Stderr, `usage: client admin <command> [flags]
+
+commands:
+  create  issue a new API key (the key is printed only once)
+  list    list API keys
+  revoke  revoke an API key
+  rotate  replace the value of an API key, keeping its ID and scopes
+
+The admin service needs an API key or token allowed to call myapp.ApiKeyAdminService,
+e.g. the bootstrap key the server prints when it creates the key file.
+Run "client admin <command> -h" for the flags of each command.
+`)
+}
+
+// runAdmin はmyapp.ApiKeyAdminServiceのRPCを呼ぶ
+func runAdmin(args []string) int {
+	if len(args) == 0 {
+		adminUsage()
+		return exitUsage
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "create":
+		var ttl time.Duration
+		var scopes stringsFlag
+		req := &hellopb.CreateApiKeyRequest{}
+		return runAdminCall("admin create", args,
+			func(fs *flag.FlagSet) {
+				fs.StringVar(&req.Name, "name", "", "name describing what the key is for")
+				fs.Var(&scopes, "scope", `method the key may call (repeatable): /package.Service/Method, /package.Service/* or *`)
+				fs.DurationVar(&ttl, "ttl", 0, "how long the key stays valid, e.g. 720h (0 never expires)")
+			},
+			func(ctx context.Context, client hellopb.ApiKeyAdminServiceClient) (proto.Message, error) {
+				req.Scopes = scopes
+				if ttl > 0 {
+					req.Ttl = durationpb.New(ttl)
+				}
+				return client.CreateApiKey(ctx, req)
+			})
+	case "list":
+		req := &hellopb.ListApiKeysRequest{}
+		return runAdminCall("admin list", args,
+			func(fs *flag.FlagSet) {
+				fs.BoolVar(&req.IncludeRevoked, "all", false, "include revoked keys")
+			},
+			func(ctx context.Context, client hellopb.ApiKeyAdminServiceClient) (proto.Message, error) {
+				return client.ListApiKeys(ctx, req)
+			})
+	case "revoke":
+		req := &hellopb.RevokeApiKeyRequest{}
+		return runAdminCall("admin revoke", args,
+			func(fs *flag.FlagSet) {
+				fs.StringVar(&req.Id, "id", "", "ID of the key to revoke")
+			},
+			func(ctx context.Context, client hellopb.ApiKeyAdminServiceClient) (proto.Message, error) {
+				return client.RevokeApiKey(ctx, req)
+			})
+	case "rotate":
+		var ttl time.Duration
+		req := &hellopb.RotateApiKeyRequest{}
+		return runAdminCall("admin rotate", args,
+			func(fs *flag.FlagSet) {
+				fs.StringVar(&req.Id, "id", "", "ID of the key to rotate")
+				fs.DurationVar(&ttl, "ttl", 0, "new validity period from now (0 keeps the current expiry)")
+			},
+			func(ctx context.Context, client hellopb.ApiKeyAdminServiceClient) (proto.Message, error) {
+				if ttl > 0 {
+					req.Ttl = durationpb.New(ttl)
+				}
+				return client.RotateApiKey(ctx, req)
+			})
+	case "help", "-h", "--help":
+		adminUsage()
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "unknown admin command %q\n\n", cmd)
+		adminUsage()
+		return exitUsage
+	}
+}
+
+// runAdminCall はUnary RPCを1回呼び、レスポンスを出力する
+func runAdminCall(name string, args []string, bind func(fs *flag.FlagSet), call func(context.Context, hellopb.ApiKeyAdminServiceClient) (proto.Message, error)) int {
+	return runConn(name, args, nil, bind, func(ctx context.Context, conn grpc.ClientConnInterface, p printer) error {
+		res, err := call(ctx, hellopb.NewApiKeyAdminServiceClient(conn))
+		if err == nil {
+			p.response(res)
+		}
+		return err
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"mygrpc/pkg/fileresolver"
+	"mygrpc/pkg/lb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+/*-------------------------------------------------------------
+クライアント側の負荷分散
+
+接続先(バックエンド)は次のどれかで指定する。
+・-backends host1:8080,host2:8080   固定のリスト
+・-addr file:///path/endpoints.json  JSONファイルに書いたアドレスと重み・ゾーン。実行中の変更も反映する
+・-addr dns:///greeting.example.com:8080  DNSのA/AAAAレコード
+どのバックエンドに送るかは -lb-policy(pick_first / round_robin / consistent_hash_by_name)で決める。
+consistent_hash_by_name では、同じ名前のHelloは同じバックエンドに届く。
+-------------------------------------------------------------*/
+
+// lbPolicies は -lb-policy に指定できるポリシー
+var lbPolicies = []string{"pick_first", "round_robin", lb.ConsistentHashName}
+
+// balanced は複数のバックエンドに振り分ける設定かどうか。trueなら結果にバックエンドを表示する
+func (o *connOptions) balanced() bool {
+	return o.backends != "" || o.lbPolicy != "" || strings.HasPrefix(o.addr, "dns:") || strings.HasPrefix(o.addr, fileresolver.Scheme+":")
+}
+
+// dialTarget はgrpc.Dialに渡すターゲットと、そのためのリゾルバーを返す
+// -backends はmanualリゾルバーでアドレスを渡す。file:・dns: などのスキームはgRPCに登録されたリゾルバーが解決する
+func (o *connOptions) dialTarget() (string, *manual.Resolver, error) {
+	if o.backends == "" {
+		// リゾルバーのエラーはWithBlockの接続待ちには返らず、タイムアウトするまで理由がわからない
+		// エンドポイントのファイルは先に一度読んで、壊れていればすぐにエラーにする
+		if path, ok := strings.CutPrefix(o.addr, fileresolver.Scheme+"://"); ok {
+			if _, err := fileresolver.Load(path); err != nil {
+				return "", nil, err
+			}
+		}
+		return o.addr, nil, nil
+	}
+	var addrs []string
+	for _, a := range strings.Split(o.backends, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) == 0 {
+		return "", nil, errors.New("no backends")
+	}
+	for _, a := range addrs {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return "", nil, fmt.Errorf("backend %q: %w", a, err)
+		}
+	}
+	r := manual.NewBuilderWithScheme("backends")
+	r.InitialState(resolver.State{Addresses: resolverAddresses(addrs)})
+	// :authority(TLSで確認するサーバー名)には最初のバックエンドのホスト名を使う
+	host, _, _ := net.SplitHostPort(addrs[0])
+	return r.Scheme() + ":///" + host, r, nil
+}
+
+func resolverAddresses(addrs []string) []resolver.Address {
+	out := make([]resolver.Address, len(addrs))
+	for i, a := range addrs {
+		out[i] = resolver.Address{Addr: a}
+	}
+	return out
+}
+
+// serviceConfigJSON は -service-config のファイルに -lb-policy を反映した、デフォルトのservice configを返す
+// どちらも指定されていなければ空文字列
+func (o *connOptions) serviceConfigJSON() (string, error) {
+	if o.lbPolicy == "" {
+		if o.serviceConfig == "" {
+			return "", nil
+		}
+		return loadServiceConfig(o.serviceConfig)
+	}
+	if !slices.Contains(lbPolicies, o.lbPolicy) {
+		return "", fmt.Errorf("unknown -lb-policy %q (want %s)", o.lbPolicy, strings.Join(lbPolicies, ", "))
+	}
+	sc := map[string]any{}
+	if o.serviceConfig != "" {
+		s, err := loadServiceConfig(o.serviceConfig)
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal([]byte(s), &sc); err != nil {
+			return "", fmt.Errorf("service config %s must be a JSON object: %w", o.serviceConfig, err)
+		}
+	}
+	// -lb-policy はファイルの loadBalancingConfig より優先する
+	delete(sc, "loadBalancingPolicy")
+	sc["loadBalancingConfig"] = []map[string]any{{o.lbPolicy: map[string]any{}}}
+	b, err := json.Marshal(sc)
+	return string(b), err
+}
+
+// hashKeyUnaryClientInterceptor はリクエストの名前を、consistent_hash_by_nameでバックエンドを選ぶキーにする
+// 名前のないリクエストや、すでにキーが入っている呼び出しはそのまま送る
+func hashKeyUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if _, ok := lb.HashKeyFromContext(ctx); !ok {
+			if r, ok := req.(interface{ GetName() string }); ok {
+				ctx = lb.WithHashKey(ctx, r.GetName())
+			}
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	hellopb "mygrpc/pkg/grpc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+/*-------------------------------------------------------------
+負荷試験 (bench サブコマンド)
+
+-c 個のワーカーが -conns 本のコネクションを分け合い、指定したRPCを繰り返し呼び出す。
+-duration の間、または -n 回呼び出したら終了し、スループット・レイテンシの分布・
+ステータスコードごとのエラー数・ストリームごとのメッセージレートを出力する。
+-qps を指定すると、全ワーカー合計の呼び出し回数をその値に抑える。
+
+ストリームのRPCでは、ストリームを開いてから閉じるまでを1回の呼び出しとして数える。
+-------------------------------------------------------------*/
+
+// exitBenchFailed は接続できない・結果を書き出せないなど、計測を終えられなかったときの終了コード
+// フラグの誤り(exitUsage)と区別できるよう、別の値にする
+const exitBenchFailed = 3
+
+// maxNameLen はapi/hello.protoでHelloRequest.nameに付けたmax_len
+// これより長い-sizeはすべての呼び出しがINVALID_ARGUMENTになるので、始める前に弾く
+const maxNameLen = 64
+
+type benchOptions struct {
+	conn     connOptions
+	headers  metadataFlag
+	rpc      string
+	workers  int
+	conns    int
+	qps      float64
+	duration time.Duration
+	total    int64
+	size     int
+	messages int
+	count    uint
+	interval time.Duration
+	timeout  time.Duration
+	jsonOut  string
+}
+
+func (o *benchOptions) bindFlags(fs *flag.FlagSet) {
+	o.conn.bindFlags(fs)
+	fs.Var(&o.headers, "H", "request metadata as key=value (repeatable)")
+	fs.StringVar(&o.rpc, "rpc", "hello", "RPC to call: hello, server-stream, client-stream or bidi")
+	fs.IntVar(&o.workers, "c", 10, "number of concurrent workers")
+	fs.IntVar(&o.conns, "conns", 1, "number of connections shared by the workers")
+	fs.Float64Var(&o.qps, "qps", 0, "total calls per second across all workers (0 means as fast as possible)")
+	fs.DurationVar(&o.duration, "duration", 10*time.Second, "how long to run (ignored when -n is set)")
+	fs.Int64Var(&o.total, "n", 0, "total number of calls (0 means run for -duration)")
+	fs.IntVar(&o.size, "size", 16, "length of the name sent in each request (1 to 64)")
+	fs.IntVar(&o.messages, "messages", 10, "requests sent per stream for client-stream and bidi")
+	fs.UintVar(&o.count, "count", 10, "responses per stream for server-stream")
+	fs.DurationVar(&o.interval, "interval", 100*time.Millisecond, "interval between responses for server-stream")
+	fs.DurationVar(&o.timeout, "timeout", 30*time.Second, "deadline for each call")
+	fs.StringVar(&o.jsonOut, "json-out", "", `write the results as JSON to this file ("-" for stdout, with the table on stderr)`)
+}
+
+func (o *benchOptions) validate() error {
+	var errs []error
+	switch o.rpc {
+	case "hello", "server-stream", "client-stream", "bidi":
+	default:
+		errs = append(errs, fmt.Errorf("-rpc: unknown RPC %q", o.rpc))
+	}
+	if o.workers <= 0 {
+		errs = append(errs, errors.New("-c: must be positive"))
+	}
+	if o.conns <= 0 {
+		errs = append(errs, errors.New("-conns: must be positive"))
+	}
+	if o.qps < 0 {
+		errs = append(errs, errors.New("-qps: must not be negative"))
+	}
+	if o.total < 0 {
+		errs = append(errs, errors.New("-n: must not be negative"))
+	}
+	if o.total == 0 && o.duration <= 0 {
+		errs = append(errs, errors.New("-duration: must be positive when -n is not set"))
+	}
+	if o.messages <= 0 {
+		errs = append(errs, errors.New("-messages: must be positive"))
+	}
+	if o.size < 1 || o.size > maxNameLen {
+		errs = append(errs, fmt.Errorf("-size: must be between 1 and %d to pass the server's name validation", maxNameLen))
+	}
+	if o.count > math.MaxUint32 {
+		errs = append(errs, fmt.Errorf("-count: must be at most %d", uint32(math.MaxUint32)))
+	}
+	return errors.Join(errs...)
+}
+
+// callResult は1回の呼び出し(ストリームなら1本分)の結果
+type callResult struct {
+	latency  time.Duration
+	code     codes.Code
+	sent     int
+	received int
+}
+
+// benchCall は1回分のRPCを呼び出す
+type benchCall func(ctx context.Context, client hellopb.GreetingServiceClient) callResult
+
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	var opts benchOptions
+	opts.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if err := opts.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if err := opts.conn.setup(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	clients := make([]hellopb.GreetingServiceClient, opts.conns)
+	for i := range clients {
+		conn, err := dial(context.Background(), &opts.conn)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "did not connect: %v\n", err)
+			return exitBenchFailed
+		}
+		defer conn.Close()
+		clients[i] = hellopb.NewGreetingServiceClient(conn)
+	}
+
+	call := opts.benchCall()
+	stats := make([]*workerStats, opts.workers)
+
+	// -nが指定されていなければ、-durationが過ぎたら新しい呼び出しをやめる
+	// 実行中の呼び出しはキャンセルせず、最後まで計測する
+	stop := make(chan struct{})
+	if opts.total == 0 {
+		time.AfterFunc(opts.duration, func() { close(stop) })
+	}
+	var limiter <-chan time.Time
+	if opts.qps > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.qps))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	fmt.Fprintf(os.Stderr, "running %s with %d workers on %d connections...\n", opts.rpc, opts.workers, opts.conns)
+	var issued atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < opts.workers; i++ {
+		stats[i] = &workerStats{codes: make(map[codes.Code]int), backends: make(map[string]int)}
+		wg.Add(1)
+		go func(s *workerStats, client hellopb.GreetingServiceClient) {
+			defer wg.Done()
+			for {
+				if opts.total > 0 && issued.Add(1) > opts.total {
+					return
+				}
+				if limiter != nil {
+					select {
+					case <-limiter:
+					case <-stop:
+						return
+					}
+				}
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ctx, cancel := opts.callContext()
+				ctx, attempts := withAttemptCounter(ctx)
+				s.add(call(ctx, client))
+				cancel()
+				if opts.conn.balanced() {
+					s.backends[attempts.Backend()]++
+				}
+			}
+		}(stats[i], clients[i%len(clients)])
+	}
+	wg.Wait()
+
+	report := newBenchReport(&opts, time.Since(start), stats)
+	// JSONを標準出力に書くときは、そのままパースできるよう表は標準エラーに出す
+	text := io.Writer(os.Stdout)
+	if opts.jsonOut == "-" {
+		text = os.Stderr
+	}
+	report.print(text)
+	if opts.jsonOut != "" {
+		if err := report.writeJSON(opts.jsonOut); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write results: %v\n", err)
+			return exitBenchFailed
+		}
+	}
+	if report.Errors > 0 {
+		return exitRPCError
+	}
+	return exitOK
+}
+
+func (o *benchOptions) callContext() (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if len(o.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.MD(o.headers))
+	}
+	return context.WithTimeout(ctx, o.timeout)
+}
+
+// benchCall は-rpcに応じた1回分の呼び出しを返す
+func (o *benchOptions) benchCall() benchCall {
+	name := strings.Repeat("x", o.size)
+	req := &hellopb.HelloRequest{Name: name}
+
+	switch o.rpc {
+	case "server-stream":
+		streamReq := &hellopb.HelloRequest{
+			Name:     name,
+			Count:    proto.Uint32(uint32(o.count)),
+			Interval: durationpb.New(o.interval),
+		}
+		return func(ctx context.Context, client hellopb.GreetingServiceClient) callResult {
+			start := time.Now()
+			r := callResult{sent: 1}
+			stream, err := client.HelloServerStream(ctx, streamReq)
+			if err == nil {
+				for {
+					if _, err = stream.Recv(); err != nil {
+						break
+					}
+					r.received++
+				}
+			}
+			r.latency = time.Since(start)
+			r.code = codeOf(err)
+			return r
+		}
+	case "client-stream":
+		return func(ctx context.Context, client hellopb.GreetingServiceClient) callResult {
+			start := time.Now()
+			var r callResult
+			stream, err := client.HelloClientStream(ctx)
+			if err == nil {
+				for i := 0; i < o.messages; i++ {
+					if err = stream.Send(req); err != nil {
+						break
+					}
+					r.sent++
+				}
+				// Sendのエラー(EOF)より、CloseAndRecvで受け取るステータスのほうが正確
+				if _, err = stream.CloseAndRecv(); err == nil {
+					r.received++
+				}
+			}
+			r.latency = time.Since(start)
+			r.code = codeOf(err)
+			return r
+		}
+	case "bidi":
+		return func(ctx context.Context, client hellopb.GreetingServiceClient) callResult {
+			start := time.Now()
+			var r callResult
+			stream, err := client.HelloBiStreams(ctx)
+			if err == nil {
+				sent := make(chan int)
+				go func() {
+					n := 0
+					for ; n < o.messages; n++ {
+						if stream.Send(req) != nil {
+							break
+						}
+					}
+					_ = stream.CloseSend()
+					sent <- n
+				}()
+				for {
+					if _, err = stream.Recv(); err != nil {
+						break
+					}
+					r.received++
+				}
+				r.sent = <-sent
+			}
+			r.latency = time.Since(start)
+			r.code = codeOf(err)
+			return r
+		}
+	}
+
+	return func(ctx context.Context, client hellopb.GreetingServiceClient) callResult {
+		start := time.Now()
+		_, err := client.Hello(ctx, req)
+		r := callResult{latency: time.Since(start), code: codeOf(err), sent: 1}
+		if err == nil {
+			r.received = 1
+		}
+		return r
+	}
+}
+
+// codeOf はエラーをステータスコードにする。ストリームの正常終了(io.EOF)はOK
+func codeOf(err error) codes.Code {
+	if err == nil || errors.Is(err, io.EOF) {
+		return codes.OK
+	}
+	return status.Code(err)
+}
+
+// workerStats はワーカーごとに集計する。ロックを取らないよう、最後にまとめて合算する
+type workerStats struct {
+	latencies []time.Duration
+	codes     map[codes.Code]int
+	// backends は負荷分散しているときの、バックエンドごとの呼び出しの数
+	backends map[string]int
+	sent     int
+	received int
+	// rates はストリーム1本あたりのメッセージレート(送受信の合計/秒)
+	rates []float64
+}
+
+func (s *workerStats) add(r callResult) {
+	s.latencies = append(s.latencies, r.latency)
+	s.codes[r.code]++
+	s.sent += r.sent
+	s.received += r.received
+	if r.latency > 0 {
+		s.rates = append(s.rates, float64(r.sent+r.received)/r.latency.Seconds())
+	}
+}
+
+// benchReport は結果の集計。-json-outではこのままJSONとして書き出す
+type benchReport struct {
+	RPC         string           `json:"rpc"`
+	Workers     int              `json:"workers"`
+	Connections int              `json:"connections"`
+	TargetQPS   float64          `json:"target_qps,omitempty"`
+	Size        int              `json:"size"`
+	Elapsed     float64          `json:"elapsed_seconds"`
+	Calls       int              `json:"calls"`
+	Errors      int              `json:"errors"`
+	Throughput  float64          `json:"throughput_per_second"`
+	Codes       map[string]int   `json:"codes"`
+	Backends    map[string]int   `json:"backends,omitempty"`
+	Latency     latencySummary   `json:"latency_ms"`
+	Histogram   []histogramEntry `json:"histogram"`
+	Streams     *streamSummary   `json:"streams,omitempty"`
+	Timestamp   time.Time        `json:"timestamp"`
+}
+
+type latencySummary struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+type histogramEntry struct {
+	// UpperBoundMS はこのバケットに入るレイテンシの上限(ミリ秒)
+	UpperBoundMS float64 `json:"le_ms"`
+	Count        int     `json:"count"`
+}
+
+type streamSummary struct {
+	MessagesSent     int     `json:"messages_sent"`
+	MessagesReceived int     `json:"messages_received"`
+	MessagesPerSec   float64 `json:"messages_per_second"`
+	PerStreamMean    float64 `json:"per_stream_messages_per_second_mean"`
+	PerStreamP50     float64 `json:"per_stream_messages_per_second_p50"`
+}
+
+func newBenchReport(o *benchOptions, elapsed time.Duration, stats []*workerStats) *benchReport {
+	r := &benchReport{
+		RPC:         o.rpc,
+		Workers:     o.workers,
+		Connections: o.conns,
+		TargetQPS:   o.qps,
+		Size:        o.size,
+		Elapsed:     elapsed.Seconds(),
+		Codes:       make(map[string]int),
+		Timestamp:   time.Now(),
+	}
+
+	var latencies []time.Duration
+	var rates []float64
+	var sent, received int
+	for _, s := range stats {
+		latencies = append(latencies, s.latencies...)
+		rates = append(rates, s.rates...)
+		sent += s.sent
+		received += s.received
+		for addr, n := range s.backends {
+			if r.Backends == nil {
+				r.Backends = make(map[string]int)
+			}
+			r.Backends[addr] += n
+		}
+		for code, n := range s.codes {
+			r.Codes[code.String()] += n
+			if code != codes.OK {
+				r.Errors += n
+			}
+		}
+	}
+	r.Calls = len(latencies)
+	if elapsed > 0 {
+		r.Throughput = float64(r.Calls) / elapsed.Seconds()
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if len(latencies) > 0 {
+		var sum time.Duration
+		for _, l := range latencies {
+			sum += l
+		}
+		r.Latency = latencySummary{
+			Min:  ms(latencies[0]),
+			Mean: ms(sum / time.Duration(len(latencies))),
+			P50:  ms(percentile(latencies, 0.50)),
+			P90:  ms(percentile(latencies, 0.90)),
+			P99:  ms(percentile(latencies, 0.99)),
+			P999: ms(percentile(latencies, 0.999)),
+			Max:  ms(latencies[len(latencies)-1]),
+		}
+		r.Histogram = histogram(latencies)
+	}
+
+	if o.rpc != "hello" {
+		sort.Float64s(rates)
+		ss := &streamSummary{MessagesSent: sent, MessagesReceived: received}
+		if elapsed > 0 {
+			ss.MessagesPerSec = float64(sent+received) / elapsed.Seconds()
+		}
+		if len(rates) > 0 {
+			var sum float64
+			for _, rate := range rates {
+				sum += rate
+			}
+			ss.PerStreamMean = sum / float64(len(rates))
+			ss.PerStreamP50 = rates[int(math.Ceil(0.5*float64(len(rates))))-1]
+		}
+		r.Streams = ss
+	}
+	return r
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// percentile はソート済みのsortedからp(0〜1)の位置の値を返す
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// histogram はソート済みのレイテンシを、100µsから2倍ずつ広がるバケットに振り分ける
+func histogram(sorted []time.Duration) []histogramEntry {
+	var entries []histogramEntry
+	bound := 100 * time.Microsecond
+	i := 0
+	for i < len(sorted) {
+		n := 0
+		for i < len(sorted) && sorted[i] <= bound {
+			n++
+			i++
+		}
+		entries = append(entries, histogramEntry{UpperBoundMS: ms(bound), Count: n})
+		bound *= 2
+	}
+	return entries
+}
+
+func (r *benchReport) print(w io.Writer) {
+	fmt.Fprintf(w, "rpc:         %s\n", r.RPC)
+	fmt.Fprintf(w, "elapsed:     %.2fs\n", r.Elapsed)
+	fmt.Fprintf(w, "calls:       %d (errors: %d)\n", r.Calls, r.Errors)
+	fmt.Fprintf(w, "throughput:  %.1f calls/s\n", r.Throughput)
+
+	fmt.Fprintln(w, "status codes:")
+	names := make([]string, 0, len(r.Codes))
+	for name := range r.Codes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-20s %d\n", name, r.Codes[name])
+	}
+
+	if len(r.Backends) > 0 {
+		fmt.Fprintln(w, "backends:")
+		addrs := make([]string, 0, len(r.Backends))
+		for addr := range r.Backends {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			name := addr
+			if name == "" {
+				name = "(not sent)"
+			}
+			fmt.Fprintf(w, "  %-20s %d\n", name, r.Backends[addr])
+		}
+	}
+
+	if r.Calls == 0 {
+		return
+	}
+	l := r.Latency
+	fmt.Fprintln(w, "latency (ms):")
+	fmt.Fprintf(w, "  min %.3f  mean %.3f  max %.3f\n", l.Min, l.Mean, l.Max)
+	fmt.Fprintf(w, "  p50 %.3f  p90 %.3f  p99 %.3f  p999 %.3f\n", l.P50, l.P90, l.P99, l.P999)
+
+	fmt.Fprintln(w, "histogram:")
+	max := 0
+	for _, e := range r.Histogram {
+		if e.Count > max {
+			max = e.Count
+		}
+	}
+	for _, e := range r.Histogram {
+		if e.Count == 0 {
+			continue
+		}
+		bar := strings.Repeat("#", int(math.Ceil(40*float64(e.Count)/float64(max))))
+		fmt.Fprintf(w, "  <= %10.3fms %8d %s\n", e.UpperBoundMS, e.Count, bar)
+	}
+
+	if s := r.Streams; s != nil {
+		fmt.Fprintln(w, "streams:")
+		fmt.Fprintf(w, "  messages sent %d, received %d (%.1f msg/s)\n", s.MessagesSent, s.MessagesReceived, s.MessagesPerSec)
+		fmt.Fprintf(w, "  per stream: mean %.1f msg/s, p50 %.1f msg/s\n", s.PerStreamMean, s.PerStreamP50)
+	}
+}
+
+func (r *benchReport) writeJSON(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	hellopb "mygrpc/pkg/grpc"
+	"mygrpc/pkg/lb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// サブコマンドの終了コード
+const (
+	exitOK       = 0 // RPCが成功した
+	exitRPCError = 1 // RPCがOK以外のステータスで終わった
+	exitUsage    = 2 // フラグの誤りや接続の失敗など、RPCを実行できなかった
+)
+
+// callOptions はRPCを呼び出すサブコマンドに共通のフラグ
+type callOptions struct {
+	conn    connOptions
+	headers metadataFlag
+	timeout time.Duration
+	output  string
+}
+
+func (o *callOptions) bindFlags(fs *flag.FlagSet) {
+	o.conn.bindFlags(fs)
+	fs.Var(&o.headers, "H", "request metadata as key=value (repeatable)")
+	fs.DurationVar(&o.timeout, "timeout", 0, "deadline for the call, e.g. 3s (0 means no deadline)")
+	fs.StringVar(&o.output, "output", "text", "output format: text, json or jsonl")
+}
+
+// callContext はデッドラインと送信するメタデータを設定したコンテキストを返す
+// baseはRPCごとに決まったメタデータで、-Hで同じキーを指定した場合は両方送られる
+func (o *callOptions) callContext(base map[string]string) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	md := metadata.Join(metadata.New(base), metadata.MD(o.headers))
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	if o.timeout > 0 {
+		return context.WithTimeout(ctx, o.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// runCall はフラグを解析してサーバーに接続し、callを実行して終了コードを返す
+// 各サブコマンドはbindで自分のフラグを追加し、callでRPCを呼び出す
+func runCall(name string, args []string, md map[string]string, bind func(fs *flag.FlagSet), call func(context.Context, hellopb.GreetingServiceClient, printer) error) int {
+	return runConn(name, args, md, bind, func(ctx context.Context, conn grpc.ClientConnInterface, p printer) error {
+		return call(ctx, hellopb.NewGreetingServiceClient(conn), p)
+	})
+}
+
+// runConn はrunCallと同じだが、GreetingService以外のサービスを呼べるようにコネクションをそのまま渡す
+func runConn(name string, args []string, md map[string]string, bind func(fs *flag.FlagSet), call func(context.Context, grpc.ClientConnInterface, printer) error) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var opts callOptions
+	opts.bindFlags(fs)
+	if bind != nil {
+		bind(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %v\n", fs.Args())
+		return exitUsage
+	}
+	if _, err := newPrinter(opts.output); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if err := opts.conn.setup(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	conn, err := dial(context.Background(), &opts.conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "did not connect: %v\n", err)
+		return exitUsage
+	}
+	defer conn.Close()
+
+	ctx, cancel := opts.callContext(md)
+	defer cancel()
+	// リトライの回数を出力できるよう、インターセプタより先に試行の数を数える入れ物を入れておく
+	ctx, attempts := withAttemptCounter(ctx)
+	// 経過時間はRPCの呼び出しから数えたいので、printerは接続した後に作る
+	p, _ := newPrinter(opts.output)
+	err = call(ctx, conn, p)
+	p.attempts(attempts.Attempts())
+	if opts.conn.balanced() {
+		p.backend(attempts.Backend())
+	}
+	p.finish(err)
+	if err != nil {
+		return exitRPCError
+	}
+	return exitOK
+}
+
+func runHello(args []string) int {
+	var name string
+	return runCall("hello", args, map[string]string{"type": "unary", "from": "client"},
+		func(fs *flag.FlagSet) {
+			fs.StringVar(&name, "name", "", "name to greet")
+		},
+		func(ctx context.Context, client hellopb.GreetingServiceClient, p printer) error {
+			return Hello(ctx, client, name, p)
+		})
+}
+
+func runServerStream(args []string) int {
+	var interval time.Duration
+	req := &hellopb.HelloRequest{}
+	return runCall("server-stream", args, nil,
+		func(fs *flag.FlagSet) {
+			fs.StringVar(&req.Name, "name", "", "name to greet")
+			fs.Var(optionalUint32{&req.Count}, "count", "number of responses (server default if not set)")
+			fs.DurationVar(&interval, "interval", 0, "interval between responses (server default if not set)")
+		},
+		func(ctx context.Context, client hellopb.GreetingServiceClient, p printer) error {
+			// 回数と間隔は省略するとサーバーのデフォルト値が使われる
+			if interval > 0 {
+				req.Interval = durationpb.New(interval)
+			}
+			// ストリームはリクエストを送る前にバックエンドが決まるので、名前をキーにするにはここで入れる
+			return HelloServerStream(lb.WithHashKey(ctx, req.GetName()), client, req, p)
+		})
+}
+
+func runClientStream(args []string) int {
+	var names stringsFlag
+	return runCall("client-stream", args, nil,
+		func(fs *flag.FlagSet) {
+			fs.Var(&names, "name", "name to send (repeatable); read one name per line from stdin if not set")
+		},
+		func(ctx context.Context, client hellopb.GreetingServiceClient, p printer) error {
+			return HelloClientStream(ctx, client, names.source(), p)
+		})
+}
+
+func runBidi(args []string) int {
+	var names stringsFlag
+	return runCall("bidi", args, map[string]string{"type": "stream", "from": "client"},
+		func(fs *flag.FlagSet) {
+			fs.Var(&names, "name", "name to send (repeatable); read one name per line from stdin if not set")
+		},
+		func(ctx context.Context, client hellopb.GreetingServiceClient, p printer) error {
+			return HelloBiStreams(ctx, client, names.source(), p)
+		})
+}
+
+// stringsFlag は何度でも指定できる文字列のフラグ
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// source は指定された名前を順に返す。1つも指定されていなければ標準入力から1行ずつ読む
+func (f *stringsFlag) source() nameSource {
+	if len(*f) == 0 {
+		return newLineReader(os.Stdin).next
+	}
+	names := *f
+	return func(context.Context) (string, bool) {
+		if len(names) == 0 {
+			return "", false
+		}
+		name := names[0]
+		names = names[1:]
+		return name, true
+	}
+}
+
+// lineReader は入力を別のgoroutineで1行ずつ読み、チャネルで渡す
+// 行を待っている途中でやめても、読んだ行はチャネルに残り、次にnextを呼んだときに渡される
+type lineReader struct {
+	lines chan string
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	l := &lineReader{lines: make(chan string)}
+	go func() {
+		defer close(l.lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			l.lines <- scanner.Text()
+		}
+	}()
+	return l
+}
+
+// next は次の行を返す。入力が終わったか、ctxが終わればfalseを返す
+func (l *lineReader) next(ctx context.Context) (string, bool) {
+	select {
+	case line, ok := <-l.lines:
+		return line, ok
+	case <-ctx.Done():
+		return "", false
+	}
+}
+
+// optionalUint32 は指定されたときだけ値が入る、protoのoptional uint32用のフラグ
+type optionalUint32 struct {
+	v **uint32
+}
+
+func (f optionalUint32) String() string {
+	if f.v == nil || *f.v == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(**f.v), 10)
+}
+
+func (f optionalUint32) Set(v string) error {
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return err
+	}
+	u := uint32(n)
+	*f.v = &u
+	return nil
+}
+
+// metadataFlag は -H key=value 形式で指定されたメタデータ
+type metadataFlag metadata.MD
+
+func (f *metadataFlag) String() string {
+	return fmt.Sprint(metadata.MD(*f))
+}
+
+func (f *metadataFlag) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("want key=value, got %q", v)
+	}
+	if *f == nil {
+		*f = metadataFlag{}
+	}
+	// メタデータのキーは小文字に正規化される
+	metadata.MD(*f).Append(key, value)
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"mygrpc/pkg/logging"
+	"mygrpc/pkg/redact"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// connOptions はサーバーへ接続するための設定
+type connOptions struct {
+	addr           string
+	connectTimeout time.Duration
+
+	tls        bool
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+
+	token         string
+	tokenFile     string
+	tokenInsecure bool
+	apiKey        string
+	apiKeyFile    string
+
+	backends string
+	lbPolicy string
+
+	serviceConfig               string
+	ignoreResolverServiceConfig bool
+
+	metricsListen           string
+	metricsLogLevelEndpoint bool
+
+	tracingExporter string
+	tracingEndpoint string
+
+	logFormat            string
+	logLevel             string
+	logPayloads          string
+	logPayloadSampleRate float64
+	logRedactKeys        string
+}
+
+func (o *connOptions) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.addr, "addr", "localhost:8080", "server address, or a resolver target such as dns:///host:port or file:///path/endpoints.json")
+	fs.DurationVar(&o.connectTimeout, "connect-timeout", 10*time.Second, "how long to wait for the connection (0 waits forever)")
+	fs.BoolVar(&o.tls, "tls", false, "connect with TLS (implied by the other -tls-* flags)")
+	fs.StringVar(&o.caFile, "tls-ca", "", "CA certificate file (PEM) used to verify the server; system roots if empty")
+	fs.StringVar(&o.certFile, "tls-cert", "", "client certificate file (PEM) for mutual TLS")
+	fs.StringVar(&o.keyFile, "tls-key", "", "client private key file (PEM) for mutual TLS")
+	fs.StringVar(&o.serverName, "tls-server-name", "", "override the server name used to verify the server certificate")
+	fs.StringVar(&o.token, "token", "", "bearer token (JWT) sent in the authorization metadata of every RPC")
+	fs.StringVar(&o.tokenFile, "token-file", "", "file containing the bearer token; re-read on every RPC so rotated tokens are picked up")
+	fs.StringVar(&o.apiKey, "api-key", "", "API key sent in the x-api-key metadata of every RPC")
+	fs.StringVar(&o.apiKeyFile, "api-key-file", "", "file containing the API key; re-read on every RPC")
+	fs.BoolVar(&o.tokenInsecure, "token-insecure", false, "allow sending the token or API key over a connection without TLS (local testing only)")
+	fs.StringVar(&o.backends, "backends", "", "comma-separated backend addresses (host:port) to balance across instead of -addr")
+	fs.StringVar(&o.lbPolicy, "lb-policy", "", "load balancing policy: pick_first, round_robin or consistent_hash_by_name (gRPC default pick_first if empty)")
+	fs.StringVar(&o.serviceConfig, "service-config", "", "JSON service config file with per-method retry and hedging policies; used when the resolver supplies none")
+	fs.BoolVar(&o.ignoreResolverServiceConfig, "ignore-resolver-service-config", false, "ignore service configs supplied by the resolver (e.g. DNS TXT records) and always use -service-config")
+	fs.StringVar(&o.metricsListen, "metrics-listen", "", "serve Prometheus /metrics on this address (host:port) while the command runs")
+	fs.BoolVar(&o.metricsLogLevelEndpoint, "metrics-loglevel-endpoint", false, "also serve /loglevel, which changes the log level without authentication, on the metrics listener")
+	fs.StringVar(&o.tracingExporter, "tracing-exporter", "none", "trace exporter: none, stdout (written to stderr), otlp or memory")
+	fs.StringVar(&o.logFormat, "log-format", "text", "log format: text or json (logs go to stderr)")
+	fs.StringVar(&o.logLevel, "log-level", "warn", "log level: debug, info, warn or error")
+	fs.StringVar(&o.logPayloads, "log-payloads", "off", "log request and response payloads: off, sampled or full")
+	fs.Float64Var(&o.logPayloadSampleRate, "log-payload-sample-rate", 0.01, "fraction of RPCs whose payloads are logged when -log-payloads is sampled")
+	fs.StringVar(&o.logRedactKeys, "log-redact-metadata-keys", "", "comma-separated metadata keys to redact in logs and traces, in addition to authorization, cookie, x-api-key etc.")
+	fs.StringVar(&o.tracingEndpoint, "tracing-endpoint", "localhost:4317", "OTLP/gRPC collector address (host:port) for the otlp exporter")
+}
+
+// redactKeys は -log-redact-metadata-keys を分割したもの
+func (o *connOptions) redactKeys() []string {
+	var keys []string
+	for _, k := range strings.Split(o.logRedactKeys, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (o *connOptions) useTLS() bool {
+	return o.tls || o.caFile != "" || o.certFile != "" || o.keyFile != "" || o.serverName != ""
+}
+
+// transportCredentials はTLSを使うかどうかに応じて、grpc.WithTransportCredentialsに渡す認証情報を返す
+func (o *connOptions) transportCredentials() (credentials.TransportCredentials, error) {
+	if !o.useTLS() {
+		// insecure: コネクションでSSL/TLSを使用しない
+		return insecure.NewCredentials(), nil
+	}
+
+	tlsCfg := &tls.Config{
+		ServerName: o.serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if o.caFile != "" {
+		pem, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA file " + o.caFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if (o.certFile == "") != (o.keyFile == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	}
+	if o.certFile != "" {
+		// mTLS: サーバーにクライアント証明書を提示する
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client key pair: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
+
+// perRPCCredentials は -token / -token-file / -api-key / -api-key-file のどれかが指定されていれば、
+// RPCごとにBearerトークンかAPIキーを付ける認証情報を返す。どれも指定されていなければnilを返す
+func (o *connOptions) perRPCCredentials() (credentials.PerRPCCredentials, error) {
+	var set []string
+	for name, v := range map[string]string{"-token": o.token, "-token-file": o.tokenFile, "-api-key": o.apiKey, "-api-key-file": o.apiKeyFile} {
+		if v != "" {
+			set = append(set, name)
+		}
+	}
+	if len(set) > 1 {
+		sort.Strings(set)
+		return nil, fmt.Errorf("%s cannot be used together", strings.Join(set, " and "))
+	}
+
+	c := &secretCredentials{insecure: o.tokenInsecure}
+	switch {
+	case o.token != "" || o.tokenFile != "":
+		c.key, c.prefix, c.value, c.file = "authorization", "Bearer ", o.token, o.tokenFile
+	case o.apiKey != "" || o.apiKeyFile != "":
+		c.key, c.value, c.file = "x-api-key", o.apiKey, o.apiKeyFile
+	default:
+		return nil, nil
+	}
+	// 読めないファイルはRPCを始める前に知らせる
+	if _, err := c.read(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// secretCredentials はBearerトークンやAPIキーをメタデータに付けるPerRPCCredentials
+type secretCredentials struct {
+	// key はメタデータのキー、prefix は値の前に付ける文字列("Bearer " など)
+	key    string
+	prefix string
+	value  string
+	// file が空でなければ、RPCのたびにそこから値を読む
+	file     string
+	insecure bool
+}
+
+func (c *secretCredentials) read() (string, error) {
+	if c.file == "" {
+		return c.value, nil
+	}
+	b, err := os.ReadFile(c.file)
+	if err != nil {
+		return "", fmt.Errorf("read credentials file: %w", err)
+	}
+	v := strings.TrimSpace(string(b))
+	if v == "" {
+		return "", fmt.Errorf("credentials file %s is empty", c.file)
+	}
+	return v, nil
+}
+
+func (c *secretCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	v, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{c.key: c.prefix + v}, nil
+}
+
+// RequireTransportSecurity がtrueだと、TLSなしのコネクションでは認証情報を送らずにRPCが失敗する
+func (c *secretCredentials) RequireTransportSecurity() bool {
+	return !c.insecure
+}
+
+// setup はログ・メトリクスの公開・トレースなど、プロセス全体で1回だけ行う準備をする
+// コネクションを何本張るコマンドでも、最初のdialの前に1回だけ呼ぶ
+func (o *connOptions) setup() error {
+	if o.metricsListen != "" {
+		serveMetrics(o.metricsListen, o.metricsLogLevelEndpoint)
+	} else if o.metricsLogLevelEndpoint {
+		return errors.New("-metrics-loglevel-endpoint requires -metrics-listen")
+	}
+	if err := setupLogging(o); err != nil {
+		return err
+	}
+	if o.tracingExporter != "none" {
+		return setupTracing(o)
+	}
+	return nil
+}
+
+// dial はconnOptionsに従ってサーバーとのコネクションを確立する
+// コネクションが確立されるまでブロックするので、待つ時間はctxで制限する
+func dial(ctx context.Context, o *connOptions, extra ...grpc.DialOption) (*grpc.ClientConn, error) {
+	creds, err := o.transportCredentials()
+	if err != nil {
+		return nil, err
+	}
+	perRPC, err := o.perRPCCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if o.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.connectTimeout)
+		defer cancel()
+	}
+	// リクエストIDは他のインターセプタのログにも付くよう、一番外側で決める
+	// メトリクスは他のインターセプタの処理時間も含めて測るよう、そのすぐ内側に置く
+	unary := []grpc.UnaryClientInterceptor{requestIDUnaryClientInterceptor(), metrics.unaryInterceptor()}
+	stream := []grpc.StreamClientInterceptor{requestIDStreamClientInterceptor(), metrics.streamInterceptor()}
+	// リトライはインターセプタの内側(gRPCの中)で行われるので、どこに置いても試行の数は同じ
+	unary = append(unary, retryUnaryClientInterceptor(), hashKeyUnaryClientInterceptor())
+	stream = append(stream, retryStreamClientInterceptor())
+	if o.tracingExporter != "none" {
+		redactor := redact.NewMetadataRedactor(o.redactKeys()...)
+		unary = append(unary, tracingUnaryClientInterceptor(redactor))
+		stream = append(stream, tracingStreamClientInterceptor(redactor))
+	}
+	// ログにトレースIDが付くよう、トレースより内側に置く
+	payloads := logging.PayloadPolicy{Mode: o.logPayloads, SampleRate: o.logPayloadSampleRate}
+	unary = append(unary, loggingUnaryClientInterceptor(payloads))
+	stream = append(stream, loggingStreamClientInterceptor(payloads))
+	unary = append(unary, myUnaryClientInterceptor1())
+	stream = append(stream, myStreamClientInterceptor1())
+	if o.serviceConfig != "" {
+		hedging, err := loadHedgingPolicies(o.serviceConfig)
+		if err != nil {
+			return nil, err
+		}
+		// ヘッジングの試行が1回の呼び出しとしてログ・トレースに出るよう、一番内側に置く
+		if len(hedging) > 0 {
+			unary = append(unary, hedgingUnaryClientInterceptor(hedging))
+		}
+	}
+	opts := []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(unary...),
+		grpc.WithChainStreamInterceptor(stream...),
+
+		// 昔はgrpc.WithInsecure()で同じことをしていましたが、現在google.golang.org/grpcパッケージのWithInsecure()関数はDeprecatedになっています
+		grpc.WithTransportCredentials(creds),
+		grpc.WithBlock(), // コネクションが確立されるまで待機する(同期処理をする)
+	}
+	if perRPC != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(perRPC))
+	}
+	// 試行ごとに呼ばれるstats.Handlerで、リトライ・ヘッジングの試行と送り先のバックエンドを記録する
+	opts = append(opts, grpc.WithStatsHandler(attemptStatsHandler{}))
+	sc, err := o.serviceConfigJSON()
+	if err != nil {
+		return nil, err
+	}
+	if sc != "" {
+		opts = append(opts, grpc.WithDefaultServiceConfig(sc))
+	}
+	if o.ignoreResolverServiceConfig {
+		opts = append(opts, grpc.WithDisableServiceConfig())
+	}
+	target, backends, err := o.dialTarget()
+	if err != nil {
+		return nil, err
+	}
+	if backends != nil {
+		opts = append(opts, grpc.WithResolvers(backends))
+	}
+	return grpc.DialContext(ctx, target, append(opts, extra...)...)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	// これを忘れると、実行時にditailに[proto: not found]というエラーが出てしまう
+	// デシリアライズする際に、protoファイルを参照するために必要
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+// printStatus はRPCのエラーを、コード・メッセージと詳細(details)の型ごとに読みやすく表示する
+func printStatus(err error) {
+	stat, ok := status.FromError(err)
+	if !ok {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("code: %s\n", stat.Code())
+	fmt.Printf("message: %s\n", stat.Message())
+	for _, detail := range stat.Details() {
+		switch d := detail.(type) {
+		case *errdetails.BadRequest:
+			fmt.Println("bad request:")
+			for _, v := range d.GetFieldViolations() {
+				fmt.Printf("  - %s: %s\n", v.GetField(), v.GetDescription())
+			}
+		case *errdetails.ErrorInfo:
+			fmt.Printf("error info: reason=%s domain=%s", d.GetReason(), d.GetDomain())
+			if len(d.GetMetadata()) > 0 {
+				fmt.Printf(" metadata=%v", d.GetMetadata())
+			}
+			fmt.Println()
+		case *errdetails.QuotaFailure:
+			fmt.Println("quota failure:")
+			for _, v := range d.GetViolations() {
+				fmt.Printf("  - %s: %s\n", v.GetSubject(), v.GetDescription())
+			}
+		case *errdetails.RetryInfo:
+			fmt.Printf("retry after: %s\n", d.GetRetryDelay().AsDuration())
+		case *errdetails.LocalizedMessage:
+			fmt.Printf("localized message (%s): %s\n", d.GetLocale(), d.GetMessage())
+		case *errdetails.DebugInfo:
+			fmt.Printf("debug info: %s\n", d.GetDetail())
+			for _, entry := range d.GetStackEntries() {
+				fmt.Printf("  %s\n", entry)
+			}
+		case error:
+			// 詳細の型がクライアントに登録されていないとき(errdetailsのimportし忘れなど)はerrorになる
+			fmt.Printf("detail: could not decode: %v\n", d)
+		default:
+			fmt.Printf("detail: %T %v\n", d, d)
+		}
+	}
+}
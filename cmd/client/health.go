@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// healthコマンドの終了コード
+// オーケストレーション側(readiness probeなど)はこの値だけを見て判断できる
+const (
+	exitServing    = 0 // SERVING
+	exitNotServing = 1 // NOT_SERVING / UNKNOWN / SERVICE_UNKNOWN
+	exitError      = 2 // 接続できない・Healthサービスがないなど、状態を確認できなかった
+)
+
+// runHealth はgrpc.health.v1.Healthに問い合わせ、結果に応じた終了コードを返す
+func runHealth(args []string) int {
+	fs := flag.NewFlagSet("health", flag.ContinueOnError)
+	var connOpts connOptions
+	connOpts.bindFlags(fs)
+	service := fs.String("service", "myapp.GreetingService", `service name to check ("" for the whole server)`)
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout for connecting and for each check")
+	watch := fs.Bool("watch", false, "keep watching and print every status change")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitServing
+		}
+		return exitError
+	}
+
+	if err := connOpts.setup(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	dialCtx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	conn, err := dial(dialCtx, &connOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "did not connect: %v\n", err)
+		return exitError
+	}
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	req := &healthpb.HealthCheckRequest{Service: *service}
+
+	if !*watch {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		res, err := client.Check(ctx, req)
+		if status.Code(err) == codes.NotFound {
+			// Checkは登録されていないサービス名に対してNOT_FOUNDを返す
+			fmt.Println(healthpb.HealthCheckResponse_SERVICE_UNKNOWN)
+			return exitNotServing
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "health check failed: %s\n", status.Convert(err).Message())
+			return exitError
+		}
+		fmt.Println(res.GetStatus())
+		return exitCodeFor(res.GetStatus())
+	}
+
+	// Watchはサーバー側で状態が変わるたびにレスポンスが届くServer Streaming RPC
+	stream, err := client.Watch(context.Background(), req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "health watch failed: %s\n", status.Convert(err).Message())
+		return exitError
+	}
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return exitCodeFor(last)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "health watch failed: %s\n", status.Convert(err).Message())
+			return exitError
+		}
+		last = res.GetStatus()
+		fmt.Printf("%s %s\n", time.Now().Format(time.RFC3339), last)
+	}
+}
+
+func exitCodeFor(s healthpb.HealthCheckResponse_ServingStatus) int {
+	if s == healthpb.HealthCheckResponse_SERVING {
+		return exitServing
+	}
+	return exitNotServing
+}
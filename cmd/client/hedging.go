@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+/*-------------------------------------------------------------
+ヘッジング
+
+grpc-goはservice configのhedgingPolicyを読み飛ばすので、-service-config のファイルに書かれた
+hedgingPolicyはこのインターセプタが実行する。
+最初の試行を送った後、hedgingDelayごとに次の試行を並行に送り、最初に返ってきたOKか致命的なエラーを結果にする。
+nonFatalStatusCodesのエラーが返ったときは、遅延を待たずに次の試行を送る。
+結果が決まったら残りの試行はキャンセルする。
+
+対象はUnaryのRPCだけで、ストリームのRPCはヘッジングしない。
+リゾルバーが配ったservice configのhedgingPolicyは、grpc-goと同じく使われない。
+-------------------------------------------------------------*/
+
+// maxHedgingAttempts はmaxAttemptsの上限。grpc-goのリトライと同じく、これより大きい値は切り詰める
+const maxHedgingAttempts = 5
+
+// hedgingPolicy はservice configのhedgingPolicy
+type hedgingPolicy struct {
+	MaxAttempts         int          `json:"maxAttempts"`
+	HedgingDelay        string       `json:"hedgingDelay"`
+	NonFatalStatusCodes []codes.Code `json:"nonFatalStatusCodes"`
+
+	// delay はHedgingDelayを解析した値
+	delay time.Duration
+}
+
+// hedgingPolicies は "/サービス/メソッド" ごとのhedgingPolicy
+// メソッドを書かないnameは "/サービス/"、サービスも書かないnameは "" をキーにする
+type hedgingPolicies map[string]*hedgingPolicy
+
+// lookup はメソッド、サービス、全体の順にポリシーを探す
+func (p hedgingPolicies) lookup(method string) (*hedgingPolicy, bool) {
+	if h, ok := p[method]; ok {
+		return h, true
+	}
+	if h, ok := p[method[:strings.LastIndex(method, "/")+1]]; ok {
+		return h, true
+	}
+	h, ok := p[""]
+	return h, ok
+}
+
+// loadHedgingPolicies は -service-config のファイルからhedgingPolicyを読み込む
+func loadHedgingPolicies(path string) (hedgingPolicies, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read service config: %w", err)
+	}
+	p, err := parseHedgingPolicies(b)
+	if err != nil {
+		return nil, fmt.Errorf("service config %s: %w", path, err)
+	}
+	return p, nil
+}
+
+func parseHedgingPolicies(b []byte) (hedgingPolicies, error) {
+	var sc struct {
+		MethodConfig []struct {
+			Name []struct {
+				Service string `json:"service"`
+				Method  string `json:"method"`
+			} `json:"name"`
+			RetryPolicy   json.RawMessage `json:"retryPolicy"`
+			HedgingPolicy *hedgingPolicy  `json:"hedgingPolicy"`
+		} `json:"methodConfig"`
+	}
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return nil, err
+	}
+	p := hedgingPolicies{}
+	var errs []error
+	for i, mc := range sc.MethodConfig {
+		h := mc.HedgingPolicy
+		if h == nil {
+			continue
+		}
+		if mc.RetryPolicy != nil {
+			errs = append(errs, fmt.Errorf("methodConfig[%d]: retryPolicy and hedgingPolicy cannot be used together", i))
+			continue
+		}
+		if h.MaxAttempts < 2 {
+			errs = append(errs, fmt.Errorf("methodConfig[%d]: hedgingPolicy.maxAttempts must be at least 2", i))
+			continue
+		}
+		h.MaxAttempts = min(h.MaxAttempts, maxHedgingAttempts)
+		delay, err := parseConfigDuration(h.HedgingDelay)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("methodConfig[%d]: hedgingPolicy.hedgingDelay: %w", i, err))
+			continue
+		}
+		h.delay = delay
+		for _, n := range mc.Name {
+			switch {
+			case n.Service == "" && n.Method != "":
+				errs = append(errs, fmt.Errorf("methodConfig[%d]: method %q has no service", i, n.Method))
+			case n.Service == "":
+				p[""] = h
+			default:
+				p["/"+n.Service+"/"+n.Method] = h
+			}
+		}
+	}
+	return p, errors.Join(errs...)
+}
+
+// parseConfigDuration はservice configの "0.5s" のような時間を解析する。空文字列は0
+func parseConfigDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	sec, ok := strings.CutSuffix(s, "s")
+	if !ok {
+		return 0, fmt.Errorf("%q must end with s", s)
+	}
+	f, err := strconv.ParseFloat(sec, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative number of seconds", s)
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// hedgingUnaryClientInterceptor はpoliciesにあるメソッドの呼び出しをヘッジングする
+// 試行ごとにログ・トレースが出ないよう、インターセプタの一番内側に置く
+func hedgingUnaryClientInterceptor(policies hedgingPolicies) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		h, ok := policies.lookup(method)
+		m, isProto := reply.(proto.Message)
+		if !ok || !isProto {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		return h.invoke(ctx, method, req, m, cc, invoker, opts)
+	}
+}
+
+type hedgedKey struct{}
+
+// isHedged はヘッジングした呼び出しの試行かどうか。attemptStatsHandlerはこの試行をリトライとしてログに出さない
+func isHedged(ctx context.Context) bool {
+	_, ok := ctx.Value(hedgedKey{}).(bool)
+	return ok
+}
+
+// invoke は試行を並行に送り、最初に決まった結果をreplyとoptsのヘッダー・トレーラーに返す
+func (h *hedgingPolicy) invoke(ctx context.Context, method string, req interface{}, reply proto.Message, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts []grpc.CallOption) error {
+	// 結果が決まったら、まだ終わっていない試行をキャンセルする
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, hedgedKey{}, true))
+	defer cancel()
+	// 返ってこなかった試行が送る先がなくてブロックしないよう、試行の数だけバッファを持つ
+	done := make(chan *hedgedAttempt, h.MaxAttempts)
+	sent, pending := 0, 0
+	send := func(attrs ...any) {
+		sent++
+		pending++
+		if sent > 1 {
+			slog.WarnContext(ctx, "sending hedged attempt", append([]any{"method", method, "attempt", sent}, attrs...)...)
+		}
+		a := newHedgedAttempt(reply, opts)
+		go func() {
+			a.err = invoker(ctx, method, req, a.reply, cc, a.opts...)
+			done <- a
+		}()
+	}
+
+	send()
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+	for {
+		var next <-chan time.Time
+		if sent < h.MaxAttempts {
+			next = timer.C
+		}
+		select {
+		case <-next:
+			send("delay", h.delay)
+			timer.Reset(h.delay)
+		case a := <-done:
+			pending--
+			nonFatal := a.err != nil && slices.Contains(h.NonFatalStatusCodes, status.Code(a.err))
+			if !nonFatal || (sent == h.MaxAttempts && pending == 0) {
+				return a.deliver(reply, opts)
+			}
+			if sent < h.MaxAttempts {
+				// 致命的でないエラーなら、遅延を待たずに次の試行を送る
+				if !timer.Stop() {
+					<-timer.C
+				}
+				send("previous_code", status.Code(a.err).String())
+				timer.Reset(h.delay)
+			}
+		}
+	}
+}
+
+// hedgedAttempt は1回の試行の結果。試行が並行に書き込まないよう、レスポンスとヘッダー・トレーラーの受け取り先を試行ごとに持つ
+type hedgedAttempt struct {
+	reply   proto.Message
+	opts    []grpc.CallOption
+	header  metadata.MD
+	trailer metadata.MD
+	peer    peer.Peer
+	err     error
+}
+
+func newHedgedAttempt(reply proto.Message, opts []grpc.CallOption) *hedgedAttempt {
+	a := &hedgedAttempt{reply: reply.ProtoReflect().New().Interface()}
+	a.opts = make([]grpc.CallOption, len(opts))
+	for i, o := range opts {
+		switch o.(type) {
+		case grpc.HeaderCallOption:
+			o = grpc.Header(&a.header)
+		case grpc.TrailerCallOption:
+			o = grpc.Trailer(&a.trailer)
+		case grpc.PeerCallOption:
+			o = grpc.Peer(&a.peer)
+		}
+		a.opts[i] = o
+	}
+	return a
+}
+
+// deliver は試行の結果を、呼び出し元が渡したreplyとヘッダー・トレーラーの受け取り先に書き戻す
+func (a *hedgedAttempt) deliver(reply proto.Message, opts []grpc.CallOption) error {
+	for _, o := range opts {
+		switch o := o.(type) {
+		case grpc.HeaderCallOption:
+			*o.HeaderAddr = a.header
+		case grpc.TrailerCallOption:
+			*o.TrailerAddr = a.trailer
+		case grpc.PeerCallOption:
+			*o.PeerAddr = a.peer
+		}
+	}
+	if a.err != nil {
+		return a.err
+	}
+	proto.Reset(reply)
+	proto.Merge(reply, a.reply)
+	return nil
+}
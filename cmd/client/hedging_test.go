@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hellopb "mygrpc/pkg/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseHedgingPolicies(t *testing.T) {
+	p, err := parseHedgingPolicies([]byte(`{"methodConfig": [
+		{"name": [{"service": "myapp.GreetingService", "method": "Hello"}],
+		 "hedgingPolicy": {"maxAttempts": 10, "hedgingDelay": "0.5s", "nonFatalStatusCodes": ["UNAVAILABLE", 14]}},
+		{"name": [{"service": "grpc.health.v1.Health"}],
+		 "hedgingPolicy": {"maxAttempts": 2}},
+		{"name": [{"service": "myapp.GreetingService", "method": "HelloServerStream"}],
+		 "retryPolicy": {"maxAttempts": 2}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, ok := p.lookup("/myapp.GreetingService/Hello")
+	if !ok || h.MaxAttempts != maxHedgingAttempts || h.delay != 500*time.Millisecond || len(h.NonFatalStatusCodes) != 2 {
+		t.Errorf("Hello policy = %+v, want maxAttempts capped, 500ms delay and 2 non-fatal codes", h)
+	}
+	if _, ok := p.lookup("/grpc.health.v1.Health/Check"); !ok {
+		t.Errorf("no policy for a method of a service-wide name")
+	}
+	if _, ok := p.lookup("/myapp.GreetingService/HelloServerStream"); ok {
+		t.Errorf("policy found for a method with only a retryPolicy")
+	}
+}
+
+func TestParseHedgingPoliciesErrors(t *testing.T) {
+	tests := []struct {
+		name, config, want string
+	}{
+		{"with retryPolicy", `{"methodConfig": [{"name": [{"service": "s"}], "retryPolicy": {}, "hedgingPolicy": {"maxAttempts": 2}}]}`, "cannot be used together"},
+		{"one attempt", `{"methodConfig": [{"name": [{"service": "s"}], "hedgingPolicy": {"maxAttempts": 1}}]}`, "at least 2"},
+		{"bad delay", `{"methodConfig": [{"name": [{"service": "s"}], "hedgingPolicy": {"maxAttempts": 2, "hedgingDelay": "1m"}}]}`, "must end with s"},
+		{"method without service", `{"methodConfig": [{"name": [{"method": "Hello"}], "hedgingPolicy": {"maxAttempts": 2}}]}`, "has no service"},
+		{"unknown code", `{"methodConfig": [{"name": [{"service": "s"}], "hedgingPolicy": {"maxAttempts": 2, "nonFatalStatusCodes": ["NOPE"]}}]}`, "NOPE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseHedgingPolicies([]byte(tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// fakeAttempt は1回の試行の振る舞い。delayの間待ってからerrを返す。delayが負ならキャンセルされるまで返らない
+type fakeAttempt struct {
+	delay time.Duration
+	err   error
+}
+
+// hedge はattemptsの順に振る舞う試行でpolicyをヘッジングし、結果と送られた試行の数を返す
+func hedge(t *testing.T, policy *hedgingPolicy, attempts []fakeAttempt) (*hellopb.HelloResponse, metadata.MD, int, error) {
+	t.Helper()
+	var started atomic.Int32
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		n := int(started.Add(1))
+		a := attempts[n-1]
+		if a.delay < 0 {
+			<-ctx.Done()
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		time.Sleep(a.delay)
+		for _, o := range opts {
+			if o, ok := o.(grpc.TrailerCallOption); ok {
+				*o.TrailerAddr = metadata.Pairs("attempt", string(rune('0'+n)))
+			}
+		}
+		if a.err != nil {
+			return a.err
+		}
+		reply.(*hellopb.HelloResponse).Message = "attempt " + string(rune('0'+n))
+		return nil
+	}
+	i := hedgingUnaryClientInterceptor(hedgingPolicies{"/myapp.GreetingService/Hello": policy})
+	res := &hellopb.HelloResponse{}
+	var trailer metadata.MD
+	err := i(context.Background(), "/myapp.GreetingService/Hello", &hellopb.HelloRequest{}, res, nil, invoker, grpc.Trailer(&trailer))
+	return res, trailer, int(started.Load()), err
+}
+
+func TestHedgingUnaryClientInterceptor(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	tests := []struct {
+		name     string
+		policy   *hedgingPolicy
+		attempts []fakeAttempt
+		code     codes.Code
+		winner   string
+		sent     int
+	}{
+		{
+			name:     "delayed attempt wins over a hanging one",
+			policy:   &hedgingPolicy{MaxAttempts: 2, delay: 10 * time.Millisecond},
+			attempts: []fakeAttempt{{delay: -1}, {}},
+			code:     codes.OK, winner: "2", sent: 2,
+		},
+		{
+			name:     "non-fatal code sends the next attempt without waiting",
+			policy:   &hedgingPolicy{MaxAttempts: 3, delay: time.Hour, NonFatalStatusCodes: []codes.Code{codes.Unavailable}},
+			attempts: []fakeAttempt{{err: unavailable}, {err: unavailable}, {}},
+			code:     codes.OK, winner: "3", sent: 3,
+		},
+		{
+			name:     "fatal code is returned at once",
+			policy:   &hedgingPolicy{MaxAttempts: 3, delay: time.Hour, NonFatalStatusCodes: []codes.Code{codes.Unavailable}},
+			attempts: []fakeAttempt{{err: status.Error(codes.InvalidArgument, "bad")}},
+			code:     codes.InvalidArgument, winner: "1", sent: 1,
+		},
+		{
+			name:     "last non-fatal error after all attempts",
+			policy:   &hedgingPolicy{MaxAttempts: 2, delay: time.Hour, NonFatalStatusCodes: []codes.Code{codes.Unavailable}},
+			attempts: []fakeAttempt{{err: unavailable}, {err: unavailable}},
+			code:     codes.Unavailable, winner: "2", sent: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, trailer, sent, err := hedge(t, tt.policy, tt.attempts)
+			if status.Code(err) != tt.code {
+				t.Fatalf("code = %v, want %v", status.Code(err), tt.code)
+			}
+			if sent != tt.sent {
+				t.Errorf("sent %d attempts, want %d", sent, tt.sent)
+			}
+			// 結果にした試行のトレーラーとレスポンスだけが呼び出し元に返る
+			if got := trailer.Get("attempt"); len(got) != 1 || got[0] != tt.winner {
+				t.Errorf("trailer attempt = %v, want [%s]", got, tt.winner)
+			}
+			if tt.code == codes.OK && res.GetMessage() != "attempt "+tt.winner {
+				t.Errorf("message = %q, want the response of attempt %s", res.GetMessage(), tt.winner)
+			}
+		})
+	}
+}
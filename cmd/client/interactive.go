@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	hellopb "mygrpc/pkg/grpc"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// runInteractive は標準入力からメニューを選んでRPCを呼び出す対話モード
+func runInteractive(args []string) int {
+	fs := flag.NewFlagSet("interactive", flag.ContinueOnError)
+	var connOpts connOptions
+	connOpts.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	fmt.Println("start gRPC client")
+
+	// メニューの入力とストリームで送る名前は、同じ標準入力から読む
+	lines := newLineReader(os.Stdin)
+
+	if err := connOpts.setup(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	conn, err := dial(context.Background(), &connOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "did not connect: %v\n", err)
+		return exitUsage
+	}
+	defer conn.Close()
+
+	client := hellopb.NewGreetingServiceClient(conn)
+	p := textPrinter{}
+
+	for {
+		fmt.Println("1: send Request")
+		fmt.Println("2: HelloServerStream")
+		fmt.Println("3: HelloClientStream")
+		fmt.Println("4: HelloBiStream")
+		fmt.Println("5: exit")
+		fmt.Print("please enter >")
+
+		input, ok := lines.next(context.Background())
+		if !ok {
+			return exitOK
+		}
+
+		var err error
+		switch input {
+		case "1":
+			fmt.Print("please enter your name >")
+			name, _ := lines.next(context.Background())
+			ctx := metadata.NewOutgoingContext(context.Background(), metadata.New(map[string]string{"type": "unary", "from": "client"}))
+			err = Hello(ctx, client, name, p)
+		case "2":
+			req, ok := scanServerStreamRequest(lines)
+			if !ok {
+				continue
+			}
+			err = HelloServerStream(context.Background(), client, req, p)
+		case "3":
+			sendCount := 5
+			fmt.Printf("Please enter %d names.\n", sendCount)
+			err = HelloClientStream(context.Background(), client, limitNames(lines.next, sendCount), p)
+		case "4":
+			sendNum := 5
+			fmt.Printf("Please enter %d names.\n", sendNum)
+			ctx := metadata.NewOutgoingContext(context.Background(), metadata.New(map[string]string{"type": "stream", "from": "client"}))
+			err = HelloBiStreams(ctx, client, limitNames(lines.next, sendNum), p)
+		case "5":
+			fmt.Println("exit")
+			return exitOK
+		}
+		p.finish(err)
+	}
+}
+
+// scanServerStreamRequest はHelloServerStreamのリクエストを標準入力から組み立てる
+func scanServerStreamRequest(lines *lineReader) (*hellopb.HelloRequest, bool) {
+	ctx := context.Background()
+	fmt.Print("please enter your name >")
+	name, _ := lines.next(ctx)
+	req := &hellopb.HelloRequest{Name: name}
+
+	// 回数と間隔は省略するとサーバーのデフォルト値が使われる
+	fmt.Print("please enter the number of responses (empty for default) >")
+	if s, _ := lines.next(ctx); s != "" {
+		count, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			fmt.Println(err)
+			return nil, false
+		}
+		req.Count = proto.Uint32(uint32(count))
+	}
+	fmt.Print("please enter the interval, e.g. 500ms (empty for default) >")
+	if s, _ := lines.next(ctx); s != "" {
+		interval, err := time.ParseDuration(s)
+		if err != nil {
+			fmt.Println(err)
+			return nil, false
+		}
+		req.Interval = durationpb.New(interval)
+	}
+	return req, true
+}
+
+// limitNames はnamesから最大n個だけ名前を返す
+func limitNames(names nameSource, n int) nameSource {
+	return func(ctx context.Context) (string, bool) {
+		if n <= 0 {
+			return "", false
+		}
+		n--
+		return names(ctx)
+	}
+}
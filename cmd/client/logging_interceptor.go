@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mygrpc/pkg/logging"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+/*-------------------------------------------------------------
+クライアントのログ
+
+ログは標準エラー出力に書く(標準出力はRPCの結果のため)。
+RPCが終わるたびに、メソッド・所要時間・ステータスコード・リクエストID・メッセージのサイズを
+Infoで1行出力する。結果はprinterが表示するので、デフォルトのレベル(warn)では出ない。
+-------------------------------------------------------------*/
+
+// logLevel は -metrics-loglevel-endpoint を付ければ、-metrics-listen の /loglevel から実行中に変えられる
+var logLevel = new(slog.LevelVar)
+
+// setupLogging はデフォルトのLoggerを設定する。connOptions.setupから1回だけ呼ばれる
+func setupLogging(o *connOptions) error {
+	if !slices.Contains(logging.PayloadModes, o.logPayloads) {
+		return fmt.Errorf("unknown -log-payloads %q (want %s)", o.logPayloads, strings.Join(logging.PayloadModes, ", "))
+	}
+	level, err := logging.ParseLevel(o.logLevel)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	logger, err := logging.New(os.Stderr, o.logFormat, logLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// clientRPCAttrs はRPCのログに共通で付ける属性。request_idはコンテキストから、Loggerが自動で付ける
+func clientRPCAttrs(rpcType, method string) []any {
+	return []any{"method", method, "type", rpcType}
+}
+
+func logClientFinished(ctx context.Context, logger *slog.Logger, start time.Time, err error, attrs ...slog.Attr) {
+	attrs = append(attrs,
+		slog.String("code", status.Code(err).String()),
+		slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+	)
+	if err != nil {
+		attrs = append(attrs, slog.String("error", status.Convert(err).Message()))
+	}
+	logger.LogAttrs(ctx, slog.LevelInfo, "finished call", attrs...)
+}
+
+func loggingUnaryClientInterceptor(payloads logging.PayloadPolicy) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		logger := slog.Default().With(clientRPCAttrs("unary", method)...)
+		logPayload := payloads.Sample()
+		if logPayload {
+			logger.LogAttrs(ctx, slog.LevelInfo, "request payload", logging.Payload(req))
+		}
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+
+		attrs := []slog.Attr{slog.String("target", cc.Target()), slog.Int("request_size", logging.Size(req))}
+		if err == nil {
+			if logPayload {
+				logger.LogAttrs(ctx, slog.LevelInfo, "response payload", logging.Payload(reply))
+			}
+			attrs = append(attrs, slog.Int("response_size", logging.Size(reply)))
+		}
+		logClientFinished(ctx, logger, start, err, attrs...)
+		return err
+	}
+}
+
+func loggingStreamClientInterceptor(payloads logging.PayloadPolicy) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		logger := slog.Default().With(clientRPCAttrs(streamRPCType(desc), method)...)
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			logClientFinished(ctx, logger, start, err, slog.String("target", cc.Target()))
+			return nil, err
+		}
+		return &loggingClientStream{
+			ClientStream: cs,
+			desc:         desc,
+			ctx:          ctx,
+			logger:       logger.With("target", cc.Target()),
+			logPayload:   payloads.Sample(),
+			start:        start,
+		}, nil
+	}
+}
+
+// loggingClientStream は送受信したメッセージの数とサイズを数え、RecvMsgがエラーを返したら終了のログを出す
+// クライアントストリーミングは、レスポンスを受け取った時点で終了のログを出す
+// 双方向ストリーミングでは送信と受信が別のgoroutineから呼ばれるので、カウンターはatomicにする
+type loggingClientStream struct {
+	grpc.ClientStream
+	desc       *grpc.StreamDesc
+	ctx        context.Context
+	logger     *slog.Logger
+	logPayload bool
+	start      time.Time
+	once       sync.Once
+
+	sent, received           atomic.Int64
+	sentBytes, receivedBytes atomic.Int64
+}
+
+func (s *loggingClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		n := s.sent.Add(1)
+		s.sentBytes.Add(int64(logging.Size(m)))
+		if s.logPayload {
+			s.logger.LogAttrs(s.ctx, slog.LevelInfo, "request payload", slog.Int64("index", n-1), logging.Payload(m))
+		}
+	}
+	return err
+}
+
+func (s *loggingClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		n := s.received.Add(1)
+		s.receivedBytes.Add(int64(logging.Size(m)))
+		if s.logPayload {
+			s.logger.LogAttrs(s.ctx, slog.LevelInfo, "response payload", slog.Int64("index", n-1), logging.Payload(m))
+		}
+		if !s.desc.ServerStreams {
+			s.finish(nil)
+		}
+		return nil
+	}
+	final := err
+	if errors.Is(err, io.EOF) {
+		final = nil
+	}
+	s.finish(final)
+	return err
+}
+
+func (s *loggingClientStream) finish(err error) {
+	s.once.Do(func() {
+		logClientFinished(s.ctx, s.logger, s.start, err,
+			slog.Int64("msgs_sent", s.sent.Load()),
+			slog.Int64("msgs_received", s.received.Load()),
+			slog.Int64("bytes_sent", s.sentBytes.Load()),
+			slog.Int64("bytes_received", s.receivedBytes.Load()),
+		)
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"mygrpc/pkg/logging"
+
+	"google.golang.org/grpc"
+)
+
+// captureLogs はテストの間だけデフォルトのLoggerの出力をbufに切り替える
+func captureLogs(t *testing.T) *lockedBuffer {
+	t.Helper()
+	buf := &lockedBuffer{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return buf
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLoggingClientStreamLogsFinish(t *testing.T) {
+	tests := []struct {
+		name     string
+		desc     *grpc.StreamDesc
+		recv     []error
+		finished int
+	}{
+		{"client stream response", clientStreamDesc, []error{nil}, 1},
+		{"server stream until EOF", serverStreamDesc, []error{nil, nil, io.EOF}, 1},
+		{"server stream still open", serverStreamDesc, []error{nil}, 0},
+		{"bidi until EOF", bidiStreamDesc, []error{nil, io.EOF}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			openFakeStream(t, loggingStreamClientInterceptor(logging.PayloadPolicy{}), tt.desc, tt.recv)
+			if got := strings.Count(logs.String(), "finished call"); got != tt.finished {
+				t.Errorf("finished call logged %d times, want %d\n%s", got, tt.finished, logs)
+			}
+		})
+	}
+}
+
+// 双方向ストリーミングでは送信と受信が別のgoroutineから呼ばれる。go test -race で競合がないことを確かめる
+func TestLoggingClientStreamConcurrentSendRecv(t *testing.T) {
+	logs := captureLogs(t)
+	const n = 100
+	recv := make([]error, n+1)
+	recv[n] = io.EOF
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &fakeClientStream{recv: recv}, nil
+	}
+	interceptor := loggingStreamClientInterceptor(logging.PayloadPolicy{})
+	cs, err := interceptor(context.Background(), bidiStreamDesc, newTestClientConn(t), "/myapp.GreetingService/HelloBiStreams", streamer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			_ = cs.SendMsg(nil)
+		}
+	}()
+	for range recv {
+		_ = cs.RecvMsg(nil)
+	}
+	wg.Wait()
+
+	if !strings.Contains(logs.String(), "msgs_received=100") {
+		t.Errorf("finished call does not count received messages:\n%s", logs)
+	}
+}
@@ -1,239 +1,255 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"strings"
+	"sync"
 
 	hellopb "mygrpc/pkg/grpc"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/status"
-
 	"google.golang.org/grpc/metadata"
-
-	// これを忘れると、実行時にditailに[proto: not found]というエラーが出てしまう
-	// デシリアライズする際に、protoファイルを参照するために必要
-	_ "google.golang.org/genproto/googleapis/rpc/errdetails"
-)
-
-var (
-	scanner *bufio.Scanner
-	client  hellopb.GreetingServiceClient
 )
 
 func main() {
-	fmt.Println("start gRPC client")
-
-	scanner = bufio.NewScanner(os.Stdin)
-
-	address := "localhost:8080"
-	conn, err := grpc.Dial(
-		address,
-
-		grpc.WithUnaryInterceptor(myUnaryClientInterceptor1()),
-		grpc.WithStreamInterceptor(myStreamClientInterceptor1()),
-
-		// 昔はgrpc.WithInsecure()で同じことをしていましたが、現在google.golang.org/grpcパッケージのWithInsecure()関数はDeprecatedになっています
-		grpc.WithTransportCredentials(insecure.NewCredentials()), // insecure: コネクションでSSL/TLSを使用しない
-		grpc.WithBlock(), // コネクションが確立されるまで待機する(同期処理をする)
-	)
-	if err != nil {
-		log.Fatalf("did not connect: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	client = hellopb.NewGreetingServiceClient(conn)
-
-	for {
-		fmt.Println("1: send Request")
-		fmt.Println("2: HelloServerStream")
-		fmt.Println("3: HelloClientStream")
-		fmt.Println("4: HelloBiStream")
-		fmt.Println("5: exit")
-		fmt.Print("please enter >")
-
-		scanner.Scan()
-		input := scanner.Text()
-
-		switch input {
-		case "1":
-			Hello()
-		case "2":
-			HelloServerStream()
-		case "3":
-			HelloClientStream()
-		case "4":
-			HelloBiStreams()
-		case "5":
-			fmt.Println("exit")
-			return
-		}
-	}
+	code := run(os.Args[1:])
+	// os.Exitはdeferを実行しないので、スパンはここで送り出す
+	flushTracing()
+	os.Exit(code)
 }
 
-func Hello() {
-	fmt.Print("please enter your name >")
-	scanner.Scan()
-	name := scanner.Text()
+// nameSource は送信する名前を1つずつ返す。もう名前がないか、ctxが終わればfalseを返す
+// 対話モードでは標準入力から、サブコマンドではフラグや標準入力から名前を読む
+type nameSource func(ctx context.Context) (string, bool)
 
+func Hello(ctx context.Context, client hellopb.GreetingServiceClient, name string, p printer) error {
 	req := &hellopb.HelloRequest{Name: name}
 
-	ctx := context.Background()
-	md := metadata.New(map[string]string{"type": "unary", "from": "client"})
-	ctx = metadata.NewOutgoingContext(ctx, md)
-
 	// NewGreetingServiceClient関数で生成したクライアントは、サービスのHelloメソッドにリクエストを送るためのメソッドHelloを持っている
 	var header, trailer metadata.MD
 	// header, trailerを受け取るためのgrpc.Headerとgrpc.Trailerを使って、ヘッダーとトレーラーを受け取る
 	// このCallOption付きでメソッドを呼び出すと、grpc.Header・grpc.Trailer関数に引数として渡したメタデータ型に、レスポンス受信時に取得したヘッダー・トレーラーのデータが格納される
 	res, err := client.Hello(ctx, req, grpc.Header(&header), grpc.Trailer(&trailer))
-
-	if err != nil {
-		if stat, ok := status.FromError(err); ok {
-			fmt.Printf("code: %s\n", stat.Code())
-			fmt.Printf("message: %s\n", stat.Message())
-			fmt.Printf("details: %s\n", stat.Details())
-			return
-		} else {
-			fmt.Println(err)
-			return
-		}
+	p.header(header)
+	if err == nil {
+		p.response(res)
 	}
-
-	fmt.Println(header)
-	fmt.Println(trailer)
-	log.Printf("Greeting: %s", res.GetMessage())
+	// トレーラーはエラーで終わった場合にも届く
+	p.trailer(trailer)
+	return err
 }
 
-func HelloServerStream() {
-	fmt.Println("please enter your name >")
-	scanner.Scan()
-	name := scanner.Text()
-
-	req := &hellopb.HelloRequest{Name: name}
+func HelloServerStream(ctx context.Context, client hellopb.GreetingServiceClient, req *hellopb.HelloRequest, p printer) error {
 	// NewGreetingServiceClient関数で生成したクライアントは、サービスのHelloServerStreamメソッドにリクエストを送るためのメソッドHelloServerStreamを持っている
 	// サーバーから複数回レスポンスを受け取るためのストリームを得る
-	stream, err := client.HelloServerStream(context.Background(), req)
+	stream, err := client.HelloServerStream(ctx, req)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
+	}
+	// Headerはサーバーからヘッダーが届くまでブロックする。エラーの場合はRecvで受け取る
+	if md, err := stream.Header(); err == nil {
+		p.header(md)
 	}
 
 	for {
 		// サーバーからのレスポンスを受信するためのメソッドRecvを呼び出す
 		res, err := stream.Recv()
-		if errors.Is(err, io.EOF) {
-			fmt.Println("all the responses have already received.")
-			break
-		}
 		if err != nil {
-			log.Fatalf("could not greet: %v", err)
-			return
+			// Recvがエラー(io.EOFを含む)を返した後なら、トレーラーを読める
+			p.trailer(stream.Trailer())
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
 		}
-		log.Println(res)
+		p.response(res)
 	}
 }
 
-func HelloClientStream() {
+func HelloClientStream(ctx context.Context, client hellopb.GreetingServiceClient, names nameSource, p printer) error {
 	// サーバーに複数回リクエストを送るためのストリームを得る
-	stream, err := client.HelloClientStream(context.Background())
+	stream, err := client.HelloClientStream(ctx)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
-	sendCount := 5
-	fmt.Printf("Please enter %d names.\n", sendCount)
-	for i := 0; i < sendCount; i++ {
-		scanner.Scan()
-		name := scanner.Text()
-
+	for {
+		name, ok := names(ctx)
+		if !ok {
+			break
+		}
 		req := &hellopb.HelloRequest{Name: name}
 		// クライアントからリクエストを送信するためのメソッドSendを呼び出す
 		// ストリームを通じてリクエストを送信する
 		if err := stream.Send(req); err != nil {
-			log.Fatalf("could not send: %v", err)
-			return
+			// サーバーがエラーでストリームを終了させた場合、SendはEOFを返す。本当のエラーはCloseAndRecvで受け取る
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			break
 		}
 	}
 
 	// クライアントからのリクエストを全て送信した後、レスポンスを受け取るためのメソッドRecvを呼び出す
 	res, err := stream.CloseAndRecv()
-	if err != nil {
-		log.Fatalf("could not greet: %v", err)
-		return
+	if md, herr := stream.Header(); herr == nil {
+		p.header(md)
+	}
+	if err == nil {
+		p.response(res)
 	}
-	log.Printf("Greeting: %s\n", res.GetMessage())
+	p.trailer(stream.Trailer())
+	return err
 }
 
-func HelloBiStreams() {
-	ctx := context.Background()
-	md := metadata.New(map[string]string{"type": "stream", "from": "client"})
-	ctx = metadata.NewOutgoingContext(ctx, md)
+/*-------------------------------------------------------------
+Bidirectional Streaming RPCでは、送信と受信は互いに独立している
+サーバーがリクエスト1つにつきレスポンスを1つ返すとは限らないので、
+送信用と受信用のgoroutineを分けて、どちらかがもう一方を待たずに進めるようにする
+
+・送信側: 名前をすべて送ったらCloseSendでリクエストの終わりを伝える
+・受信側: RecvがEOFを返したらレスポンスの終わり。送信側がまだ名前を待っていても止める
+・どちらかでエラーが起きたらコンテキストをキャンセルして、もう一方も止める
+-------------------------------------------------------------*/
+
+func HelloBiStreams(ctx context.Context, client hellopb.GreetingServiceClient, names nameSource, p printer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	stream, err := client.HelloBiStreams(ctx)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
-	sendNum := 5
-	sendCount := 0
-	fmt.Printf("Please enter %d names.\n", sendNum)
-	var sendEnd, recvEnd bool
-	for !(sendEnd && recvEnd) {
-		if !sendEnd {
-			scanner.Scan()
-			name := scanner.Text()
-
-			sendCount++
+	// 最初に起きたエラーだけを記録し、同時にコンテキストをキャンセルしてもう一方も止める
+	var (
+		once     sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
 
-			req := &hellopb.HelloRequest{Name: name}
-			if err := stream.Send(req); err != nil {
-				log.Fatalf("could not send: %v", err)
-				return
-			}
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		if err := sendNames(ctx, stream, names); err != nil {
+			fail(err)
+		}
+	}()
+
+	// 受信が終わったら、エラーがなくても(サーバーが先にストリームを終えた場合も)送信側を止める
+	// ここで結果が決まるので、止められた送信側のエラーは記録しない
+	fail(receiveGreetings(stream, p))
+	// 送信側のgoroutineが終わるのを待ってから戻る
+	// (対話モードでは、送信側が標準入力を読み続けないようにするため)
+	// 送信側は標準入力の行を待っていても、キャンセルされればすぐに終わる
+	<-sent
+	return firstErr
+}
 
-			if sendCount == sendNum {
-				sendEnd = true
-				/*
-					client.HelloBiStreamsから得られるストリームは、SendメソッドとRecvメソッド以外にも、
-					grpc.ClientStreamインタフェースが持つメソッドセットも使うことができます。
-					CloseSendメソッドは、まさにgrpc.ClientStreamインターフェース由来のメソッドです。
-				*/
-				if err := stream.CloseSend(); err != nil {
-					fmt.Println(err)
-				}
+// sendNames は名前を順に送り、最後にCloseSendを呼ぶ
+func sendNames(ctx context.Context, stream hellopb.GreetingService_HelloBiStreamsClient, names nameSource) error {
+	for {
+		name, ok := names(ctx)
+		if !ok {
+			break
+		}
+		if err := stream.Send(&hellopb.HelloRequest{Name: name}); err != nil {
+			// サーバーがストリームを終了させた場合、SendはEOFを返す。本当のエラーは受信側のRecvで受け取る
+			if errors.Is(err, io.EOF) {
+				return nil
 			}
+			return err
 		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	/*
+		client.HelloBiStreamsから得られるストリームは、SendメソッドとRecvメソッド以外にも、
+		grpc.ClientStreamインタフェースが持つメソッドセットも使うことができます。
+		CloseSendメソッドは、まさにgrpc.ClientStreamインターフェース由来のメソッドです。
+	*/
+	return stream.CloseSend()
+}
 
-		var headerMD metadata.MD
-		if !recvEnd {
-			if headerMD == nil {
-				headerMD, err = stream.Header()
-				if err != nil {
-					fmt.Println(err)
-				} else {
-					fmt.Println(headerMD)
-				}
-			}
-			res, err := stream.Recv()
+// receiveGreetings はレスポンスをEOFまで受け取って出力する
+func receiveGreetings(stream hellopb.GreetingService_HelloBiStreamsClient, p printer) error {
+	// ヘッダーはレスポンスより先に届くので、ストリームごとに1回だけ取り出す
+	if md, err := stream.Header(); err == nil {
+		p.header(md)
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			// Recvがエラー(io.EOFを含む)を返した後なら、トレーラーを読める
+			p.trailer(stream.Trailer())
 			if errors.Is(err, io.EOF) {
-				recvEnd = true
-			} else if err != nil {
-				log.Fatalf("could not greet: %v", err)
-				return
+				return nil
 			}
-			log.Println(res.GetMessage())
+			return err
 		}
+		p.response(res)
+	}
+}
+
+// usage はサブコマンドの一覧を表示する
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: client <command> [flags]
+
+commands:
+  hello          call Hello once
+  server-stream  call HelloServerStream and print every response
+  client-stream  send names with HelloClientStream and print the reply
+  bidi           send names with HelloBiStreams and print every response
+  health         check grpc.health.v1.Health and exit with its status
+  bench          call an RPC repeatedly and report throughput and latency
+  admin          manage API keys (create, list, revoke, rotate)
+  interactive    the interactive menu (default when no command is given)
+
+Run "client <command> -h" for the flags of each command.
+`)
+}
+
+// run はサブコマンドを選んで実行し、プロセスの終了コードを返す
+func run(args []string) int {
+	// サブコマンドがない場合やフラグから始まる場合は、これまで通り対話モードで起動する
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help") {
+		return runInteractive(args)
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "hello":
+		return runHello(args)
+	case "server-stream":
+		return runServerStream(args)
+	case "client-stream":
+		return runClientStream(args)
+	case "bidi":
+		return runBidi(args)
+	case "health":
+		return runHealth(args)
+	case "bench":
+		return runBench(args)
+	case "admin":
+		return runAdmin(args)
+	case "interactive":
+		return runInteractive(args)
+	case "help", "-h", "--help":
+		usage()
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		return exitUsage
 	}
-	trailerMD := stream.Trailer()
-	fmt.Println(trailerMD)
 }
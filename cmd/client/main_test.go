@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	hellopb "mygrpc/pkg/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// earlyEndServer はリクエストを待たずにBidirectional Streamingのストリームを正常に終える
+type earlyEndServer struct {
+	hellopb.UnimplementedGreetingServiceServer
+}
+
+func (earlyEndServer) HelloBiStreams(hellopb.GreetingService_HelloBiStreamsServer) error {
+	return nil
+}
+
+func TestHelloBiStreamsStopsSenderWhenServerEnds(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	hellopb.RegisterGreetingServiceServer(s, earlyEndServer{})
+	go s.Serve(lis)
+	defer s.Stop()
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 対話モードで次の行を待っているのと同じく、キャンセルされるまで名前を返さない
+	waiting := func(ctx context.Context) (string, bool) {
+		<-ctx.Done()
+		return "", false
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- HelloBiStreams(context.Background(), hellopb.NewGreetingServiceClient(conn), waiting, &jsonlPrinter{w: io.Discard})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("HelloBiStreams() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HelloBiStreams did not return after the server ended the stream")
+	}
+}
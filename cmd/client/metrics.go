@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mygrpc/pkg/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+/*-------------------------------------------------------------
+クライアント側のPrometheusのメトリクス
+
+サーバー側と同じく、RPCの開始数・終了数(ステータスコード別)・所要時間・処理中の数・
+送受信したメッセージ数を記録する。
+ストリームはRecvMsgがエラー(io.EOFを含む)を返した時点で終了したとみなす。
+クライアントストリーミングはレスポンスが1つだけなので、それを受け取った時点で終了とする。
+
+-metrics-listen を指定すると、コマンドの実行中は /metrics で公開する。
+-metrics-loglevel-endpoint も付けると、同じリスナーの /loglevel でログのレベルを変えられる(認証はない)。
+benchのように長く動かすときに、外からスクレイプできる。
+-------------------------------------------------------------*/
+
+type clientMetrics struct {
+	started         *prometheus.CounterVec
+	handled         *prometheus.CounterVec
+	handlingSeconds *prometheus.HistogramVec
+	inFlight        *prometheus.GaugeVec
+	msgReceived     *prometheus.CounterVec
+	msgSent         *prometheus.CounterVec
+}
+
+var (
+	metricsRegistry = newMetricsRegistry()
+	metrics         = newClientMetrics(metricsRegistry)
+)
+
+func newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
+
+func newClientMetrics(reg prometheus.Registerer) *clientMetrics {
+	labels := []string{"grpc_type", "grpc_service", "grpc_method"}
+	m := &clientMetrics{
+		started: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_client_started_total",
+			Help: "Total number of RPCs started by the client.",
+		}, labels),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_client_handled_total",
+			Help: "Total number of RPCs completed by the client, regardless of success or failure.",
+		}, append(labels, "grpc_code")),
+		handlingSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_client_handling_seconds",
+			Help:    "Time from starting an RPC until the client received its final status.",
+			Buckets: prometheus.DefBuckets,
+		}, labels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "grpc_client_in_flight",
+			Help: "Number of RPCs started by the client that have not finished yet.",
+		}, labels),
+		msgReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_client_msg_received_total",
+			Help: "Total number of response messages received by the client.",
+		}, labels),
+		msgSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_client_msg_sent_total",
+			Help: "Total number of request messages sent by the client.",
+		}, labels),
+	}
+	reg.MustRegister(m.started, m.handled, m.handlingSeconds, m.inFlight, m.msgReceived, m.msgSent)
+	return m
+}
+
+// rpcLabels はgrpc_type・grpc_service・grpc_methodラベルの値
+type rpcLabels [3]string
+
+func newRPCLabels(rpcType, fullMethod string) rpcLabels {
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	return rpcLabels{rpcType, service, method}
+}
+
+func streamRPCType(desc *grpc.StreamDesc) string {
+	switch {
+	case desc.ClientStreams && desc.ServerStreams:
+		return "bidi_stream"
+	case desc.ClientStreams:
+		return "client_stream"
+	default:
+		return "server_stream"
+	}
+}
+
+// begin はRPCの開始を記録し、終了時に呼ぶ関数を返す
+func (m *clientMetrics) begin(l rpcLabels) func(err error) {
+	start := time.Now()
+	m.started.WithLabelValues(l[:]...).Inc()
+	m.inFlight.WithLabelValues(l[:]...).Inc()
+	return func(err error) {
+		m.inFlight.WithLabelValues(l[:]...).Dec()
+		m.handlingSeconds.WithLabelValues(l[:]...).Observe(time.Since(start).Seconds())
+		m.handled.WithLabelValues(append(l[:], status.Code(err).String())...).Inc()
+	}
+}
+
+func (m *clientMetrics) unaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		l := newRPCLabels("unary", method)
+		done := m.begin(l)
+		m.msgSent.WithLabelValues(l[:]...).Inc()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil {
+			m.msgReceived.WithLabelValues(l[:]...).Inc()
+		}
+		done(err)
+		return err
+	}
+}
+
+func (m *clientMetrics) streamInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		l := newRPCLabels(streamRPCType(desc), method)
+		done := m.begin(l)
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			done(err)
+			return nil, err
+		}
+		return &monitoredClientStream{
+			ClientStream: cs,
+			desc:         desc,
+			received:     m.msgReceived.WithLabelValues(l[:]...),
+			sent:         m.msgSent.WithLabelValues(l[:]...),
+			done:         done,
+		}, nil
+	}
+}
+
+// monitoredClientStream は送受信に成功したメッセージを数え、最終的なステータスを1回だけ記録するストリーム
+type monitoredClientStream struct {
+	grpc.ClientStream
+	desc     *grpc.StreamDesc
+	received prometheus.Counter
+	sent     prometheus.Counter
+	done     func(err error)
+	once     sync.Once
+}
+
+func (s *monitoredClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.sent.Inc()
+	}
+	return err
+}
+
+func (s *monitoredClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.received.Inc()
+		// サーバーストリーミングでなければレスポンスは1つだけで、受け取った時点でRPCは終わっている
+		if !s.desc.ServerStreams {
+			s.once.Do(func() { s.done(nil) })
+		}
+		return nil
+	}
+	// io.EOFはストリームが正常に終わったことを表す
+	final := err
+	if errors.Is(err, io.EOF) {
+		final = nil
+	}
+	s.once.Do(func() { s.done(final) })
+	return err
+}
+
+// serveMetrics はaddrで /metrics の公開を始める。withLogLevelなら /loglevel も公開する
+// connOptions.setupから1回だけ呼ばれる
+func serveMetrics(addr string, withLogLevel bool) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{Registry: metricsRegistry}))
+	if withLogLevel {
+		mux.Handle("/loglevel", logging.LevelHandler(logLevel))
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			fmt.Fprintf(os.Stderr, "metrics server stopped: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeClientStream はRecvMsgが順にrecvの値を返すストリーム
+type fakeClientStream struct {
+	grpc.ClientStream
+	recv []error
+}
+
+func (s *fakeClientStream) Context() context.Context     { return context.Background() }
+func (s *fakeClientStream) Header() (metadata.MD, error) { return metadata.MD{}, nil }
+func (s *fakeClientStream) Trailer() metadata.MD         { return metadata.MD{} }
+func (s *fakeClientStream) CloseSend() error             { return nil }
+func (s *fakeClientStream) SendMsg(m interface{}) error  { return nil }
+func (s *fakeClientStream) RecvMsg(m interface{}) error {
+	err := s.recv[0]
+	s.recv = s.recv[1:]
+	return err
+}
+
+var (
+	clientStreamDesc = &grpc.StreamDesc{StreamName: "HelloClientStream", ClientStreams: true}
+	serverStreamDesc = &grpc.StreamDesc{StreamName: "HelloServerStream", ServerStreams: true}
+	bidiStreamDesc   = &grpc.StreamDesc{StreamName: "HelloBiStreams", ClientStreams: true, ServerStreams: true}
+)
+
+// openFakeStream はinterceptorを通してfakeClientStreamを開き、RecvMsgをrecvの数だけ呼ぶ
+func openFakeStream(t *testing.T, interceptor grpc.StreamClientInterceptor, desc *grpc.StreamDesc, recv []error) {
+	t.Helper()
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &fakeClientStream{recv: recv}, nil
+	}
+	cs, err := interceptor(context.Background(), desc, newTestClientConn(t), "/myapp.GreetingService/"+desc.StreamName, streamer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.SendMsg(nil); err != nil {
+		t.Fatal(err)
+	}
+	for range recv {
+		_ = cs.RecvMsg(nil)
+	}
+}
+
+// newTestClientConn はインターセプターに渡すClientConnを作る。接続はしない
+func newTestClientConn(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	cc, err := grpc.Dial("passthrough:///localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+func metricValue(t *testing.T, c prometheus.Collector) float64 {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 1)
+	c.Collect(ch)
+	var m dto.Metric
+	if err := (<-ch).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	default:
+		return float64(m.Histogram.GetSampleCount())
+	}
+}
+
+func TestMonitoredClientStreamFinishes(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	tests := []struct {
+		name     string
+		desc     *grpc.StreamDesc
+		recv     []error
+		inFlight float64
+		code     codes.Code
+	}{
+		{"client stream response", clientStreamDesc, []error{nil}, 0, codes.OK},
+		{"client stream error", clientStreamDesc, []error{unavailable}, 0, codes.Unavailable},
+		{"server stream until EOF", serverStreamDesc, []error{nil, nil, io.EOF}, 0, codes.OK},
+		{"server stream still open", serverStreamDesc, []error{nil, nil}, 1, codes.OK},
+		{"bidi error", bidiStreamDesc, []error{nil, unavailable}, 0, codes.Unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newClientMetrics(prometheus.NewRegistry())
+			openFakeStream(t, m.streamInterceptor(), tt.desc, tt.recv)
+
+			l := newRPCLabels(streamRPCType(tt.desc), "/myapp.GreetingService/"+tt.desc.StreamName)
+			if got := metricValue(t, m.inFlight.WithLabelValues(l[:]...)); got != tt.inFlight {
+				t.Errorf("in flight = %v, want %v", got, tt.inFlight)
+			}
+			var finished float64
+			if tt.inFlight == 0 {
+				finished = 1
+			}
+			if got := metricValue(t, m.handled.WithLabelValues(append(l[:], tt.code.String())...)); got != finished {
+				t.Errorf("handled{grpc_code=%s} = %v, want %v", tt.code, got, finished)
+			}
+			if got := metricValue(t, m.handlingSeconds.WithLabelValues(l[:]...).(prometheus.Histogram)); got != finished {
+				t.Errorf("handling seconds observations = %v, want %v", got, finished)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+/*-------------------------------------------------------------
+RPCの結果の出力形式 (-output)
+
+text  人が読むための出力
+jsonl 受け取った順に、ヘッダー・レスポンス・トレーラー・ステータスを1行1レコードのJSONで出力する
+      ストリームのレスポンスも1メッセージごとに1行になるので、届いた順に処理できる
+json  RPCが終わってから、すべてを1つのJSONオブジェクトにまとめて出力する
+
+レスポンスとエラーの詳細はprotojsonでエンコードする
+-------------------------------------------------------------*/
+
+// printer はRPCの結果(ヘッダー・レスポンス・トレーラー・最終的なステータス)を出力する
+type printer interface {
+	header(md metadata.MD)
+	response(m proto.Message)
+	trailer(md metadata.MD)
+	// attempts はリトライ・ヘッジングを含めた試行の数。finishの前に1回だけ呼ばれる
+	attempts(n int)
+	// backend はRPCを処理したバックエンドのアドレス。負荷分散しているときだけ、finishの前に呼ばれる
+	backend(addr string)
+	// finish はRPCが終わったときに1回だけ呼ばれる。errがnilなら成功
+	finish(err error)
+}
+
+func newPrinter(format string) (printer, error) {
+	switch format {
+	case "text":
+		return textPrinter{}, nil
+	case "jsonl":
+		return &jsonlPrinter{w: os.Stdout, start: time.Now()}, nil
+	case "json":
+		return &jsonPrinter{w: os.Stdout, start: time.Now()}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q (want text, json or jsonl)", format)
+}
+
+// textPrinter は人が読むための出力
+type textPrinter struct{}
+
+func (textPrinter) header(md metadata.MD) {
+	if len(md) > 0 {
+		fmt.Printf("header: %v\n", md)
+	}
+}
+
+func (textPrinter) response(m proto.Message) {
+	if res, ok := m.(interface{ GetMessage() string }); ok {
+		fmt.Println(res.GetMessage())
+		return
+	}
+	fmt.Print(prototext.Format(m))
+}
+
+func (textPrinter) trailer(md metadata.MD) {
+	md = withoutStatusDetails(md)
+	if len(md) > 0 {
+		fmt.Printf("trailer: %v\n", md)
+	}
+}
+
+func (textPrinter) attempts(n int) {
+	// リトライしなかったときは、これまでと同じ出力にする
+	if n > 1 {
+		fmt.Printf("attempts: %d\n", n)
+	}
+}
+
+func (textPrinter) backend(addr string) {
+	fmt.Printf("backend: %s\n", addr)
+}
+
+func (textPrinter) finish(err error) {
+	if err != nil {
+		printStatus(err)
+	}
+}
+
+// record はjson・jsonlで出力する1件分のデータ
+type record struct {
+	Type      string              `json:"type"`
+	Time      time.Time           `json:"time"`
+	ElapsedMS float64             `json:"elapsed_ms"`
+	Index     *int                `json:"index,omitempty"`
+	Metadata  map[string][]string `json:"metadata,omitempty"`
+	Message   json.RawMessage     `json:"message,omitempty"`
+	Status    *statusRecord       `json:"status,omitempty"`
+	Attempts  int                 `json:"attempts,omitempty"`
+	Backend   string              `json:"backend,omitempty"`
+}
+
+type statusRecord struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message,omitempty"`
+	Details []json.RawMessage `json:"details,omitempty"`
+}
+
+func newStatusRecord(err error) *statusRecord {
+	st := status.Convert(err)
+	r := &statusRecord{Code: st.Code().String(), Message: st.Message()}
+	// 詳細はAny型のまま出力する。protojsonは"@type"に型名を入れてくれる
+	for _, d := range st.Proto().GetDetails() {
+		b, err := protojson.Marshal(d)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{"@type": d.GetTypeUrl(), "error": err.Error()})
+		}
+		r.Details = append(r.Details, b)
+	}
+	return r
+}
+
+func marshalMessage(m proto.Message) json.RawMessage {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	return b
+}
+
+// withoutStatusDetails はトレーラーからエラーの詳細のバイナリを除く
+// 同じ内容はステータスの詳細としてデコードした形で出力する
+func withoutStatusDetails(md metadata.MD) metadata.MD {
+	if len(md.Get("grpc-status-details-bin")) == 0 {
+		return md
+	}
+	md = md.Copy()
+	delete(md, "grpc-status-details-bin")
+	return md
+}
+
+func elapsedMS(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+// jsonlPrinter は1行に1レコードずつ、届いた順に出力する
+type jsonlPrinter struct {
+	w     io.Writer
+	start time.Time
+	n     int
+	// tries・served はattempts・backendで受け取った値。ステータスのレコードに入れる
+	tries  int
+	served string
+}
+
+func (p *jsonlPrinter) write(r record) {
+	r.Time = time.Now()
+	r.ElapsedMS = elapsedMS(p.start)
+	b, err := json.Marshal(r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintln(p.w, string(b))
+}
+
+func (p *jsonlPrinter) header(md metadata.MD) {
+	p.write(record{Type: "header", Metadata: md})
+}
+
+func (p *jsonlPrinter) response(m proto.Message) {
+	i := p.n
+	p.n++
+	p.write(record{Type: "response", Index: &i, Message: marshalMessage(m)})
+}
+
+func (p *jsonlPrinter) trailer(md metadata.MD) {
+	p.write(record{Type: "trailer", Metadata: withoutStatusDetails(md)})
+}
+
+func (p *jsonlPrinter) attempts(n int) {
+	p.tries = n
+}
+
+func (p *jsonlPrinter) backend(addr string) {
+	p.served = addr
+}
+
+func (p *jsonlPrinter) finish(err error) {
+	p.write(record{Type: "status", Status: newStatusRecord(err), Attempts: p.tries, Backend: p.served})
+}
+
+// jsonPrinter はRPCが終わってから、結果を1つのJSONオブジェクトにまとめて出力する
+type jsonPrinter struct {
+	w     io.Writer
+	start time.Time
+
+	result struct {
+		Header    map[string][]string `json:"header"`
+		Responses []json.RawMessage   `json:"responses"`
+		Trailer   map[string][]string `json:"trailer"`
+		Status    *statusRecord       `json:"status"`
+		ElapsedMS float64             `json:"elapsed_ms"`
+		Attempts  int                 `json:"attempts"`
+		Backend   string              `json:"backend,omitempty"`
+	}
+}
+
+func (p *jsonPrinter) header(md metadata.MD) {
+	p.result.Header = md
+}
+
+func (p *jsonPrinter) response(m proto.Message) {
+	p.result.Responses = append(p.result.Responses, marshalMessage(m))
+}
+
+func (p *jsonPrinter) trailer(md metadata.MD) {
+	p.result.Trailer = withoutStatusDetails(md)
+}
+
+func (p *jsonPrinter) attempts(n int) {
+	p.result.Attempts = n
+}
+
+func (p *jsonPrinter) backend(addr string) {
+	p.result.Backend = addr
+}
+
+func (p *jsonPrinter) finish(err error) {
+	p.result.Status = newStatusRecord(err)
+	p.result.ElapsedMS = elapsedMS(p.start)
+	if p.result.Responses == nil {
+		p.result.Responses = []json.RawMessage{}
+	}
+	b, err := json.MarshalIndent(p.result, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintln(p.w, string(b))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+
+	"mygrpc/pkg/requestid"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+/*-------------------------------------------------------------
+リクエストID
+
+RPCごとにリクエストIDを決めて x-request-id メタデータで送る。
+コンテキストにIDが入っていればそれを、-H x-request-id=... のようにメタデータで指定されていればそれを使い、
+どちらもなければ新しく作る。両方に違うIDが入っていればコンテキストのIDを使い、メタデータの値を置き換える。
+IDはコンテキストにも入れるので、このRPCのログとサーバーに送るIDは必ず同じになる。
+サーバーは同じIDを、どのRPCでもヘッダーとトレーラーの両方で返す。
+-------------------------------------------------------------*/
+
+// withRequestID はRPCのリクエストIDを決め、メタデータとコンテキストに入れる
+func withRequestID(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		md = metadata.MD{}
+	}
+	sent := md.Get(requestid.MetadataKey)
+	id := requestid.FromContext(ctx)
+	switch {
+	case id == "" && len(sent) > 0:
+		id = sent[0]
+	case id == "":
+		id = requestid.New()
+	}
+	// x-request-idが1つだけで、コンテキストのIDと同じならそのまま送る
+	if len(sent) != 1 || sent[0] != id {
+		md.Set(requestid.MetadataKey, id)
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+	return requestid.NewContext(ctx, id)
+}
+
+func requestIDUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(withRequestID(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+func requestIDStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(withRequestID(ctx), desc, cc, method, opts...)
+	}
+}
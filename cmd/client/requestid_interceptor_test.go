@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"mygrpc/pkg/requestid"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		contextID string
+		sent      []string
+		want      string
+	}{
+		{"context", "ctx-1", nil, "ctx-1"},
+		{"metadata", "", []string{"md-1"}, "md-1"},
+		{"same in both", "id-1", []string{"id-1"}, "id-1"},
+		// 違うIDが入っていればコンテキストのIDを使い、メタデータを合わせる
+		{"different", "ctx-1", []string{"md-1"}, "ctx-1"},
+		{"several in metadata", "", []string{"md-1", "md-2"}, "md-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.contextID != "" {
+				ctx = requestid.NewContext(ctx, tt.contextID)
+			}
+			for _, v := range tt.sent {
+				ctx = metadata.AppendToOutgoingContext(ctx, requestid.MetadataKey, v)
+			}
+			ctx = withRequestID(ctx)
+			if got := requestid.FromContext(ctx); got != tt.want {
+				t.Errorf("context id = %q, want %q", got, tt.want)
+			}
+			md, _ := metadata.FromOutgoingContext(ctx)
+			if got := md.Get(requestid.MetadataKey); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("metadata %s = %v, want [%s]", requestid.MetadataKey, got, tt.want)
+			}
+		})
+	}
+
+	// どちらにもなければ新しく作り、両方に入れる
+	ctx := withRequestID(context.Background())
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if id := requestid.FromContext(ctx); !requestid.Valid(id) || md.Get(requestid.MetadataKey)[0] != id {
+		t.Errorf("new id = %q, metadata = %v, want the same valid id in both", id, md)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+/*-------------------------------------------------------------
+リトライとヘッジング
+
+メソッドごとのリトライ(retryPolicy)・ヘッジング(hedgingPolicy)はservice configのJSONで宣言する。
+grpc-goはヘッジングを実装していないので、hedgingPolicyはhedging.goのインターセプタが実行する。
+-service-config のファイルはデフォルトのservice configとして使われ、
+リゾルバー(dns:/// のTXTレコードなど)がサーバー側のservice configを返した場合はそちらが優先される。
+
+リトライはgRPCの中で行われるのでインターセプタからは1回の呼び出しにしか見えない。
+そのため、インターセプタがコンテキストに入れたattemptCounterを、試行ごとに呼ばれるstats.Handlerが数える。
+-------------------------------------------------------------*/
+
+// loadServiceConfig は -service-config のファイルを読み、JSONとして正しいことを確認する
+// ポリシーの中身はgrpc.Dialが解析し、誤りがあれば接続時にエラーになる
+func loadServiceConfig(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read service config: %w", err)
+	}
+	if !json.Valid(b) {
+		return "", fmt.Errorf("service config %s is not valid JSON", path)
+	}
+	return string(b), nil
+}
+
+// attemptCounter は1回のRPCの試行の数と、直前の試行のエラー・送り先のバックエンドを記録する
+type attemptCounter struct {
+	mu      sync.Mutex
+	n       int
+	lastErr error
+	backend string
+}
+
+// begin は試行の開始を数え、何回目の試行かと直前の試行のエラーを返す
+func (c *attemptCounter) begin() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	return c.n, c.lastErr
+}
+
+func (c *attemptCounter) end(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.lastErr = err
+	}
+}
+
+func (c *attemptCounter) sentTo(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backend = addr
+}
+
+// Backend は最後の試行を送ったバックエンドのアドレス。RPCが送られる前なら空
+func (c *attemptCounter) Backend() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.backend
+}
+
+// Attempts はここまでの試行の数。RPCが送られる前なら0
+func (c *attemptCounter) Attempts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+type attemptCounterKey struct{}
+
+// withAttemptCounter は試行を数えるattemptCounterを入れたコンテキストを返す。すでに入っていればそれを使う
+func withAttemptCounter(ctx context.Context) (context.Context, *attemptCounter) {
+	if c, ok := ctx.Value(attemptCounterKey{}).(*attemptCounter); ok {
+		return ctx, c
+	}
+	c := &attemptCounter{}
+	return context.WithValue(ctx, attemptCounterKey{}, c), c
+}
+
+func retryUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, c := withAttemptCounter(ctx)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		logAttempts(ctx, method, c, err)
+		return err
+	}
+}
+
+func retryStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		// ストリームはレスポンスを受け取り始めるまでリトライされる。開くのに失敗したときだけここで記録する
+		ctx, c := withAttemptCounter(ctx)
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			logAttempts(ctx, method, c, err)
+		}
+		return cs, err
+	}
+}
+
+// logAttempts はリトライ・ヘッジングで2回以上試行したRPCの結果を記録する
+func logAttempts(ctx context.Context, method string, c *attemptCounter, err error) {
+	if n := c.Attempts(); n > 1 {
+		slog.InfoContext(ctx, "call finished after retries", "method", method, "attempts", n, "code", status.Code(err).String())
+	}
+}
+
+// attemptStatsHandler は試行ごとに呼ばれ、attemptCounterを数えてリトライをログに出す
+type attemptStatsHandler struct{}
+
+func (attemptStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (attemptStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	c, ok := ctx.Value(attemptCounterKey{}).(*attemptCounter)
+	if !ok || !s.IsClient() {
+		return
+	}
+	switch s := s.(type) {
+	case *stats.Begin:
+		n, prev := c.begin()
+		// ヘッジングの試行はhedgingUnaryClientInterceptorがログに出す
+		if n == 1 || isHedged(ctx) {
+			return
+		}
+		// transparentはサーバーに届かなかった試行を、gRPCがポリシーと関係なく再送したもの
+		attrs := []any{"attempt", n, "transparent", s.IsTransparentRetryAttempt}
+		if prev != nil {
+			attrs = append(attrs, "previous_code", status.Code(prev).String(), "previous_error", status.Convert(prev).Message())
+		}
+		slog.WarnContext(ctx, "retrying call", attrs...)
+	case *stats.OutHeader:
+		// クライアントのOutHeaderには、試行を送ったコネクションの接続先が入っている
+		if s.RemoteAddr != nil {
+			c.sentTo(s.RemoteAddr.String())
+		}
+	case *stats.End:
+		c.end(s.Error)
+	}
+}
+
+func (attemptStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (attemptStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
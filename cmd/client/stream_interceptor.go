@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
+
+	"mygrpc/pkg/logging"
 
 	"google.golang.org/grpc"
 )
@@ -33,7 +35,7 @@ type myClientStreamWrapper1 struct {
 func myStreamClientInterceptor1() grpc.StreamClientInterceptor {
 	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
 		// ストリームがopenされる前に行われる前処理
-		log.Println("[pre] my stream client interceptor 1", method)
+		slog.DebugContext(ctx, "[pre] my stream client interceptor 1", "method", method)
 
 		// ストリームを生成 -> 返り値として返す
 		// このストリームを用いて、クライアントは送受信処理を行う
@@ -47,14 +49,14 @@ func (s *myClientStreamWrapper1) RecvMsg(m interface{}) error {
 	err := s.ClientStream.RecvMsg(m)
 	// レスポンス受信後に割り込ませる処理
 	if !errors.Is(err, io.EOF) {
-		log.Println("[post message] my stream client interceptor 1: ", m)
+		slog.DebugContext(s.Context(), "[post message] my stream client interceptor 1", "size", logging.Size(m))
 	}
 	return err
 }
 
 func (s *myClientStreamWrapper1) SendMsg(m interface{}) error {
 	// リクエスト送信前に割り込ませる処理
-	log.Println("[pre message] my stream client interceptor 1: ", m)
+	slog.DebugContext(s.Context(), "[pre message] my stream client interceptor 1", "size", logging.Size(m))
 	// リクエスト送信処理
 	return s.ClientStream.SendMsg(m)
 }
@@ -63,6 +65,6 @@ func (s *myClientStreamWrapper1) CloseSend() error {
 	// ストリームをclose
 	err := s.ClientStream.CloseSend()
 	// ストリームがcloseされた後に行われる後処理
-	log.Println("[post] my stream client interceptor 1")
+	slog.DebugContext(s.Context(), "[post] my stream client interceptor 1")
 	return err
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"mygrpc/pkg/redact"
+	"mygrpc/pkg/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*-------------------------------------------------------------
+OpenTelemetryのトレース
+
+RPCごとにクライアントのスパンを作り、W3C Trace Context(traceparent)をメタデータに入れてサーバーに伝える。
+サーバーのスパンはこのスパンの子になるので、クライアントからサーバーのハンドラまでを1つのトレースで追える。
+ストリームのメッセージの送受信は、スパンのイベント("message")として記録する。
+
+送信するメタデータは、authorizationなどの値を伏せてからスパンの属性にする。
+
+stdoutのエクスポーターは、-output jsonの出力と混ざらないよう標準エラー出力に書く。
+-------------------------------------------------------------*/
+
+var tracingProvider *tracing.Provider
+
+// setupTracing はTracerProviderを作る。connOptions.setupから1回だけ呼ばれる
+func setupTracing(o *connOptions) error {
+	var err error
+	tracingProvider, err = tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    o.tracingExporter,
+		Endpoint:    o.tracingEndpoint,
+		ServiceName: "greeting-client",
+		Writer:      os.Stderr,
+	})
+	return err
+}
+
+// flushTracing は溜まっているスパンを送り出す。プロセスの終了前に呼ぶ
+func flushTracing() {
+	if tracingProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracingProvider.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to flush spans: %v\n", err)
+	}
+}
+
+func startClientSpan(ctx context.Context, method string, redactor *redact.MetadataRedactor) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.RPCAttributes(method)...),
+	}
+	// traceparentを入れる前のメタデータを記録する
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		opts = append(opts, trace.WithAttributes(tracing.RequestMetadataAttributes(redactor.Redact(md))...))
+	}
+	ctx, span := otel.Tracer(tracing.InstrumentationName).Start(ctx, tracing.SpanName(method), opts...)
+	return tracing.Inject(ctx), span
+}
+
+func tracingUnaryClientInterceptor(redactor *redact.MetadataRedactor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, span := startClientSpan(ctx, method, redactor)
+		tracing.AddMessageEvent(span, tracing.Sent, 1, req)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil {
+			tracing.AddMessageEvent(span, tracing.Received, 1, reply)
+		}
+		st := status.Convert(err)
+		tracing.EndSpan(span, st.Code(), st.Message())
+		return err
+	}
+}
+
+func tracingStreamClientInterceptor(redactor *redact.MetadataRedactor) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, span := startClientSpan(ctx, method, redactor)
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			st := status.Convert(err)
+			tracing.EndSpan(span, st.Code(), st.Message())
+			return nil, err
+		}
+		return &tracedClientStream{ClientStream: cs, desc: desc, span: span}, nil
+	}
+}
+
+// tracedClientStream はメッセージの送受信をスパンに記録し、RecvMsgがエラーを返したらスパンを終える
+// クライアントストリーミングは、レスポンスを受け取った時点で終える
+type tracedClientStream struct {
+	grpc.ClientStream
+	desc           *grpc.StreamDesc
+	span           trace.Span
+	sent, received int
+	once           sync.Once
+}
+
+func (s *tracedClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.sent++
+		tracing.AddMessageEvent(s.span, tracing.Sent, s.sent, m)
+	}
+	return err
+}
+
+func (s *tracedClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.received++
+		tracing.AddMessageEvent(s.span, tracing.Received, s.received, m)
+		if !s.desc.ServerStreams {
+			s.once.Do(func() { tracing.EndSpan(s.span, codes.OK, "") })
+		}
+		return nil
+	}
+	// io.EOFはストリームが正常に終わったことを表す
+	final := err
+	if errors.Is(err, io.EOF) {
+		final = nil
+	}
+	s.once.Do(func() {
+		st := status.Convert(final)
+		tracing.EndSpan(s.span, st.Code(), st.Message())
+	})
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTracedClientStreamEndsSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	tests := []struct {
+		name  string
+		desc  *grpc.StreamDesc
+		recv  []error
+		ended bool
+	}{
+		{"client stream response", clientStreamDesc, []error{nil}, true},
+		{"client stream error", clientStreamDesc, []error{status.Error(codes.Unavailable, "unavailable")}, true},
+		{"server stream until EOF", serverStreamDesc, []error{nil, io.EOF}, true},
+		{"server stream still open", serverStreamDesc, []error{nil, nil}, false},
+		{"bidi until EOF", bidiStreamDesc, []error{nil, nil, io.EOF}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(recorder.Ended())
+			openFakeStream(t, tracingStreamClientInterceptor(nil), tt.desc, tt.recv)
+			if got := len(recorder.Ended()) - before; got != boolToInt(tt.ended) {
+				t.Errorf("ended spans = %d, want %d", got, boolToInt(tt.ended))
+			}
+		})
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
+
+	"mygrpc/pkg/logging"
 
 	"google.golang.org/grpc"
 )
@@ -13,9 +15,9 @@ import (
 
 func myUnaryClientInterceptor1() grpc.UnaryClientInterceptor {
 	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
-		log.Println("[pre] my unary client interceptor 1: ", method)
+		slog.DebugContext(ctx, "[pre] my unary client interceptor 1", "method", method)
 		err := invoker(ctx, method, req, reply, cc, opts...)
-		log.Println("[post] my unary client interceptor 1: ", reply)
+		slog.DebugContext(ctx, "[post] my unary client interceptor 1", "response_size", logging.Size(reply))
 		return err
 	}
 }
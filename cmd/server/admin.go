@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"mygrpc/pkg/apikey"
+	hellopb "mygrpc/pkg/grpc"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+/*-------------------------------------------------------------
+APIキーの管理サービス(myapp.ApiKeyAdminService)
+
+auth.api_keys_file を指定したときだけ登録する。
+キーの値は発行・ローテーションのレスポンスでしか返さず、サーバーにはハッシュだけを残す。
+-------------------------------------------------------------*/
+
+// bootstrapScopes は最初のキーに与えるスコープ。キーの管理だけができる
+var bootstrapScopes = []string{"/" + hellopb.ApiKeyAdminService_ServiceDesc.ServiceName + "/*"}
+
+// openAPIKeys はキーのファイルを開く。キーが1つもなければ、キーの管理だけができる最初のキーを発行する
+// 最初のキーの値はこのときに1回だけ標準エラー出力に書くので、控えておくこと
+func openAPIKeys(path string) (*apikey.Store, error) {
+	keys, err := apikey.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if keys.Len() > 0 {
+		return keys, nil
+	}
+	key, secret, err := keys.Create("bootstrap", bootstrapScopes, 0)
+	if err != nil {
+		return nil, err
+	}
+	slog.Warn("no API keys found, created a bootstrap key for key management", "api_key", key.ID, "scopes", key.Scopes)
+	// 値はログの集約先に残らないよう、slogを通さずに書く
+	fmt.Fprintf(os.Stderr, "bootstrap API key (shown only once): %s\n", secret)
+	return keys, nil
+}
+
+type keyAdminServer struct {
+	hellopb.UnimplementedApiKeyAdminServiceServer
+
+	keys *apikey.Store
+}
+
+func (s *keyAdminServer) CreateApiKey(ctx context.Context, in *hellopb.CreateApiKeyRequest) (*hellopb.IssuedApiKey, error) {
+	ttl, err := ttlParam(in.GetTtl())
+	if err != nil {
+		return nil, err
+	}
+	var violations []*errdetails.BadRequest_FieldViolation
+	for _, scope := range in.GetScopes() {
+		if err := apikey.ValidateScope(scope); err != nil {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "scopes", Description: err.Error()})
+		}
+	}
+	if len(in.GetScopes()) == 0 {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "scopes", Description: "must not be empty"})
+	}
+	if len(violations) > 0 {
+		return nil, invalidArgumentError(reasonInvalidField, "スコープは /package.Service/Method、/package.Service/* または * で指定してください。", violations...)
+	}
+
+	key, secret, err := s.keys.Create(in.GetName(), in.GetScopes(), ttl)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	slog.InfoContext(ctx, "created API key", "api_key", key.ID, "name", key.Name, "scopes", key.Scopes)
+	return &hellopb.IssuedApiKey{Key: apiKeyProto(key), Secret: secret}, nil
+}
+
+func (s *keyAdminServer) ListApiKeys(ctx context.Context, in *hellopb.ListApiKeysRequest) (*hellopb.ListApiKeysResponse, error) {
+	res := &hellopb.ListApiKeysResponse{}
+	for _, key := range s.keys.List(in.GetIncludeRevoked()) {
+		res.Keys = append(res.Keys, apiKeyProto(key))
+	}
+	return res, nil
+}
+
+func (s *keyAdminServer) RevokeApiKey(ctx context.Context, in *hellopb.RevokeApiKeyRequest) (*hellopb.ApiKey, error) {
+	key, err := s.keys.Revoke(in.GetId())
+	if err != nil {
+		return nil, storeError(err)
+	}
+	slog.InfoContext(ctx, "revoked API key", "api_key", key.ID, "name", key.Name)
+	return apiKeyProto(key), nil
+}
+
+func (s *keyAdminServer) RotateApiKey(ctx context.Context, in *hellopb.RotateApiKeyRequest) (*hellopb.IssuedApiKey, error) {
+	ttl, err := ttlParam(in.GetTtl())
+	if err != nil {
+		return nil, err
+	}
+	key, secret, err := s.keys.Rotate(in.GetId(), ttl)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	slog.InfoContext(ctx, "rotated API key", "api_key", key.ID, "name", key.Name)
+	return &hellopb.IssuedApiKey{Key: apiKeyProto(key), Secret: secret}, nil
+}
+
+// ttlParam はリクエストのttlを確認する。未設定なら0を返す
+func ttlParam(d *durationpb.Duration) (time.Duration, error) {
+	if d == nil {
+		return 0, nil
+	}
+	if err := d.CheckValid(); err != nil || d.AsDuration() <= 0 {
+		return 0, invalidArgumentError(reasonInvalidField, "有効期間には正の値を指定してください。",
+			&errdetails.BadRequest_FieldViolation{Field: "ttl", Description: "must be a positive duration"})
+	}
+	return d.AsDuration(), nil
+}
+
+// storeError はapikey.Storeのエラーをstatusエラーにする
+func storeError(err error) error {
+	switch {
+	case errors.Is(err, apikey.ErrNotFound):
+		return statusError(codes.NotFound, err.Error(),
+			&errdetails.ErrorInfo{Reason: reasonAPIKeyNotFound, Domain: errorDomain},
+			&errdetails.LocalizedMessage{Locale: "ja-JP", Message: "指定したIDのAPIキーはありません。"},
+		)
+	case errors.Is(err, apikey.ErrRevoked):
+		return statusError(codes.FailedPrecondition, err.Error(),
+			&errdetails.ErrorInfo{Reason: reasonAPIKeyRevoked, Domain: errorDomain},
+			&errdetails.LocalizedMessage{Locale: "ja-JP", Message: "このAPIキーはすでに無効になっています。"},
+		)
+	}
+	slog.Error("API key store failed", "error", err)
+	return statusError(codes.Internal, "failed to update the API key store")
+}
+
+func apiKeyProto(k apikey.Key) *hellopb.ApiKey {
+	pb := &hellopb.ApiKey{
+		Id:         k.ID,
+		Name:       k.Name,
+		Scopes:     k.Scopes,
+		CreateTime: timestamppb.New(k.CreateTime),
+	}
+	// ゼロ値の時刻は「未設定」なので、フィールドを空のままにする
+	if !k.ExpireTime.IsZero() {
+		pb.ExpireTime = timestamppb.New(k.ExpireTime)
+	}
+	if !k.LastUsedTime.IsZero() {
+		pb.LastUsedTime = timestamppb.New(k.LastUsedTime)
+	}
+	if !k.RevokeTime.IsZero() {
+		pb.RevokeTime = timestamppb.New(k.RevokeTime)
+	}
+	return pb
+}
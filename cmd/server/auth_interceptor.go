@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"mygrpc/pkg/apikey"
+	"mygrpc/pkg/auth"
+	hellopb "mygrpc/pkg/grpc"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+/*-------------------------------------------------------------
+JWT・APIキーによる認証
+
+authorization: Bearer <jwt> メタデータのトークンを検証し、検証済みのクレームをコンテキストに入れてハンドラに渡す。
+ハンドラはauth.FromContextでクレームを取り出せる。
+APIキーが有効なら、x-api-key メタデータのキーも受け付ける。キーのスコープにないメソッドは呼べない。
+使われたキーはapikey.FromContextで取り出せ、最終使用時刻が記録される。
+APIキーの管理サービスは、スコープに含むAPIキーでしか呼べない。JWTやクライアント証明書だけの呼び出し元には、
+どんなキーでも発行できてしまわないよう、public_methods に書いてあっても拒否する。
+認証情報がない・不正なときはハンドラを呼ばずにUNAUTHENTICATEDを返し、理由をErrorInfoのreasonで伝える。
+Stream RPCはストリームを開いたときに1回だけ検証する。
+-------------------------------------------------------------*/
+
+// apiKeyMetadataKey はAPIキーを送るメタデータのキー
+const apiKeyMetadataKey = "x-api-key"
+
+// errMissingAPIKey はAPIキーだけが有効なときに、キーが送られてこなかったことを表す
+var errMissingAPIKey = errors.New("missing API key (" + apiKeyMetadataKey + " metadata)")
+
+// adminServicePrefix はAPIキーの管理サービスのメソッドの接頭辞
+var adminServicePrefix = "/" + hellopb.ApiKeyAdminService_ServiceDesc.ServiceName + "/"
+
+type authenticator struct {
+	// verifier・keys はそれぞれJWT・APIキーが無効ならnil
+	verifier *auth.Verifier
+	keys     *apikey.Store
+	// public は認証なしで呼べるメソッド。"/package.Service/*" ならサービス全体
+	public []string
+}
+
+func newAuthenticator(cfg authConfig, keys *apikey.Store) (*authenticator, error) {
+	a := &authenticator{keys: keys, public: cfg.PublicMethods}
+	if cfg.jwtEnabled() {
+		v, err := auth.NewVerifier(auth.Config{
+			HMACSecretFile: cfg.HMACSecretFile,
+			JWKSFile:       cfg.JWKSFile,
+			Issuer:         cfg.Issuer,
+			Audience:       cfg.Audience,
+			Leeway:         cfg.Leeway,
+		})
+		if err != nil {
+			return nil, err
+		}
+		a.verifier = v
+	}
+	return a, nil
+}
+
+func (a *authenticator) isPublic(fullMethod string) bool {
+	for _, m := range a.public {
+		if service, ok := strings.CutSuffix(m, "*"); ok {
+			if strings.HasPrefix(fullMethod, service) {
+				return true
+			}
+		} else if m == fullMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate はメタデータのAPIキーかトークンを検証し、呼び出し元の情報を入れたコンテキストを返す
+func (a *authenticator) authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(apiKeyMetadataKey)
+	if strings.HasPrefix(fullMethod, adminServicePrefix) {
+		if a.keys == nil || len(values) == 0 {
+			slog.WarnContext(ctx, "key admin service called without an API key", "method", fullMethod)
+			return nil, statusError(codes.PermissionDenied, fullMethod+" requires an API key whose scopes cover it",
+				&errdetails.ErrorInfo{
+					Reason:   reasonAPIKeyRequired,
+					Domain:   errorDomain,
+					Metadata: map[string]string{"method": fullMethod},
+				},
+				&errdetails.LocalizedMessage{Locale: "ja-JP", Message: "APIキーの管理には、管理サービスをスコープに含むAPIキーが必要です。"},
+			)
+		}
+		return a.authenticateAPIKey(ctx, fullMethod, values[0])
+	}
+	if a.isPublic(fullMethod) {
+		return ctx, nil
+	}
+	if a.keys != nil && len(values) > 0 {
+		return a.authenticateAPIKey(ctx, fullMethod, values[0])
+	}
+	if a.verifier == nil {
+		return nil, unauthenticatedError(errMissingAPIKey)
+	}
+	token, err := auth.BearerToken(md)
+	if err != nil {
+		return nil, unauthenticatedError(err)
+	}
+	claims, err := a.verifier.Verify(token)
+	if err != nil {
+		slog.WarnContext(ctx, "authentication failed", "method", fullMethod, "error", err)
+		return nil, unauthenticatedError(err)
+	}
+	return auth.NewContext(ctx, claims), nil
+}
+
+func (a *authenticator) authenticateAPIKey(ctx context.Context, fullMethod, value string) (context.Context, error) {
+	key, err := a.keys.Authenticate(value)
+	if err != nil {
+		slog.WarnContext(ctx, "authentication failed", "method", fullMethod, "error", err)
+		return nil, unauthenticatedError(err)
+	}
+	if !key.Allows(fullMethod) {
+		slog.WarnContext(ctx, "API key scope does not cover the method", "method", fullMethod, "api_key", key.ID, "scopes", key.Scopes)
+		return nil, statusError(codes.PermissionDenied, fmt.Sprintf("API key %s is not allowed to call %s", key.ID, fullMethod),
+			&errdetails.ErrorInfo{
+				Reason:   reasonAPIKeyScope,
+				Domain:   errorDomain,
+				Metadata: map[string]string{"method": fullMethod, "api_key": key.ID},
+			},
+			&errdetails.LocalizedMessage{Locale: "ja-JP", Message: "このAPIキーのスコープでは、このメソッドを呼び出せません。"},
+		)
+	}
+	return apikey.NewContext(ctx, key), nil
+}
+
+func (a *authenticator) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authenticate(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (a *authenticator) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authenticatedServerStream は呼び出し元の情報を入れたコンテキストをハンドラに渡す
+type authenticatedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// unauthenticatedError は認証の失敗をUNAUTHENTICATEDにErrorInfo・LocalizedMessageを付けて返す
+func unauthenticatedError(err error) error {
+	reason, localized := reasonTokenInvalid, "トークンが無効です。"
+	switch {
+	case errors.Is(err, auth.ErrMissingToken):
+		reason, localized = reasonTokenMissing, "認証が必要です。authorizationメタデータにBearerトークンを付けてください。"
+	case errors.Is(err, errMissingAPIKey):
+		reason, localized = reasonTokenMissing, "認証が必要です。x-api-keyメタデータにAPIキーを付けてください。"
+	case errors.Is(err, apikey.ErrInvalidKey):
+		reason, localized = reasonAPIKeyInvalid, "APIキーが無効です。"
+	case errors.Is(err, apikey.ErrExpiredKey):
+		reason, localized = reasonAPIKeyExpired, "APIキーの有効期限が切れています。"
+	case errors.Is(err, auth.ErrMalformedHeader), errors.Is(err, jwt.ErrTokenMalformed):
+		reason, localized = reasonTokenMalformed, "トークンの形式が正しくありません。"
+	case errors.Is(err, jwt.ErrTokenExpired):
+		reason, localized = reasonTokenExpired, "トークンの有効期限が切れています。新しいトークンを取得してください。"
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		reason, localized = reasonTokenNotYetValid, "トークンはまだ有効になっていません。"
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		reason, localized = reasonTokenInvalidAudience, "このサービス向けのトークンではありません。"
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		reason, localized = reasonTokenInvalidIssuer, "トークンの発行者が信頼されていません。"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		reason, localized = reasonTokenInvalidSignature, "トークンの署名を検証できません。"
+	}
+	return statusError(codes.Unauthenticated, err.Error(),
+		&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain},
+		&errdetails.LocalizedMessage{Locale: "ja-JP", Message: localized},
+	)
+}
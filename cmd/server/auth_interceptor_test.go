@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mygrpc/pkg/apikey"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newTestAuthenticator はJWTとAPIキーの両方を受け付けるauthenticatorと、JWTの署名に使う共有鍵を返す
+func newTestAuthenticator(t *testing.T, public ...string) (*authenticator, *apikey.Store, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, secret, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := apikey.Open(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuthenticator(authConfig{HMACSecretFile: secretFile, PublicMethods: public}, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, keys, secret
+}
+
+func bearerToken(t *testing.T, secret []byte) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "alice",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func createKey(t *testing.T, keys *apikey.Store, scopes ...string) string {
+	t.Helper()
+	_, value, err := keys.Create("test", scopes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// APIキーの管理サービスは、管理サービスをスコープに含むAPIキーでしか呼べない
+func TestAuthenticatorAdminService(t *testing.T) {
+	const createKeyMethod = "/myapp.ApiKeyAdminService/CreateApiKey"
+	// public_methodsに書いてあっても、管理サービスは認証なしでは呼べない
+	a, keys, secret := newTestAuthenticator(t, "/myapp.ApiKeyAdminService/*")
+	tests := []struct {
+		name string
+		md   metadata.MD
+		want codes.Code
+	}{
+		{"no credentials", metadata.MD{}, codes.PermissionDenied},
+		{"JWT only", metadata.Pairs("authorization", "Bearer "+bearerToken(t, secret)), codes.PermissionDenied},
+		{"API key without the admin scope", metadata.Pairs(apiKeyMetadataKey, createKey(t, keys, "/myapp.GreetingService/*")), codes.PermissionDenied},
+		{"API key with the admin scope", metadata.Pairs(apiKeyMetadataKey, createKey(t, keys, "/myapp.ApiKeyAdminService/*")), codes.OK},
+		{"invalid API key", metadata.Pairs(apiKeyMetadataKey, "mgk_unknown_secret"), codes.Unauthenticated},
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: createKeyMethod}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				called = true
+				if _, ok := apikey.FromContext(ctx); !ok {
+					t.Error("handler context has no API key")
+				}
+				return nil, nil
+			}
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			_, err := a.unaryInterceptor()(ctx, nil, info, handler)
+			if got := status.Code(err); got != tt.want {
+				t.Fatalf("code = %v, want %v (%v)", got, tt.want, err)
+			}
+			if called != (tt.want == codes.OK) {
+				t.Errorf("handler called = %v, want %v", called, tt.want == codes.OK)
+			}
+		})
+	}
+}
+
+// 管理サービス以外では、JWTだけの呼び出し元も通す
+func TestAuthenticatorJWT(t *testing.T) {
+	a, _, secret := newTestAuthenticator(t)
+	info := &grpc.UnaryServerInfo{FullMethod: "/myapp.GreetingService/Hello"}
+	tests := []struct {
+		name string
+		md   metadata.MD
+		want codes.Code
+	}{
+		{"JWT", metadata.Pairs("authorization", "Bearer "+bearerToken(t, secret)), codes.OK},
+		{"wrong secret", metadata.Pairs("authorization", "Bearer "+bearerToken(t, []byte("wrong"))), codes.Unauthenticated},
+		{"no credentials", metadata.MD{}, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			_, err := a.unaryInterceptor()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, nil
+			})
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("code = %v, want %v (%v)", got, tt.want, err)
+			}
+		})
+	}
+}
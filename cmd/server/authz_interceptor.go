@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"mygrpc/pkg/apikey"
+	"mygrpc/pkg/auth"
+	"mygrpc/pkg/authz"
+	"mygrpc/pkg/filewatch"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+/*-------------------------------------------------------------
+メソッドごとの認可
+
+認証で分かった呼び出し元(JWTのsub・roles、mTLSのSAN、APIキーのID)を、ポリシーファイルのルールと照合する。
+許可されなければハンドラを呼ばずにPERMISSION_DENIEDを返す。
+ポリシーファイルは証明書と同じようにポーリングで監視し、変更されたら再起動せずに差し替える。
+dry_runにすると判定をログに出すだけで、拒否はしない(新しいポリシーを試すとき用)。
+-------------------------------------------------------------*/
+
+type authorizer struct {
+	cfg     authzConfig
+	policy  atomic.Pointer[authz.Policy]
+	watcher *filewatch.Watcher
+}
+
+func newAuthorizer(cfg authzConfig) (*authorizer, error) {
+	// 読む前に状態を記録しておき、最初に読んでから監視が始まるまでの変更も拾う
+	a := &authorizer{cfg: cfg, watcher: filewatch.New(cfg.PolicyFile)}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload はポリシーファイルを読み直す。読めなかったり誤りがあれば、今のポリシーを使い続ける
+func (a *authorizer) reload() error {
+	p, err := authz.Load(a.cfg.PolicyFile)
+	if err != nil {
+		return err
+	}
+	a.policy.Store(p)
+	slog.Info("loaded authorization policy", "file", a.cfg.PolicyFile, "rules", len(p.Rules), "default", p.Default, "dry_run", a.cfg.DryRun)
+	return nil
+}
+
+// watch はctxがキャンセルされるまでポリシーファイルを監視し、変更があればリロードする
+func (a *authorizer) watch(ctx context.Context) {
+	a.watcher.Run(ctx, a.cfg.ReloadInterval, func() {
+		if err := a.reload(); err != nil {
+			slog.Error("failed to reload authorization policy, keeping the current one", "error", err)
+		}
+	})
+}
+
+// principalFromContext は認証のインターセプタとTLSがコンテキストに入れた情報から呼び出し元をまとめる
+func principalFromContext(ctx context.Context) authz.Principal {
+	var p authz.Principal
+	if claims, ok := auth.FromContext(ctx); ok {
+		p.Subject = claims.Subject
+		p.Roles = claims.Roles
+	}
+	if id, ok := peerIdentityFromContext(ctx); ok {
+		p.SANs = append(append(append(p.SANs, id.DNSNames...), id.URIs...), id.Emails...)
+	}
+	if key, ok := apikey.FromContext(ctx); ok {
+		p.APIKey = key.ID
+	}
+	return p
+}
+
+func (a *authorizer) authorize(ctx context.Context, fullMethod string) error {
+	principal := principalFromContext(ctx)
+	d := a.policy.Load().Evaluate(fullMethod, principal)
+	attrs := []any{"method", fullMethod, "allowed", d.Allowed, "rule", d.Rule, "subject", principal.Subject, "roles", principal.Roles, "sans", principal.SANs, "api_key", principal.APIKey}
+	switch {
+	case a.cfg.DryRun:
+		slog.InfoContext(ctx, "authorization decision (dry run)", attrs...)
+		return nil
+	case !d.Allowed:
+		slog.WarnContext(ctx, "permission denied", attrs...)
+		return permissionDeniedError(fullMethod, d.Rule)
+	}
+	slog.DebugContext(ctx, "authorization decision", attrs...)
+	return nil
+}
+
+func (a *authorizer) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := a.authorize(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (a *authorizer) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := a.authorize(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// permissionDeniedError はPERMISSION_DENIEDに、拒否したメソッドとルールをErrorInfoで付けて返す
+func permissionDeniedError(fullMethod, rule string) error {
+	if rule == "" {
+		rule = "default"
+	}
+	return statusError(codes.PermissionDenied, fmt.Sprintf("not allowed to call %s", fullMethod),
+		&errdetails.ErrorInfo{
+			Reason:   reasonPermissionDenied,
+			Domain:   errorDomain,
+			Metadata: map[string]string{"method": fullMethod, "rule": rule},
+		},
+		&errdetails.LocalizedMessage{Locale: "ja-JP", Message: "このメソッドを呼び出す権限がありません。"},
+	)
+}
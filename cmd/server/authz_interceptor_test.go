@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthorizerReloadsChangeBeforeWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("rules: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuthorizer(authzConfig{PolicyFile: path, ReloadInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 最初に読んでから監視を始めるまでの間に変わったファイルも読み直す
+	if err := os.WriteFile(path, []byte("rules:\n  - name: hello\n    methods: [\"/myapp.GreetingService/Hello\"]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.watch(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.policy.Load().Rules) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the policy written before watch started was not reloaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mygrpc/pkg/logging"
+	"mygrpc/pkg/ratelimit"
+	"mygrpc/pkg/tracing"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/*-------------------------------------------------------------
+サーバーの設定は以下の優先順位で決まる(下ほど強い)
+
+1. デフォルト値(defaultConfig)
+2. 設定ファイル(-config または MYGRPC_CONFIG で指定。拡張子で YAML / TOML を判定)
+3. 環境変数(MYGRPC_ + フラグ名を大文字にして - を _ に置き換えたもの。例: MYGRPC_LISTEN)
+4. コマンドラインフラグ
+-------------------------------------------------------------*/
+
+const envPrefix = "MYGRPC_"
+
+type config struct {
+	// Listen はサーバーがListenするアドレス(host:port)
+	Listen string `yaml:"listen" toml:"listen"`
+	// Interceptors は有効にするインターセプタの名前を、外側から順に並べたもの
+	Interceptors []string `yaml:"interceptors" toml:"interceptors"`
+	// Reflection はサーバーリフレクションを登録するかどうか
+	Reflection bool `yaml:"reflection" toml:"reflection"`
+	// MaxRecvMsgSize / MaxSendMsgSize は1メッセージあたりの最大バイト数
+	MaxRecvMsgSize int `yaml:"max_recv_msg_size" toml:"max_recv_msg_size"`
+	MaxSendMsgSize int `yaml:"max_send_msg_size" toml:"max_send_msg_size"`
+	// Debug がtrueならINTERNALのエラーにパニックのスタックトレース(DebugInfo)を付ける。本番では有効にしないこと
+	Debug bool `yaml:"debug" toml:"debug"`
+	// ShutdownTimeout はGracefulStopを待つ最大時間。超えたらStopで強制終了する
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// TLS はサーバー証明書とクライアント証明書の検証に関する設定
+	TLS tlsConfig `yaml:"tls" toml:"tls"`
+	// ServerStream はHelloServerStreamでクライアントが指定できるcount・intervalの範囲
+	ServerStream serverStreamConfig `yaml:"server_stream" toml:"server_stream"`
+	// Metrics はPrometheusのメトリクスを公開するHTTPリスナーの設定
+	Metrics metricsConfig `yaml:"metrics" toml:"metrics"`
+	// Tracing はOpenTelemetryのトレースの設定
+	Tracing tracingConfig `yaml:"tracing" toml:"tracing"`
+	// Log はログの形式・レベルと、ペイロードを出力するかどうか
+	Log logConfig `yaml:"log" toml:"log"`
+	// Auth はJWTのBearerトークンによる認証の設定
+	Auth authConfig `yaml:"auth" toml:"auth"`
+	// Authz はメソッドごとの認可ポリシーの設定
+	Authz authzConfig `yaml:"authz" toml:"authz"`
+	// RateLimit は呼び出し元ごとのレート制限の設定
+	RateLimit rateLimitConfig `yaml:"rate_limit" toml:"rate_limit"`
+}
+
+type rateLimitConfig struct {
+	// Key は呼び出し元を区別する方法。identity / peer / metadata:<key> のいずれか
+	Key string `yaml:"key" toml:"key"`
+	// Unary・StreamOpen・StreamMessages はメソッドごとの設定がないときの制限。rateが0なら制限しない
+	Unary          ratelimit.Limit `yaml:"unary" toml:"unary"`
+	StreamOpen     ratelimit.Limit `yaml:"stream_open" toml:"stream_open"`
+	StreamMessages ratelimit.Limit `yaml:"stream_messages" toml:"stream_messages"`
+	// Methods はメソッド("/package.Service/Method" または "/package.Service/*")ごとの制限
+	// 書いた項目だけが上書きされ、残りは上のデフォルトを使う
+	Methods map[string]methodRateLimits `yaml:"methods" toml:"methods"`
+}
+
+type methodRateLimits struct {
+	Unary          *ratelimit.Limit `yaml:"unary" toml:"unary"`
+	StreamOpen     *ratelimit.Limit `yaml:"stream_open" toml:"stream_open"`
+	StreamMessages *ratelimit.Limit `yaml:"stream_messages" toml:"stream_messages"`
+}
+
+type authzConfig struct {
+	// PolicyFile はポリシーのYAMLファイル。指定すると認可が有効になる
+	PolicyFile string `yaml:"policy_file" toml:"policy_file"`
+	// DryRun がtrueなら判定をログに出すだけで拒否しない
+	DryRun bool `yaml:"dry_run" toml:"dry_run"`
+	// ReloadInterval はポリシーファイルの変更を確認する間隔。0ならリロードしない
+	ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+}
+
+type authConfig struct {
+	// HMACSecretFile / JWKSFile のどちらかを指定するとJWTによる認証が有効になる
+	HMACSecretFile string `yaml:"hmac_secret_file" toml:"hmac_secret_file"`
+	JWKSFile       string `yaml:"jwks_file" toml:"jwks_file"`
+	// APIKeysFile を指定するとx-api-keyによる認証と、APIキーを管理するサービスが有効になる
+	// キーのハッシュを保存するファイルで、なければ作る
+	APIKeysFile string `yaml:"api_keys_file" toml:"api_keys_file"`
+	// Issuer / Audience は空でなければトークンのiss・audと照合する
+	Issuer   string `yaml:"issuer" toml:"issuer"`
+	Audience string `yaml:"audience" toml:"audience"`
+	// Leeway はexp・nbfの確認で許す時計のずれ
+	Leeway time.Duration `yaml:"leeway" toml:"leeway"`
+	// PublicMethods は認証なしで呼べるメソッド。"/package.Service/*" でサービス全体を指定できる
+	PublicMethods []string `yaml:"public_methods" toml:"public_methods"`
+}
+
+type logConfig struct {
+	// Format は text / json のいずれか
+	Format string `yaml:"format" toml:"format"`
+	// Level は debug / info / warn / error のいずれか。metrics.loglevel_endpointを有効にすれば、実行中は /loglevel で変えられる
+	Level string `yaml:"level" toml:"level"`
+	// Payloads は off / sampled / full のいずれか。sampledではPayloadSampleRateの割合のRPCだけ出力する
+	Payloads          string  `yaml:"payloads" toml:"payloads"`
+	PayloadSampleRate float64 `yaml:"payload_sample_rate" toml:"payload_sample_rate"`
+	// RedactMetadataKeys は値を伏せるメタデータのキー。authorizationなどの既定のキーに追加される
+	RedactMetadataKeys []string `yaml:"redact_metadata_keys" toml:"redact_metadata_keys"`
+}
+
+type metricsConfig struct {
+	// Listen は /metrics を公開するアドレス(host:port)。空ならメトリクスを記録しない
+	Listen string `yaml:"listen" toml:"listen"`
+	// LogLevelEndpoint がtrueなら、同じリスナーで /loglevel も公開する
+	// 認証はないので、信頼できるネットワークからしか届かないアドレスで使うこと
+	LogLevelEndpoint bool `yaml:"loglevel_endpoint" toml:"loglevel_endpoint"`
+}
+
+type serverStreamConfig struct {
+	DefaultCount    uint32        `yaml:"default_count" toml:"default_count"`
+	MaxCount        uint32        `yaml:"max_count" toml:"max_count"`
+	DefaultInterval time.Duration `yaml:"default_interval" toml:"default_interval"`
+	MinInterval     time.Duration `yaml:"min_interval" toml:"min_interval"`
+	MaxInterval     time.Duration `yaml:"max_interval" toml:"max_interval"`
+}
+
+type tlsConfig struct {
+	// CertFile / KeyFile を両方指定するとTLSが有効になる
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	// CAFile はクライアント証明書を検証するためのCA証明書(PEM)
+	CAFile string `yaml:"ca_file" toml:"ca_file"`
+	// ClientAuth は none / request / require のいずれか。requireでmTLSになる
+	ClientAuth string `yaml:"client_auth" toml:"client_auth"`
+	// ReloadInterval は証明書ファイルの変更を確認する間隔。0ならリロードしない
+	ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+}
+
+type tracingConfig struct {
+	// Exporter は none / stdout / otlp / memory のいずれか。noneならトレースしない
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	// Endpoint はotlpで送るコレクターのアドレス(host:port)
+	Endpoint    string `yaml:"endpoint" toml:"endpoint"`
+	ServiceName string `yaml:"service_name" toml:"service_name"`
+}
+
+func (c logConfig) validate() error {
+	var errs []error
+	if !slices.Contains(logging.Formats, c.Format) {
+		errs = append(errs, fmt.Errorf("log.format: unknown format %q (want %s)", c.Format, strings.Join(logging.Formats, ", ")))
+	}
+	if _, err := logging.ParseLevel(c.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	if !slices.Contains(logging.PayloadModes, c.Payloads) {
+		errs = append(errs, fmt.Errorf("log.payloads: unknown mode %q (want %s)", c.Payloads, strings.Join(logging.PayloadModes, ", ")))
+	}
+	if c.PayloadSampleRate < 0 || c.PayloadSampleRate > 1 {
+		errs = append(errs, fmt.Errorf("log.payload_sample_rate: must be between 0 and 1, got %g", c.PayloadSampleRate))
+	}
+	return errors.Join(errs...)
+}
+
+func (c tracingConfig) enabled() bool {
+	return c.Exporter != "none"
+}
+
+func (c authConfig) enabled() bool {
+	return c.jwtEnabled() || c.APIKeysFile != ""
+}
+
+func (c authConfig) jwtEnabled() bool {
+	return c.HMACSecretFile != "" || c.JWKSFile != ""
+}
+
+func (c authConfig) validate() error {
+	var errs []error
+	if c.HMACSecretFile != "" && c.JWKSFile != "" {
+		errs = append(errs, errors.New("auth: set either hmac_secret_file or jwks_file, not both"))
+	}
+	if c.Leeway < 0 {
+		errs = append(errs, fmt.Errorf("auth.leeway: must not be negative, got %s", c.Leeway))
+	}
+	for _, m := range c.PublicMethods {
+		if !strings.HasPrefix(m, "/") || strings.Count(m, "/") != 2 {
+			errs = append(errs, fmt.Errorf("auth.public_methods: %q is not /package.Service/Method or /package.Service/*", m))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c rateLimitConfig) enabled() bool {
+	return !c.Unary.Unlimited() || !c.StreamOpen.Unlimited() || !c.StreamMessages.Unlimited() || len(c.Methods) > 0
+}
+
+// limits はfullMethodに適用する制限を返す。メソッド名が完全に一致する設定、サービス全体の設定、デフォルトの順に探す
+func (c rateLimitConfig) limits(fullMethod string) rateLimitConfig {
+	l := rateLimitConfig{Unary: c.Unary, StreamOpen: c.StreamOpen, StreamMessages: c.StreamMessages}
+	service := fullMethod[:strings.LastIndex(fullMethod, "/")+1] + "*"
+	for _, key := range []string{service, fullMethod} {
+		m, ok := c.Methods[key]
+		if !ok {
+			continue
+		}
+		if m.Unary != nil {
+			l.Unary = *m.Unary
+		}
+		if m.StreamOpen != nil {
+			l.StreamOpen = *m.StreamOpen
+		}
+		if m.StreamMessages != nil {
+			l.StreamMessages = *m.StreamMessages
+		}
+	}
+	return l
+}
+
+func (c rateLimitConfig) validate() error {
+	var errs []error
+	if c.Key != "identity" && c.Key != "peer" && !(strings.HasPrefix(c.Key, "metadata:") && len(c.Key) > len("metadata:")) {
+		errs = append(errs, fmt.Errorf("rate_limit.key: unknown key %q (want identity, peer or metadata:<key>)", c.Key))
+	}
+	check := func(name string, l *ratelimit.Limit) {
+		if l != nil && (l.Rate < 0 || l.Burst < 0) {
+			errs = append(errs, fmt.Errorf("%s: rate and burst must not be negative", name))
+		}
+	}
+	check("rate_limit.unary", &c.Unary)
+	check("rate_limit.stream_open", &c.StreamOpen)
+	check("rate_limit.stream_messages", &c.StreamMessages)
+	for method, m := range c.Methods {
+		if !strings.HasPrefix(method, "/") || strings.Count(method, "/") != 2 {
+			errs = append(errs, fmt.Errorf("rate_limit.methods: %q is not /package.Service/Method or /package.Service/*", method))
+		}
+		check(fmt.Sprintf("rate_limit.methods[%s].unary", method), m.Unary)
+		check(fmt.Sprintf("rate_limit.methods[%s].stream_open", method), m.StreamOpen)
+		check(fmt.Sprintf("rate_limit.methods[%s].stream_messages", method), m.StreamMessages)
+	}
+	return errors.Join(errs...)
+}
+
+func (c authzConfig) enabled() bool {
+	return c.PolicyFile != ""
+}
+
+func (c tlsConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+func defaultConfig() *config {
+	return &config{
+		Listen:          ":8080",
+		Interceptors:    []string{"my1", "my2"},
+		Reflection:      true,
+		MaxRecvMsgSize:  4 * 1024 * 1024, // grpc-goのデフォルトと同じ4MB
+		MaxSendMsgSize:  4 * 1024 * 1024,
+		ShutdownTimeout: 30 * time.Second,
+		TLS: tlsConfig{
+			ClientAuth:     "none",
+			ReloadInterval: 10 * time.Second,
+		},
+		ServerStream: serverStreamConfig{
+			DefaultCount:    5,
+			MaxCount:        100,
+			DefaultInterval: time.Second,
+			MinInterval:     100 * time.Millisecond,
+			MaxInterval:     time.Minute,
+		},
+		Log: logConfig{
+			Format:            "text",
+			Level:             "info",
+			Payloads:          "off",
+			PayloadSampleRate: 0.01,
+		},
+		Tracing: tracingConfig{
+			Exporter:    "none",
+			Endpoint:    "localhost:4317",
+			ServiceName: "greeting-server",
+		},
+		Auth: authConfig{
+			Leeway: 30 * time.Second,
+			// ヘルスチェックとリフレクションは、トークンを持たないロードバランサーやgrpcurlからも呼べるようにする
+			PublicMethods: []string{
+				"/grpc.health.v1.Health/*",
+				"/grpc.reflection.v1.ServerReflection/*",
+				"/grpc.reflection.v1alpha.ServerReflection/*",
+			},
+		},
+		Authz: authzConfig{
+			ReloadInterval: 10 * time.Second,
+		},
+		RateLimit: rateLimitConfig{
+			Key: "identity",
+		},
+	}
+}
+
+// loadConfig はデフォルト値・設定ファイル・環境変数・フラグの順に設定を重ねて返す
+func loadConfig(args []string) (*config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to a YAML (.yaml/.yml) or TOML (.toml) config file")
+	cfg.bindFlags(fs)
+
+	// 1回目のParseは設定ファイルのパスを知るため
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *configPath == "" {
+		*configPath = os.Getenv(envPrefix + "CONFIG")
+	}
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+	// 2回目のParseで、明示的に指定されたフラグを設定ファイル・環境変数より優先させる
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+func (c *config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to listen on (host:port)")
+	fs.Var((*stringList)(&c.Interceptors), "interceptors", "comma separated interceptor chain, outermost first")
+	fs.BoolVar(&c.Reflection, "reflection", c.Reflection, "register the server reflection service")
+	fs.IntVar(&c.MaxRecvMsgSize, "max-recv-msg-size", c.MaxRecvMsgSize, "max size in bytes of a received message")
+	fs.IntVar(&c.MaxSendMsgSize, "max-send-msg-size", c.MaxSendMsgSize, "max size in bytes of a sent message")
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "include panic stack traces (DebugInfo) in INTERNAL errors; do not enable in production")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for graceful shutdown before forcing it")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "server certificate file (PEM); enables TLS")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "server private key file (PEM)")
+	fs.StringVar(&c.TLS.CAFile, "tls-ca", c.TLS.CAFile, "CA certificate file (PEM) used to verify client certificates")
+	fs.StringVar(&c.TLS.ClientAuth, "tls-client-auth", c.TLS.ClientAuth, "client certificate policy: none, request or require")
+	fs.DurationVar(&c.TLS.ReloadInterval, "tls-reload-interval", c.TLS.ReloadInterval, "how often to check the certificate files for changes (0 disables reloading)")
+	fs.Var((*uint32Value)(&c.ServerStream.DefaultCount), "stream-default-count", "HelloServerStream responses when the request has no count")
+	fs.Var((*uint32Value)(&c.ServerStream.MaxCount), "stream-max-count", "largest count a HelloServerStream request may ask for")
+	fs.DurationVar(&c.ServerStream.DefaultInterval, "stream-default-interval", c.ServerStream.DefaultInterval, "HelloServerStream interval when the request has none")
+	fs.DurationVar(&c.ServerStream.MinInterval, "stream-min-interval", c.ServerStream.MinInterval, "shortest interval a HelloServerStream request may ask for")
+	fs.DurationVar(&c.ServerStream.MaxInterval, "stream-max-interval", c.ServerStream.MaxInterval, "longest interval a HelloServerStream request may ask for")
+	fs.StringVar(&c.Metrics.Listen, "metrics-listen", c.Metrics.Listen, "address to serve Prometheus /metrics on (host:port); empty disables metrics")
+	fs.BoolVar(&c.Metrics.LogLevelEndpoint, "metrics-loglevel-endpoint", c.Metrics.LogLevelEndpoint, "also serve /loglevel, which changes the log level without authentication, on the metrics listener")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "log format: text or json")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "log level: debug, info, warn or error")
+	fs.StringVar(&c.Log.Payloads, "log-payloads", c.Log.Payloads, "log request and response payloads: off, sampled or full")
+	fs.Float64Var(&c.Log.PayloadSampleRate, "log-payload-sample-rate", c.Log.PayloadSampleRate, "fraction of RPCs whose payloads are logged when -log-payloads is sampled")
+	fs.Var((*stringList)(&c.Log.RedactMetadataKeys), "log-redact-metadata-keys", "comma separated metadata keys to redact in logs and traces, in addition to authorization etc.")
+	fs.StringVar(&c.Auth.HMACSecretFile, "auth-hmac-secret-file", c.Auth.HMACSecretFile, "file with the HMAC secret used to verify JWTs (HS256/384/512); enables auth")
+	fs.StringVar(&c.Auth.JWKSFile, "auth-jwks-file", c.Auth.JWKSFile, "JWK Set file with the keys used to verify JWTs; enables auth")
+	fs.StringVar(&c.Auth.APIKeysFile, "auth-api-keys-file", c.Auth.APIKeysFile, "file storing hashed API keys (created if missing); enables x-api-key auth and the key admin service")
+	fs.StringVar(&c.Auth.Issuer, "auth-issuer", c.Auth.Issuer, "required iss claim (empty skips the check)")
+	fs.StringVar(&c.Auth.Audience, "auth-audience", c.Auth.Audience, "required aud claim (empty skips the check)")
+	fs.DurationVar(&c.Auth.Leeway, "auth-leeway", c.Auth.Leeway, "allowed clock skew when checking exp and nbf")
+	fs.Var((*stringList)(&c.Auth.PublicMethods), "auth-public-methods", "comma separated methods callable without a token (/package.Service/Method or /package.Service/*)")
+	fs.StringVar(&c.Authz.PolicyFile, "authz-policy-file", c.Authz.PolicyFile, "YAML authorization policy file; enables per-method authorization")
+	fs.BoolVar(&c.Authz.DryRun, "authz-dry-run", c.Authz.DryRun, "only log authorization decisions instead of denying calls")
+	fs.DurationVar(&c.Authz.ReloadInterval, "authz-reload-interval", c.Authz.ReloadInterval, "how often to check the policy file for changes (0 disables reloading)")
+	fs.StringVar(&c.RateLimit.Key, "rate-limit-key", c.RateLimit.Key, "what identifies a caller for rate limiting: identity, peer or metadata:<key>")
+	fs.Var((*limitValue)(&c.RateLimit.Unary), "rate-limit-unary", "default unary calls per second per caller and method, as RATE[:BURST] (0 disables)")
+	fs.Var((*limitValue)(&c.RateLimit.StreamOpen), "rate-limit-stream-open", "default streams opened per second per caller and method, as RATE[:BURST] (0 disables)")
+	fs.Var((*limitValue)(&c.RateLimit.StreamMessages), "rate-limit-stream-messages", "default messages received per second on each stream, as RATE[:BURST] (0 disables)")
+	fs.StringVar(&c.Tracing.Exporter, "tracing-exporter", c.Tracing.Exporter, "trace exporter: none, stdout, otlp or memory")
+	fs.StringVar(&c.Tracing.Endpoint, "tracing-endpoint", c.Tracing.Endpoint, "OTLP/gRPC collector address (host:port) for the otlp exporter")
+	fs.StringVar(&c.Tracing.ServiceName, "tracing-service-name", c.Tracing.ServiceName, "service.name resource attribute of the spans")
+}
+
+func (c *config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true) // typoしたキーを黙って無視しない
+		if err := dec.Decode(c); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(b), c)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("parse %s: unknown keys %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("unsupported config file extension %q (want .yaml, .yml or .toml)", ext)
+	}
+	return nil
+}
+
+// applyEnv はフラグ名に対応する環境変数が設定されていれば、その値をフラグ経由で反映する
+func applyEnv(fs *flag.FlagSet) error {
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// validate は設定の誤りをまとめて返す
+func (c *config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %w", err))
+	}
+	seen := make(map[string]bool)
+	for _, name := range c.Interceptors {
+		if !isKnownInterceptor(name) {
+			errs = append(errs, fmt.Errorf("interceptors: unknown interceptor %q (known: %s)", name, strings.Join(interceptorNames, ", ")))
+		}
+		if seen[name] {
+			errs = append(errs, fmt.Errorf("interceptors: %q listed more than once", name))
+		}
+		seen[name] = true
+	}
+	if c.MaxRecvMsgSize <= 0 {
+		errs = append(errs, fmt.Errorf("max_recv_msg_size: must be positive, got %d", c.MaxRecvMsgSize))
+	}
+	if c.MaxSendMsgSize <= 0 {
+		errs = append(errs, fmt.Errorf("max_send_msg_size: must be positive, got %d", c.MaxSendMsgSize))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout: must not be negative, got %s", c.ShutdownTimeout))
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("metrics.listen: %w", err))
+		} else if c.Metrics.Listen == c.Listen {
+			errs = append(errs, errors.New("metrics.listen: must differ from listen"))
+		}
+	} else if c.Metrics.LogLevelEndpoint {
+		errs = append(errs, errors.New("metrics.loglevel_endpoint: requires metrics.listen"))
+	}
+	if c.Authz.ReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("authz.reload_interval: must not be negative, got %s", c.Authz.ReloadInterval))
+	}
+	if !slices.Contains(tracing.Exporters, c.Tracing.Exporter) {
+		errs = append(errs, fmt.Errorf("tracing.exporter: unknown exporter %q (want %s)", c.Tracing.Exporter, strings.Join(tracing.Exporters, ", ")))
+	}
+	errs = append(errs, c.Log.validate(), c.Auth.validate(), c.TLS.validate(), c.ServerStream.validate(), c.RateLimit.validate())
+	return errors.Join(errs...)
+}
+
+func (c serverStreamConfig) validate() error {
+	var errs []error
+	if c.MaxCount == 0 {
+		errs = append(errs, errors.New("server_stream.max_count: must be positive"))
+	}
+	if c.DefaultCount > c.MaxCount {
+		errs = append(errs, fmt.Errorf("server_stream.default_count: %d exceeds max_count %d", c.DefaultCount, c.MaxCount))
+	}
+	if c.MinInterval < 0 || c.MinInterval > c.MaxInterval {
+		errs = append(errs, fmt.Errorf("server_stream: need 0 <= min_interval <= max_interval, got %s and %s", c.MinInterval, c.MaxInterval))
+	}
+	if c.DefaultInterval < c.MinInterval || c.DefaultInterval > c.MaxInterval {
+		errs = append(errs, fmt.Errorf("server_stream.default_interval: %s is outside [%s, %s]", c.DefaultInterval, c.MinInterval, c.MaxInterval))
+	}
+	return errors.Join(errs...)
+}
+
+func (c tlsConfig) validate() error {
+	var errs []error
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs = append(errs, errors.New("tls: cert_file and key_file must be set together"))
+	}
+	switch c.ClientAuth {
+	case "none":
+	case "request", "require":
+		if !c.enabled() {
+			errs = append(errs, fmt.Errorf("tls.client_auth: %q requires cert_file and key_file", c.ClientAuth))
+		}
+		if c.CAFile == "" {
+			errs = append(errs, fmt.Errorf("tls.client_auth: %q requires ca_file", c.ClientAuth))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tls.client_auth: unknown value %q (want none, request or require)", c.ClientAuth))
+	}
+	if c.ReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("tls.reload_interval: must not be negative, got %s", c.ReloadInterval))
+	}
+	return errors.Join(errs...)
+}
+
+// stringList はカンマ区切りの文字列をスライスとして受け取るflag.Value
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// uint32Value はflagパッケージにないuint32用のflag.Value
+type uint32Value uint32
+
+func (v *uint32Value) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*v), 10)
+}
+
+func (v *uint32Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	*v = uint32Value(n)
+	return nil
+}
+
+// limitValue はレート制限を "RATE[:BURST]"(例: 10:20)で受け取るflag.Value
+type limitValue ratelimit.Limit
+
+func (v *limitValue) String() string {
+	if v == nil || v.Rate == 0 {
+		return "0"
+	}
+	if v.Burst == 0 {
+		return strconv.FormatFloat(v.Rate, 'g', -1, 64)
+	}
+	return fmt.Sprintf("%g:%d", v.Rate, v.Burst)
+}
+
+func (v *limitValue) Set(s string) error {
+	rate, burst, hasBurst := strings.Cut(s, ":")
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil {
+		return fmt.Errorf("rate: %w", err)
+	}
+	b := 0
+	if hasBurst {
+		if b, err = strconv.Atoi(burst); err != nil {
+			return fmt.Errorf("burst: %w", err)
+		}
+	}
+	*v = limitValue{Rate: r, Burst: b}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig はnameのファイルをテスト用のディレクトリに書き、パスを返す
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// デフォルト値 < 設定ファイル < 環境変数 < フラグ の順に優先する
+func TestLoadConfigPrecedence(t *testing.T) {
+	yamlFile := "listen: \":9001\"\nlog:\n  level: debug\n"
+	tomlFile := "listen = \":9001\"\n[log]\nlevel = \"debug\"\n"
+	tests := []struct {
+		name      string
+		fileName  string
+		file      string
+		env       map[string]string
+		args      []string
+		wantAddr  string
+		wantLevel string
+	}{
+		{name: "defaults", wantAddr: ":8080", wantLevel: "info"},
+		{name: "yaml file", fileName: "server.yaml", file: yamlFile, wantAddr: ":9001", wantLevel: "debug"},
+		{name: "toml file", fileName: "server.toml", file: tomlFile, wantAddr: ":9001", wantLevel: "debug"},
+		{
+			name: "env over file", fileName: "server.yaml", file: yamlFile,
+			env:      map[string]string{"MYGRPC_LISTEN": ":9002"},
+			wantAddr: ":9002", wantLevel: "debug",
+		},
+		{
+			name: "flag over env and file", fileName: "server.yaml", file: yamlFile,
+			env:      map[string]string{"MYGRPC_LISTEN": ":9002", "MYGRPC_LOG_LEVEL": "warn"},
+			args:     []string{"-listen", ":9003"},
+			wantAddr: ":9003", wantLevel: "warn",
+		},
+		{
+			name: "config path from env", fileName: "server.yaml", file: yamlFile,
+			env:      map[string]string{"MYGRPC_CONFIG": "<file>"},
+			wantAddr: ":9001", wantLevel: "debug",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			var path string
+			if tt.file != "" {
+				path = writeConfig(t, tt.fileName, tt.file)
+			}
+			if _, ok := tt.env["MYGRPC_CONFIG"]; !ok && path != "" {
+				args = append([]string{"-config", path}, args...)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, strings.ReplaceAll(v, "<file>", path))
+			}
+
+			cfg, err := loadConfig(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Listen != tt.wantAddr || cfg.Log.Level != tt.wantLevel {
+				t.Errorf("listen = %q, log.level = %q, want %q, %q", cfg.Listen, cfg.Log.Level, tt.wantAddr, tt.wantLevel)
+			}
+			// 指定しなかった項目はデフォルトのまま
+			if cfg.ShutdownTimeout != 30*time.Second {
+				t.Errorf("shutdown_timeout = %s, want the default 30s", cfg.ShutdownTimeout)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name, fileName, file, want string
+	}{
+		{"yaml", "server.yaml", "listen: \":9001\"\nlsiten: \":9002\"\n", "lsiten"},
+		{"yaml nested", "server.yaml", "log:\n  levle: debug\n", "levle"},
+		{"toml", "server.toml", "lsiten = \":9002\"\n", "lsiten"},
+		{"extension", "server.json", "{}", "unsupported config file extension"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig([]string{"-config", writeConfig(t, tt.fileName, tt.file)})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsInvalidEnv(t *testing.T) {
+	t.Setenv("MYGRPC_SHUTDOWN_TIMEOUT", "soon")
+	_, err := loadConfig(nil)
+	if err == nil || !strings.Contains(err.Error(), "MYGRPC_SHUTDOWN_TIMEOUT") {
+		t.Errorf("err = %v, want it to name MYGRPC_SHUTDOWN_TIMEOUT", err)
+	}
+}
+
+// validateは最初の誤りで止めずに、すべての誤りをまとめて返す
+func TestConfigValidateJoinsErrors(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Listen = "no-port"
+	cfg.MaxRecvMsgSize = 0
+	cfg.ShutdownTimeout = -time.Second
+	cfg.Log.Level = "loud"
+	cfg.Metrics.LogLevelEndpoint = true
+
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("validate() = nil, want errors")
+	}
+	for _, want := range []string{"listen:", "max_recv_msg_size:", "shutdown_timeout:", "log.level", "metrics.loglevel_endpoint:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+	if err := defaultConfig().validate(); err != nil {
+		t.Errorf("default config is invalid: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+/*-------------------------------------------------------------
+リッチなエラーモデル
+
+status.Statusにはコードとメッセージのほかに、google.rpcで定義された詳細(details)を付けられる。
+クライアントはstatus.FromErrorで取り出したStatusのDetailsから、型ごとに情報を読み取れる。
+
+・BadRequest       どのフィールドがなぜ不正なのか
+・ErrorInfo        機械向けのエラー理由(reason)とドメイン
+・RetryInfo        どれだけ待てば再試行してよいか
+・QuotaFailure     どの呼び出し元がどの制限を超えたのか
+・LocalizedMessage 利用者に見せるための翻訳済みメッセージ
+・DebugInfo        スタックトレースなどの開発者向けの情報(debugが有効なときだけ)
+-------------------------------------------------------------*/
+
+// errorDomain はErrorInfoに入れる、エラーを返したサービスのドメイン
+const errorDomain = "greeting.myapp.example.com"
+
+// ErrorInfoのreason。クライアントはこの値で処理を分岐できる
+const (
+	reasonInvalidField           = "INVALID_FIELD"
+	reasonInvalidStreamParameter = "INVALID_STREAM_PARAMETER"
+	reasonServerShuttingDown     = "SERVER_SHUTTING_DOWN"
+	reasonTokenMissing           = "TOKEN_MISSING"
+	reasonTokenMalformed         = "TOKEN_MALFORMED"
+	reasonTokenExpired           = "TOKEN_EXPIRED"
+	reasonTokenNotYetValid       = "TOKEN_NOT_YET_VALID"
+	reasonTokenInvalidAudience   = "TOKEN_INVALID_AUDIENCE"
+	reasonTokenInvalidIssuer     = "TOKEN_INVALID_ISSUER"
+	reasonTokenInvalidSignature  = "TOKEN_INVALID_SIGNATURE"
+	reasonTokenInvalid           = "TOKEN_INVALID"
+	reasonPermissionDenied       = "PERMISSION_DENIED"
+	reasonAPIKeyInvalid          = "API_KEY_INVALID"
+	reasonAPIKeyExpired          = "API_KEY_EXPIRED"
+	reasonAPIKeyScope            = "API_KEY_SCOPE_INSUFFICIENT"
+	reasonAPIKeyRequired         = "API_KEY_REQUIRED"
+	reasonAPIKeyNotFound         = "API_KEY_NOT_FOUND"
+	reasonAPIKeyRevoked          = "API_KEY_REVOKED"
+	reasonRateLimited            = "RATE_LIMITED"
+)
+
+// statusError は詳細付きのstatusエラーを作る
+// 詳細を付けられなかった場合でも、コードとメッセージだけのエラーは返す
+func statusError(code codes.Code, msg string, details ...protoadapt.MessageV1) error {
+	st, err := status.New(code, msg).WithDetails(details...)
+	if err != nil {
+		return status.Error(code, msg)
+	}
+	return st.Err()
+}
+
+// invalidArgumentError はINVALID_ARGUMENTにBadRequest・ErrorInfo・LocalizedMessageを付けて返す
+func invalidArgumentError(reason, localized string, violations ...*errdetails.BadRequest_FieldViolation) error {
+	msg := "invalid request"
+	if len(violations) > 0 {
+		msg = fmt.Sprintf("invalid %s: %s", violations[0].GetField(), violations[0].GetDescription())
+	}
+	return statusError(codes.InvalidArgument, msg,
+		&errdetails.BadRequest{FieldViolations: violations},
+		&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain},
+		&errdetails.LocalizedMessage{Locale: "ja-JP", Message: localized},
+	)
+}
+
+// shutdownError はシャットダウン中であることを、再試行までの目安と一緒に返す
+func shutdownError() error {
+	return statusError(codes.Unavailable, errServerShutdown.Error(),
+		&errdetails.ErrorInfo{Reason: reasonServerShuttingDown, Domain: errorDomain},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Second)},
+		&errdetails.LocalizedMessage{Locale: "ja-JP", Message: "サーバーを停止しています。しばらくしてから再接続してください。"},
+	)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// peerIdentity はmTLSで検証済みのクライアント証明書から取り出した呼び出し元の情報
+type peerIdentity struct {
+	Subject    string
+	CommonName string
+	DNSNames   []string
+	URIs       []string
+	Emails     []string
+	IPs        []string
+}
+
+// Name は挨拶などに使う表示名。CNがなければ最初のSANを使う
+func (id *peerIdentity) Name() string {
+	switch {
+	case id.CommonName != "":
+		return id.CommonName
+	case len(id.DNSNames) > 0:
+		return id.DNSNames[0]
+	case len(id.URIs) > 0:
+		return id.URIs[0]
+	case len(id.Emails) > 0:
+		return id.Emails[0]
+	}
+	return id.Subject
+}
+
+// peerIdentityFromContext はハンドラ・インターセプタが受け取ったコンテキストから呼び出し元の証明書情報を取り出す
+// gRPCはコネクションの情報をpeer.Peerとしてコンテキストに入れているので、そこから検証済みの証明書チェーンを読む
+func peerIdentityFromContext(ctx context.Context) (*peerIdentity, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil, false
+	}
+	// VerifiedChainsはClientCAsで検証できた場合にだけ埋まる
+	chains := tlsInfo.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil, false
+	}
+	return newPeerIdentity(chains[0][0]), true
+}
+
+func newPeerIdentity(cert *x509.Certificate) *peerIdentity {
+	id := &peerIdentity{
+		Subject:    cert.Subject.String(),
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+		Emails:     cert.EmailAddresses,
+	}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		id.IPs = append(id.IPs, ip.String())
+	}
+	return id
+}
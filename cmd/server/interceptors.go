@@ -0,0 +1,35 @@
+package main
+
+import (
+	"google.golang.org/grpc"
+)
+
+// interceptorNames は設定ファイルのinterceptorsで指定できる名前の一覧
+var interceptorNames = []string{"my1", "my2"}
+
+func isKnownInterceptor(name string) bool {
+	for _, n := range interceptorNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// chainInterceptors は名前のリストから、ChainUnaryInterceptor・ChainStreamInterceptorに渡すインターセプタを組み立てる
+// 名前はconfig.validateで検証済みであることを前提とする
+func chainInterceptors(names []string) ([]grpc.UnaryServerInterceptor, []grpc.StreamServerInterceptor) {
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	for _, name := range names {
+		switch name {
+		case "my1":
+			unary = append(unary, myUnaryServerInterceptor1())
+			stream = append(stream, myStreamServerInterceptor1())
+		case "my2":
+			unary = append(unary, myUnaryServerInterceptor2())
+			stream = append(stream, myStreamServerInterceptor2())
+		}
+	}
+	return unary, stream
+}
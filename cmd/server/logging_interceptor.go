@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"mygrpc/pkg/logging"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/*-------------------------------------------------------------
+アクセスログ
+
+RPCが終わるたびに、メソッド・接続元・所要時間・ステータスコード・リクエストID・メッセージのサイズを1行で出力する。
+レベルはステータスコードで決まる(OKはInfo、クライアントの誤りはWarn、サーバーの問題はError)。
+リクエスト・レスポンスの中身はlog.payloadsの設定に従って、1メッセージ1行で出力する。
+-------------------------------------------------------------*/
+
+// rpcAttrs はRPCのログに共通で付ける属性
+func rpcAttrs(ctx context.Context, rpcType, fullMethod string) []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("method", fullMethod),
+		slog.String("type", rpcType),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		attrs = append(attrs, slog.String("peer", p.Addr.String()))
+	}
+	// request_idはコンテキストから、Loggerが自動で付ける
+	return attrs
+}
+
+// logFinished はRPCの終了を、ステータスコードに応じたレベルで出力する
+func logFinished(ctx context.Context, logger *slog.Logger, start time.Time, err error, attrs ...slog.Attr) {
+	code := status.Code(err)
+	attrs = append(attrs,
+		slog.String("code", code.String()),
+		slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+	)
+	if err != nil {
+		attrs = append(attrs, slog.String("error", status.Convert(err).Message()))
+	}
+	logger.LogAttrs(ctx, logging.ServerCodeLevel(code), "finished call", attrs...)
+}
+
+func loggingUnaryServerInterceptor(payloads logging.PayloadPolicy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		logger := slog.Default().With(attrsToArgs(rpcAttrs(ctx, "unary", info.FullMethod))...)
+		logPayload := payloads.Sample()
+		if logPayload {
+			logger.LogAttrs(ctx, slog.LevelInfo, "request payload", logging.Payload(req))
+		}
+
+		res, err := handler(ctx, req)
+
+		if logPayload && err == nil {
+			logger.LogAttrs(ctx, slog.LevelInfo, "response payload", logging.Payload(res))
+		}
+		attrs := []slog.Attr{slog.Int("request_size", logging.Size(req))}
+		if err == nil {
+			attrs = append(attrs, slog.Int("response_size", logging.Size(res)))
+		}
+		logFinished(ctx, logger, start, err, attrs...)
+		return res, err
+	}
+}
+
+func loggingStreamServerInterceptor(payloads logging.PayloadPolicy) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		ctx := ss.Context()
+		s := &loggingServerStream{
+			ServerStream: ss,
+			logger:       slog.Default().With(attrsToArgs(rpcAttrs(ctx, streamRPCType(info), info.FullMethod))...),
+			logPayload:   payloads.Sample(),
+		}
+
+		err := handler(srv, s)
+
+		logFinished(ctx, s.logger, start, err,
+			slog.Int64("msgs_received", s.received.Load()),
+			slog.Int64("msgs_sent", s.sent.Load()),
+			slog.Int64("bytes_received", s.receivedBytes.Load()),
+			slog.Int64("bytes_sent", s.sentBytes.Load()),
+		)
+		return err
+	}
+}
+
+// loggingServerStream は送受信したメッセージの数とサイズを数え、必要ならペイロードを出力する
+// 受信はハンドラとは別のgoroutine(recvRequests)から呼ばれることがあるので、カウンターはatomicにする
+type loggingServerStream struct {
+	grpc.ServerStream
+	logger     *slog.Logger
+	logPayload bool
+
+	sent, received           atomic.Int64
+	sentBytes, receivedBytes atomic.Int64
+}
+
+func (s *loggingServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		n := s.sent.Add(1)
+		s.sentBytes.Add(int64(logging.Size(m)))
+		if s.logPayload {
+			s.logger.LogAttrs(s.Context(), slog.LevelInfo, "response payload", slog.Int64("index", n-1), logging.Payload(m))
+		}
+	}
+	return err
+}
+
+func (s *loggingServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		n := s.received.Add(1)
+		s.receivedBytes.Add(int64(logging.Size(m)))
+		if s.logPayload {
+			s.logger.LogAttrs(s.Context(), slog.LevelInfo, "request payload", slog.Int64("index", n-1), logging.Payload(m))
+		}
+	}
+	return err
+}
+
+func attrsToArgs(attrs []slog.Attr) []any {
+	args := make([]any, len(attrs))
+	for i, a := range attrs {
+		args[i] = a
+	}
+	return args
+}
@@ -2,34 +2,51 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
-	"errors"
-	"io"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
-	// "google.golang.org/grpc/codes"
-	// "google.golang.org/grpc/status"
-	// "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoregistry"
 
 	"google.golang.org/grpc/metadata"
 
+	"mygrpc/pkg/apikey"
+	"mygrpc/pkg/auth"
 	hellopb "mygrpc/pkg/grpc"
+	"mygrpc/pkg/logging"
+	"mygrpc/pkg/redact"
+	"mygrpc/pkg/tracing"
 )
 
 type myServer struct {
 	hellopb.UnimplementedGreetingServiceServer
+
+	serverStream serverStreamConfig
+	// redactor はログに出すメタデータから、トークンなどの値を伏せる
+	redactor *redact.MetadataRedactor
+	// recoverer はRecvを呼ぶgoroutineでのパニックをINTERNALに変える
+	recoverer *recoverer
 }
 
 func (s *myServer) Hello(ctx context.Context, in *hellopb.HelloRequest) (*hellopb.HelloResponse, error) {
 	// Unary RPCの場合には、メソッドの第一引数で受け取ったコンテキストをそのまま使えばOK
 	if md, ok := metadata.FromIncomingContext(ctx); ok {
-		log.Printf("metadata: %v\n", md)
+		slog.DebugContext(ctx, "metadata", "md", s.redactor.Redact(md))
 	}
 
 	// メタデータを生成した後、それぞれgrpc.SetHeader関数とgrpc.SetTrailerを用いてヘッダーとトレーラーを指定する
@@ -43,51 +60,126 @@ func (s *myServer) Hello(ctx context.Context, in *hellopb.HelloRequest) (*hellop
 		return nil, err
 	}
 
-	log.Printf("received: %v\n", in.GetName())
-	return &hellopb.HelloResponse{Message: fmt.Sprintf("Hello, %s!", in.GetName())}, nil
-
-	// stat := status.New(codes.Unknown, "unknown error occurred")
-	// stat, _ = stat.WithDetails(&errdetails.DebugInfo{
-	// 	Detail: "detail reason of err",
-	// })
-	// err := stat.Err()
-	// return nil, err
+	message := fmt.Sprintf("Hello, %s!", in.GetName())
+	// mTLSで接続してきた場合は、クライアント証明書の名前でも挨拶する
+	if id, ok := peerIdentityFromContext(ctx); ok {
+		slog.InfoContext(ctx, "peer identity", "subject", id.Subject, "dns", id.DNSNames, "uri", id.URIs)
+		message = fmt.Sprintf("Hello, %s! You are authenticated as %s.", in.GetName(), id.Name())
+	}
+	// JWTで認証された場合は、トークンのsubjectで挨拶する
+	if claims, ok := auth.FromContext(ctx); ok {
+		slog.InfoContext(ctx, "token claims", "subject", claims.Subject, "issuer", claims.Issuer, "roles", claims.Roles)
+		message = fmt.Sprintf("Hello, %s! You are authenticated as %s.", in.GetName(), claims.Subject)
+	}
+	// APIキーで認証された場合は、キーの名前で挨拶する
+	if key, ok := apikey.FromContext(ctx); ok {
+		message = fmt.Sprintf("Hello, %s! You are authenticated with API key %s (%s).", in.GetName(), key.Name, key.ID)
+	}
+	return &hellopb.HelloResponse{Message: message}, nil
 }
 
 func (s *myServer) HelloServerStream(in *hellopb.HelloRequest, stream hellopb.GreetingService_HelloServerStreamServer) error {
-	resCount := 5
-	for i := 0; i < resCount; i++ {
+	resCount, interval, err := s.serverStreamParams(in)
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	// time.Sleepと違い、Tickerならselectでコンテキストのキャンセルと同時に待てる
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; i < int(resCount); i++ {
+		if i > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				if isShuttingDown(ctx) {
+					// シャットダウンが始まったら、最後のメッセージを送ってから終了する
+					_ = stream.Send(&hellopb.HelloResponse{Message: fmt.Sprintf("Goodbye, %s! The server is shutting down.", in.GetName())})
+					return shutdownError()
+				}
+				// クライアントのキャンセルならCANCELED、デッドライン超過ならDEADLINE_EXCEEDEDになる
+				return status.FromContextError(ctx.Err()).Err()
+			}
+		}
 		// レスポンスを返したいときには、Sendメソッドの引数にHelloResponse型を渡すことでそれがクライアントに送信される
 		if err := stream.Send(&hellopb.HelloResponse{Message: fmt.Sprintf("Hello, %s! [%d]", in.GetName(), i)}); err != nil {
 			return err
 		}
-		time.Sleep(time.Second * 1)
 	}
 	// return文でメソッドを終了させる=ストリームの終わり
 	return nil
 }
 
+// serverStreamParams はリクエストのcount・intervalを、省略時はデフォルト値で補ったうえで上限・下限を確認する
+func (s *myServer) serverStreamParams(in *hellopb.HelloRequest) (uint32, time.Duration, error) {
+	limits := s.serverStream
+	var violations []*errdetails.BadRequest_FieldViolation
+
+	count := limits.DefaultCount
+	if in.Count != nil {
+		count = in.GetCount()
+	}
+	if count > limits.MaxCount {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       "count",
+			Description: fmt.Sprintf("must be at most %d, got %d", limits.MaxCount, count),
+		})
+	}
+
+	interval := limits.DefaultInterval
+	if in.GetInterval() != nil {
+		interval = in.GetInterval().AsDuration()
+		if err := in.GetInterval().CheckValid(); err != nil {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "interval", Description: err.Error()})
+		}
+	}
+	if interval < limits.MinInterval || interval > limits.MaxInterval {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       "interval",
+			Description: fmt.Sprintf("must be between %s and %s, got %s", limits.MinInterval, limits.MaxInterval, interval),
+		})
+	}
+
+	if len(violations) > 0 {
+		return 0, 0, invalidArgumentError(reasonInvalidStreamParameter,
+			fmt.Sprintf("回数は%d以下、間隔は%sから%sの間で指定してください。", limits.MaxCount, limits.MinInterval, limits.MaxInterval),
+			violations...)
+	}
+	return count, interval, nil
+}
+
 func (s *myServer) HelloClientStream(stream hellopb.GreetingService_HelloClientStreamServer) error {
 	nameList := make([]string, 0)
+	// streamのRecvメソッドを呼び出してリクエスト内容を取得する
+	// シャットダウンの通知と同時に待てるよう、Recvは別のgoroutineで呼ぶ
+	reqs := recvRequests(stream.Context(), stream.Recv, s.recoverRecv(stream.Context(), "client_stream"))
 	for {
-		// streamのRecvメソッドを呼び出してリクエスト内容を取得する
-		req, err := stream.Recv()
-		if errors.Is(err, io.EOF) {
+		var r recvResult
+		select {
+		case r = <-reqs:
+		case <-stream.Context().Done():
+			if isShuttingDown(stream.Context()) {
+				return shutdownError()
+			}
+			return stream.Context().Err()
+		}
+		if errors.Is(r.err, io.EOF) {
 			// リクエストを全て受け取った後の処理
 			message := fmt.Sprintf("Hello, %s!", nameList)
 			return stream.SendAndClose(&hellopb.HelloResponse{Message: message})
 		}
-		if err != nil {
-			return err
+		if r.err != nil {
+			return r.err
 		}
-		nameList = append(nameList, req.GetName())
+		nameList = append(nameList, r.req.GetName())
 	}
 }
 
 func (s *myServer) HelloBiStreams(stream hellopb.GreetingService_HelloBiStreamsServer) error {
 	// NOTE: Stream RPCの場合にはストリーム型のContextメソッドから取り出す必要あり
 	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
-		log.Println(md)
+		slog.DebugContext(stream.Context(), "metadata", "md", s.redactor.Redact(md))
 	}
 
 	headerMD := metadata.New(map[string]string{"type": "stream", "from": "server", "in": "header"})
@@ -97,17 +189,28 @@ func (s *myServer) HelloBiStreams(stream hellopb.GreetingService_HelloBiStreamsS
 	trailerMD := metadata.New(map[string]string{"type": "stream", "from": "server", "in": "trailer"})
 	stream.SetTrailer(trailerMD)
 
+	// クライアントからのリクエストを受け取るためのメソッドRecvを呼び出す
+	reqs := recvRequests(stream.Context(), stream.Recv, s.recoverRecv(stream.Context(), "bidi_stream"))
 	for {
-		// クライアントからのリクエストを受け取るためのメソッドRecvを呼び出す
-		req, err := stream.Recv()
+		var r recvResult
+		select {
+		case r = <-reqs:
+		case <-stream.Context().Done():
+			if isShuttingDown(stream.Context()) {
+				// シャットダウンが始まったら、最後のメッセージを送ってから終了する
+				_ = stream.Send(&hellopb.HelloResponse{Message: "Goodbye! The server is shutting down."})
+				return shutdownError()
+			}
+			return stream.Context().Err()
+		}
 		// 得られたエラーがio.EOFならばもうリクエストは送られてこない
-		if errors.Is(err, io.EOF) {
+		if errors.Is(r.err, io.EOF) {
 			return nil
 		}
-		if err != nil {
-			return err
+		if r.err != nil {
+			return r.err
 		}
-		log.Printf("received: %v\n", req.GetName())
+		req := r.req
 		// サーバーからのレスポンスを送信するためのメソッドSendを呼び出す
 		if err := stream.Send(&hellopb.HelloResponse{Message: fmt.Sprintf("Hello, %s!", req.GetName())}); err != nil {
 			return err
@@ -115,32 +218,194 @@ func (s *myServer) HelloBiStreams(stream hellopb.GreetingService_HelloBiStreamsS
 	}
 }
 
-func NewMyServer() *myServer {
-	return &myServer{}
+func NewMyServer(cfg *config, recoverer *recoverer) *myServer {
+	return &myServer{
+		serverStream: cfg.ServerStream,
+		redactor:     redact.NewMetadataRedactor(cfg.Log.RedactMetadataKeys...),
+		recoverer:    recoverer,
+	}
+}
+
+// recoverRecv はrecvRequestsのgoroutineでのパニックを、インターセプタと同じように記録してエラーに変える
+func (s *myServer) recoverRecv(ctx context.Context, rpcType string) func(p interface{}) error {
+	return func(p interface{}) error {
+		fullMethod, _ := grpc.Method(ctx)
+		return s.recoverer.recovered(ctx, rpcType, fullMethod, p)
+	}
 }
 
 func main() {
-	port := "8080"
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+
+	// 設定の検証でレベルは確認済み
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(level)
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, logLevel)
+	if err != nil {
+		log.Fatalf("failed to set up logging: %v", err)
+	}
+	// log.Printfの出力もこのLoggerを通るようになる
+	slog.SetDefault(logger)
+
+	listener, err := net.Listen("tcp", cfg.Listen)
 	if err != nil {
 		panic(err)
 	}
 
-	server := grpc.NewServer(
+	shutdown := newShutdownNotifier()
+	unaryInterceptors, streamInterceptors := chainInterceptors(cfg.Interceptors)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.Authz.enabled() {
+		authorizer, err := newAuthorizer(cfg.Authz)
+		if err != nil {
+			log.Fatalf("failed to set up authorization: %v", err)
+		}
+		if cfg.Authz.ReloadInterval > 0 {
+			go authorizer.watch(ctx)
+		}
+		// 認証で分かった呼び出し元を使うので、認証のすぐ内側に置く
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{authorizer.unaryInterceptor()}, unaryInterceptors...)
+		streamInterceptors = append([]grpc.StreamServerInterceptor{authorizer.streamInterceptor()}, streamInterceptors...)
+	}
+	if cfg.RateLimit.enabled() {
+		limiter := newRateLimiter(cfg.RateLimit)
+		go limiter.sweep(ctx)
+		// 呼び出し元を認証の結果で区別できるよう認証の内側に、拒否される呼び出しも数えるよう認可の外側に置く
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{limiter.unaryInterceptor()}, unaryInterceptors...)
+		streamInterceptors = append([]grpc.StreamServerInterceptor{limiter.streamInterceptor()}, streamInterceptors...)
+	}
+	var apiKeys *apikey.Store
+	if cfg.Auth.APIKeysFile != "" {
+		if apiKeys, err = openAPIKeys(cfg.Auth.APIKeysFile); err != nil {
+			log.Fatalf("failed to open API keys: %v", err)
+		}
+		// 最終使用時刻はRPCのたびには書かず、まとめて書く
+		go apiKeys.FlushEvery(ctx, time.Minute, func(err error) {
+			slog.Error("failed to save API key last-used times", "error", err)
+		})
+	}
+	if cfg.Auth.enabled() {
+		authn, err := newAuthenticator(cfg.Auth, apiKeys)
+		if err != nil {
+			log.Fatalf("failed to set up auth: %v", err)
+		}
+		// 認証に失敗したRPCもアクセスログ・メトリクスに残るよう、それらより内側に置く
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{authn.unaryInterceptor()}, unaryInterceptors...)
+		streamInterceptors = append([]grpc.StreamServerInterceptor{authn.streamInterceptor()}, streamInterceptors...)
+	}
+	var registry *prometheus.Registry
+	var panicRegistry prometheus.Registerer
+	if cfg.Metrics.Listen != "" {
+		registry = newMetricsRegistry()
+		panicRegistry = registry
+	}
+	// パニックからの復帰は2か所に置く。ここ(メトリクス・トレース・アクセスログのすぐ内側)に置くのは、
+	// パニックしたRPCをそれらがINTERNALとして記録できるようにするため。
+	// チェーンの一番外側にも置くのは、それらのインターセプタ自身のパニックも拾うため
+	recoverer := newRecoverer(panicRegistry, cfg.Debug)
+	unaryInterceptors = append([]grpc.UnaryServerInterceptor{recoverer.unaryInterceptor()}, unaryInterceptors...)
+	streamInterceptors = append([]grpc.StreamServerInterceptor{recoverer.streamInterceptor()}, streamInterceptors...)
+	// アクセスログは設定とは関係なく常に出す。トレースIDを付けられるよう、トレースより内側に置く
+	payloads := logging.PayloadPolicy{Mode: cfg.Log.Payloads, SampleRate: cfg.Log.PayloadSampleRate}
+	unaryInterceptors = append([]grpc.UnaryServerInterceptor{loggingUnaryServerInterceptor(payloads)}, unaryInterceptors...)
+	streamInterceptors = append([]grpc.StreamServerInterceptor{loggingStreamServerInterceptor(payloads)}, streamInterceptors...)
+	// シャットダウンの通知はハンドラまで届けばよいので、設定とは関係なく常に挟む
+	streamInterceptors = append([]grpc.StreamServerInterceptor{shutdown.streamInterceptor()}, streamInterceptors...)
+	// リクエストの検証も常に行う。不正なリクエストも他のインターセプタで記録できるよう、一番内側に置く
+	if err := compileValidationPatterns(protoregistry.GlobalFiles); err != nil {
+		log.Fatalf("failed to set up request validation: %v", err)
+	}
+	unaryInterceptors = append(unaryInterceptors, validateUnaryServerInterceptor())
+	streamInterceptors = append(streamInterceptors, validateStreamServerInterceptor())
+
+	if cfg.Tracing.enabled() {
+		provider, err := tracing.Setup(ctx, tracing.Config{
+			Exporter:    cfg.Tracing.Exporter,
+			Endpoint:    cfg.Tracing.Endpoint,
+			ServiceName: cfg.Tracing.ServiceName,
+		})
+		if err != nil {
+			log.Fatalf("failed to set up tracing: %v", err)
+		}
+		defer func() {
+			// 終了前に、バッファに残っているスパンを送り出す
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := provider.Shutdown(ctx); err != nil {
+				slog.Error("failed to flush spans", "error", err)
+			}
+		}()
+		// 他のインターセプタやハンドラがスパンのコンテキストを使えるよう、外側に置く
+		redactor := redact.NewMetadataRedactor(cfg.Log.RedactMetadataKeys...)
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{tracingUnaryServerInterceptor(redactor)}, unaryInterceptors...)
+		streamInterceptors = append([]grpc.StreamServerInterceptor{tracingStreamServerInterceptor(redactor)}, streamInterceptors...)
+	}
+	if registry != nil {
+		// メトリクスはすべてのRPCを、他のインターセプタでエラーになったものも含めて数えたいので、一番外側に置く
+		metrics := newServerMetrics(registry)
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{metrics.unaryInterceptor()}, unaryInterceptors...)
+		streamInterceptors = append([]grpc.StreamServerInterceptor{metrics.streamInterceptor()}, streamInterceptors...)
+	}
+	// リクエストIDは他のインターセプタのログにも付けたいので、外側に置く
+	// IDは外側のrecovererが先に決めてコンテキストに入れ、ここではそれをメタデータで返す
+	unaryInterceptors = append([]grpc.UnaryServerInterceptor{requestIDUnaryServerInterceptor()}, unaryInterceptors...)
+	streamInterceptors = append([]grpc.StreamServerInterceptor{requestIDStreamServerInterceptor()}, streamInterceptors...)
+	unaryInterceptors = append([]grpc.UnaryServerInterceptor{recoverer.unaryInterceptor()}, unaryInterceptors...)
+	streamInterceptors = append([]grpc.StreamServerInterceptor{recoverer.streamInterceptor()}, streamInterceptors...)
+	opts := []grpc.ServerOption{
 		// grpc.UnaryInterceptor(myUnaryServerInterceptor1()),
-		grpc.ChainUnaryInterceptor(
-			myUnaryServerInterceptor1(),
-			myUnaryServerInterceptor2(),
-		),
 		// grpc.StreamInterceptor(myStreamServerInterceptor1()),
-		grpc.ChainStreamInterceptor(
-			myStreamServerInterceptor1(),
-			myStreamServerInterceptor2(),
-		),
-	)
+		// どのインターセプタをどの順で挟むかは設定のinterceptorsで決まる
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+		grpc.MaxRecvMsgSize(cfg.MaxRecvMsgSize),
+		grpc.MaxSendMsgSize(cfg.MaxSendMsgSize),
+	}
+	if cfg.TLS.enabled() {
+		certs, err := newCertReloader(cfg.TLS)
+		if err != nil {
+			log.Fatalf("failed to set up TLS: %v", err)
+		}
+		if cfg.TLS.ReloadInterval > 0 {
+			go certs.watch(ctx, cfg.TLS.ReloadInterval)
+		}
+		go certs.checkExpiry(ctx)
+		opts = append(opts, grpc.Creds(certs.credentials()))
+		if registry != nil {
+			registerCertExpiry(registry, certs)
+		}
+	}
+	if registry != nil {
+		// /loglevel は認証なしでレベルを変えられるので、設定で有効にしたときだけ公開する
+		var levelVar *slog.LevelVar
+		if cfg.Metrics.LogLevelEndpoint {
+			levelVar = logLevel
+		}
+		go serveMetrics(ctx, cfg.Metrics.Listen, registry, levelVar)
+	}
+	server := grpc.NewServer(opts...)
 
 	// Register Service
-	hellopb.RegisterGreetingServiceServer(server, NewMyServer())
+	hellopb.RegisterGreetingServiceServer(server, NewMyServer(cfg, recoverer))
+	if apiKeys != nil {
+		hellopb.RegisterApiKeyAdminServiceServer(server, &keyAdminServer{keys: apiKeys})
+	}
+
+	// Register Health Service
+	// grpc.health.v1.Healthはサービス名ごとに状態を持つ。""はサーバー全体の状態を表す
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus(hellopb.GreetingService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
 
 	// Register Reflection Service
 	/*-------------------------------------------------------------
@@ -149,17 +414,47 @@ func main() {
 	「シリアライズのルール」を知り通信します。
 	そしてその「gRPCサーバーそのものから、protoファイルの情報を取得する」ための機能がサーバーリフレクション
 	-------------------------------------------------------------*/
-	reflection.Register(server)
+	if cfg.Reflection {
+		reflection.Register(server)
+	}
 
 	go func() {
-		log.Printf("start gRPC server on port %s", port)
+		slog.Info("start gRPC server", "addr", listener.Addr().String())
 		_ = server.Serve(listener)
 	}()
 
 	// Graceful Shutdown
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
-	log.Println("stopping gRPC server...")
-	server.GracefulStop()
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	sig := <-quit
+	slog.Info("stopping gRPC server", "signal", sig.String())
+	// 新しいリクエストを振り分けないよう、まずヘルスチェックの結果をNOT_SERVINGにする
+	// Watch中のクライアントにもこの変更が通知される
+	healthServer.Shutdown()
+
+	// GracefulStopはすぐにGOAWAYを送って新しいRPCを断り、処理中のRPCが終わるまで待つ
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	// 開いたままのストリームにシャットダウンを伝え、自分で終了してもらう
+	shutdown.notify()
+
+	select {
+	case <-stopped:
+		slog.Info("gRPC server stopped gracefully")
+	case <-time.After(cfg.ShutdownTimeout):
+		slog.Warn("graceful shutdown did not finish in time, forcing stop", "timeout", cfg.ShutdownTimeout.String())
+		server.Stop()
+	case sig := <-quit:
+		// 2回目のシグナルが来たらドレインを待たずに終了する
+		slog.Warn("received a second signal, forcing stop", "signal", sig.String())
+		server.Stop()
+	}
+	if apiKeys != nil {
+		if err := apiKeys.Flush(); err != nil {
+			slog.Error("failed to save API key last-used times", "error", err)
+		}
+	}
 }
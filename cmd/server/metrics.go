@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"mygrpc/pkg/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+/*-------------------------------------------------------------
+Prometheusのメトリクス
+
+RPCごとに、開始数・終了数(ステータスコード別)・処理時間・処理中の数・送受信したメッセージ数を記録する。
+ラベルの grpc_type は unary / client_stream / server_stream / bidi_stream のいずれか。
+メッセージ数はストリームのSendMsg・RecvMsgをラップして数える(Unaryはリクエスト・レスポンス1つずつ)。
+
+メトリクスはgRPCとは別のHTTPリスナー(metrics.listen)の /metrics で公開する。
+metrics.loglevel_endpointを有効にすると、実行中にログのレベルを変えるための /loglevel もこのリスナーで公開する。
+/loglevel には認証がないので、デフォルトでは公開しない。
+-------------------------------------------------------------*/
+
+// serverMetrics はサーバー側のRPCのメトリクス
+type serverMetrics struct {
+	started         *prometheus.CounterVec
+	handled         *prometheus.CounterVec
+	handlingSeconds *prometheus.HistogramVec
+	inFlight        *prometheus.GaugeVec
+	msgReceived     *prometheus.CounterVec
+	msgSent         *prometheus.CounterVec
+}
+
+func newServerMetrics(reg prometheus.Registerer) *serverMetrics {
+	labels := []string{"grpc_type", "grpc_service", "grpc_method"}
+	m := &serverMetrics{
+		started: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_started_total",
+			Help: "Total number of RPCs started on the server.",
+		}, labels),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "Total number of RPCs completed on the server, regardless of success or failure.",
+		}, append(labels, "grpc_code")),
+		handlingSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "Time taken by the server to handle an RPC, until the handler returns.",
+			Buckets: prometheus.DefBuckets,
+		}, labels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "grpc_server_in_flight",
+			Help: "Number of RPCs currently being handled by the server.",
+		}, labels),
+		msgReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_msg_received_total",
+			Help: "Total number of request messages received by the server.",
+		}, labels),
+		msgSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_msg_sent_total",
+			Help: "Total number of response messages sent by the server.",
+		}, labels),
+	}
+	reg.MustRegister(m.started, m.handled, m.handlingSeconds, m.inFlight, m.msgReceived, m.msgSent)
+	return m
+}
+
+// rpcLabels はgrpc_type・grpc_service・grpc_methodラベルの値
+type rpcLabels [3]string
+
+func newRPCLabels(rpcType, fullMethod string) rpcLabels {
+	// FullMethodは "/myapp.GreetingService/Hello" の形
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	return rpcLabels{rpcType, service, method}
+}
+
+func streamRPCType(info *grpc.StreamServerInfo) string {
+	switch {
+	case info.IsClientStream && info.IsServerStream:
+		return "bidi_stream"
+	case info.IsClientStream:
+		return "client_stream"
+	default:
+		return "server_stream"
+	}
+}
+
+// begin はRPCの開始を記録し、終了時に呼ぶ関数を返す
+func (m *serverMetrics) begin(l rpcLabels) func(err error) {
+	start := time.Now()
+	m.started.WithLabelValues(l[:]...).Inc()
+	m.inFlight.WithLabelValues(l[:]...).Inc()
+	return func(err error) {
+		m.inFlight.WithLabelValues(l[:]...).Dec()
+		m.handlingSeconds.WithLabelValues(l[:]...).Observe(time.Since(start).Seconds())
+		m.handled.WithLabelValues(append(l[:], status.Code(err).String())...).Inc()
+	}
+}
+
+func (m *serverMetrics) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		l := newRPCLabels("unary", info.FullMethod)
+		done := m.begin(l)
+		m.msgReceived.WithLabelValues(l[:]...).Inc()
+		res, err := handler(ctx, req)
+		if err == nil {
+			m.msgSent.WithLabelValues(l[:]...).Inc()
+		}
+		done(err)
+		return res, err
+	}
+}
+
+func (m *serverMetrics) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		l := newRPCLabels(streamRPCType(info), info.FullMethod)
+		done := m.begin(l)
+		err := handler(srv, &monitoredServerStream{
+			ServerStream: ss,
+			received:     m.msgReceived.WithLabelValues(l[:]...),
+			sent:         m.msgSent.WithLabelValues(l[:]...),
+		})
+		done(err)
+		return err
+	}
+}
+
+// monitoredServerStream は送受信に成功したメッセージを数えるストリーム
+type monitoredServerStream struct {
+	grpc.ServerStream
+	received prometheus.Counter
+	sent     prometheus.Counter
+}
+
+func (s *monitoredServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent.Inc()
+	}
+	return err
+}
+
+func (s *monitoredServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received.Inc()
+	}
+	return err
+}
+
+// newMetricsRegistry はRPCのメトリクスに加えて、GoランタイムとプロセスのメトリクスのRegistryを作る
+func newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
+
+// registerCertExpiry はサーバー証明書の有効期限をメトリクスとして公開する
+// リロードで証明書が変わると、次のスクレイプから新しい期限になる
+func registerCertExpiry(reg prometheus.Registerer, certs *certReloader) {
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "myapp_tls_certificate_expiry_timestamp_seconds",
+		Help: "Expiry time of the server certificate currently in use, in seconds since the Unix epoch.",
+	}, func() float64 {
+		return float64(certs.NotAfter().Unix())
+	}))
+}
+
+// serveMetrics はaddrで /metrics を公開するHTTPサーバーを起動する
+// logLevelがnilでなければ、同じリスナーの /loglevel でログのレベルを確認・変更できる
+// ctxがキャンセルされたら停止する
+func serveMetrics(ctx context.Context, addr string, reg *prometheus.Registry, logLevel *slog.LevelVar) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	if logLevel != nil {
+		mux.Handle("/loglevel", logging.LevelHandler(logLevel))
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	slog.Info("start metrics server", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("metrics server stopped", "error", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"mygrpc/pkg/ratelimit"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+/*-------------------------------------------------------------
+呼び出し元ごとのレート制限
+
+トークンバケットで、呼び出し元・メソッドごとに次の3つを別々に制限する。
+・unary           Unary RPCの呼び出し
+・stream_open     Stream RPCを開く回数
+・stream_messages 1本のストリームで受け取るメッセージ(ストリームごとのバケット)
+呼び出し元は rate_limit.key で、認証で分かった呼び出し元(identity)、接続元のIP(peer)、
+メタデータの値(metadata:<key>)から選ぶ。identity・metadataで分からなければIPを使う。
+制限を超えるとRESOURCE_EXHAUSTEDを返し、RetryInfoで次に呼べるまでの時間、QuotaFailureで超えた制限を伝える。
+-------------------------------------------------------------*/
+
+type rateLimiter struct {
+	cfg     rateLimitConfig
+	callers *ratelimit.Limiter
+}
+
+func newRateLimiter(cfg rateLimitConfig) *rateLimiter {
+	return &rateLimiter{cfg: cfg, callers: ratelimit.NewLimiter()}
+}
+
+// sweep はctxがキャンセルされるまで、使われなくなった呼び出し元のバケットを定期的に捨てる
+func (r *rateLimiter) sweep(ctx context.Context) {
+	r.callers.SweepEvery(ctx, time.Minute)
+}
+
+// caller はレート制限のキーにする呼び出し元を返す
+func (r *rateLimiter) caller(ctx context.Context) string {
+	switch key := r.cfg.Key; {
+	case key == "identity":
+		p := principalFromContext(ctx)
+		switch {
+		case p.APIKey != "":
+			return "api_key:" + p.APIKey
+		case p.Subject != "":
+			return "sub:" + p.Subject
+		case len(p.SANs) > 0:
+			return "san:" + p.SANs[0]
+		}
+	case strings.HasPrefix(key, "metadata:"):
+		name := strings.TrimPrefix(key, "metadata:")
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(name); len(values) > 0 && values[0] != "" {
+			return name + ":" + values[0]
+		}
+	}
+	return "ip:" + peerIP(ctx)
+}
+
+// peerIP は接続元のIPアドレス。ポートごとに別の呼び出し元にならないよう、ポートは除く
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// allow は呼び出し元のkindのバケットからトークンを1つ使い、使えなければRESOURCE_EXHAUSTEDを返す
+func (r *rateLimiter) allow(ctx context.Context, fullMethod, kind string, limit ratelimit.Limit) error {
+	caller := r.caller(ctx)
+	ok, wait := r.callers.Allow(kind+"|"+fullMethod+"|"+caller, limit)
+	if ok {
+		return nil
+	}
+	slog.WarnContext(ctx, "rate limit exceeded", "method", fullMethod, "limit", kind, "caller", caller, "retry_after", wait)
+	return rateLimitedError(fullMethod, caller, kind, limit, wait)
+}
+
+func (r *rateLimiter) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := r.allow(ctx, info.FullMethod, "unary", r.cfg.limits(info.FullMethod).Unary); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (r *rateLimiter) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		limits := r.cfg.limits(info.FullMethod)
+		if err := r.allow(ss.Context(), info.FullMethod, "stream_open", limits.StreamOpen); err != nil {
+			return err
+		}
+		if limits.StreamMessages.Unlimited() {
+			return handler(srv, ss)
+		}
+		return handler(srv, &rateLimitedServerStream{
+			ServerStream: ss,
+			fullMethod:   info.FullMethod,
+			caller:       r.caller(ss.Context()),
+			limit:        limits.StreamMessages,
+			bucket:       ratelimit.NewBucket(limits.StreamMessages),
+		})
+	}
+}
+
+// rateLimitedServerStream は1本のストリームで受け取るメッセージの数を制限する
+type rateLimitedServerStream struct {
+	grpc.ServerStream
+	fullMethod string
+	caller     string
+	limit      ratelimit.Limit
+	bucket     *ratelimit.Bucket
+}
+
+func (s *rateLimitedServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if ok, wait := s.bucket.Allow(); !ok {
+		slog.WarnContext(s.Context(), "rate limit exceeded", "method", s.fullMethod, "limit", "stream_messages", "caller", s.caller, "retry_after", wait)
+		// validateと同じく、RecvMsgのエラーをハンドラが返してストリームが終わる
+		return rateLimitedError(s.fullMethod, s.caller, "stream_messages", s.limit, wait)
+	}
+	return nil
+}
+
+// rateLimitedError はRESOURCE_EXHAUSTEDに、次に呼べるまでの時間と超えた制限を付けて返す
+func rateLimitedError(fullMethod, caller, kind string, limit ratelimit.Limit, wait time.Duration) error {
+	// 0.3msのように細かい値を返しても意味がないので、ミリ秒に切り上げる
+	wait = (wait + time.Millisecond - 1).Truncate(time.Millisecond)
+	return statusError(codes.ResourceExhausted, fmt.Sprintf("rate limit exceeded: %s of %s is limited to %s", kind, fullMethod, limit),
+		&errdetails.ErrorInfo{
+			Reason:   reasonRateLimited,
+			Domain:   errorDomain,
+			Metadata: map[string]string{"method": fullMethod, "limit": kind},
+		},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)},
+		&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     caller,
+			Description: fmt.Sprintf("%s of %s: %s", kind, fullMethod, limit),
+		}}},
+		&errdetails.LocalizedMessage{Locale: "ja-JP", Message: "呼び出しの回数が制限を超えました。しばらく待ってから再試行してください。"},
+	)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"mygrpc/pkg/ratelimit"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeServerStream はmessages個のメッセージを受け取った後にio.EOFを返すストリーム
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	messages int
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+func (s *fakeServerStream) RecvMsg(m interface{}) error {
+	if s.messages == 0 {
+		return io.EOF
+	}
+	s.messages--
+	return nil
+}
+
+// limitPtr はメソッドごとの設定に書くLimitを返す
+func limitPtr(rate float64, burst int) *ratelimit.Limit {
+	return &ratelimit.Limit{Rate: rate, Burst: burst}
+}
+
+func TestRateLimitConfigLimits(t *testing.T) {
+	cfg := rateLimitConfig{
+		Unary:          ratelimit.Limit{Rate: 10},
+		StreamOpen:     ratelimit.Limit{Rate: 5},
+		StreamMessages: ratelimit.Limit{Rate: 100},
+		Methods: map[string]methodRateLimits{
+			"/myapp.GreetingService/*":              {Unary: limitPtr(2, 0), StreamOpen: limitPtr(1, 0)},
+			"/myapp.GreetingService/HelloBiStreams": {StreamOpen: limitPtr(3, 0)},
+		},
+	}
+	tests := []struct {
+		method                            string
+		unary, streamOpen, streamMessages float64
+	}{
+		// メソッドの設定がサービスの設定より優先され、書いていない項目はサービスの設定、デフォルトの順に使う
+		{"/myapp.GreetingService/HelloBiStreams", 2, 3, 100},
+		{"/myapp.GreetingService/Hello", 2, 1, 100},
+		{"/grpc.health.v1.Health/Check", 10, 5, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			l := cfg.limits(tt.method)
+			if l.Unary.Rate != tt.unary || l.StreamOpen.Rate != tt.streamOpen || l.StreamMessages.Rate != tt.streamMessages {
+				t.Errorf("limits() = unary %g, stream_open %g, stream_messages %g, want %g, %g, %g",
+					l.Unary.Rate, l.StreamOpen.Rate, l.StreamMessages.Rate, tt.unary, tt.streamOpen, tt.streamMessages)
+			}
+		})
+	}
+}
+
+func TestRateLimiterUnaryPerMethod(t *testing.T) {
+	r := newRateLimiter(rateLimitConfig{
+		Key:     "peer",
+		Methods: map[string]methodRateLimits{"/myapp.GreetingService/Hello": {Unary: limitPtr(0.001, 1)}},
+	})
+	call := func(method string) error {
+		_, err := r.unaryInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method},
+			func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+		return err
+	}
+
+	if err := call("/myapp.GreetingService/Hello"); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	err := call("/myapp.GreetingService/Hello")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("second call: code = %v, want ResourceExhausted", status.Code(err))
+	}
+	var retry *errdetails.RetryInfo
+	for _, d := range status.Convert(err).Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			retry = r
+		}
+	}
+	if retry == nil || retry.GetRetryDelay().AsDuration() <= 0 {
+		t.Errorf("details have no positive RetryInfo: %v", status.Convert(err).Details())
+	}
+	// 制限のないメソッドは別に数える
+	for i := 0; i < 10; i++ {
+		if err := call("/myapp.GreetingService/HelloServerStream"); err != nil {
+			t.Fatalf("unlimited method call %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestRateLimiterStreamMessages(t *testing.T) {
+	r := newRateLimiter(rateLimitConfig{
+		Key:            "peer",
+		StreamOpen:     ratelimit.Limit{Rate: 0.001, Burst: 2},
+		StreamMessages: ratelimit.Limit{Rate: 0.001, Burst: 3},
+	})
+	info := &grpc.StreamServerInfo{FullMethod: "/myapp.GreetingService/HelloClientStream", IsClientStream: true}
+	// receive はストリームを開き、エラーになるまでに受け取れたメッセージの数を返す
+	receive := func(messages int) (int, error) {
+		received := 0
+		err := r.streamInterceptor()(nil, &fakeServerStream{messages: messages}, info, func(srv interface{}, ss grpc.ServerStream) error {
+			for {
+				if err := ss.RecvMsg(nil); err != nil {
+					if err == io.EOF {
+						return nil
+					}
+					return err
+				}
+				received++
+			}
+		})
+		return received, err
+	}
+
+	received, err := receive(5)
+	if status.Code(err) != codes.ResourceExhausted || received != 3 {
+		t.Errorf("first stream: received %d, err = %v, want 3 and ResourceExhausted", received, err)
+	}
+	// メッセージのバケットはストリームごとなので、次のストリームでもまた受け取れる
+	if received, err := receive(2); err != nil || received != 2 {
+		t.Errorf("second stream: received %d, err = %v, want 2 and no error", received, err)
+	}
+	// 開く回数は呼び出し元ごとに数える
+	if _, err := receive(0); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("third stream: code = %v, want ResourceExhausted for stream_open", status.Code(err))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+/*-------------------------------------------------------------
+パニックからの復帰
+
+ハンドラやストリームのラッパーがパニックしても、サーバーのプロセスごと落ちないように、
+recoverしてINTERNALのエラーに変える。スタックトレースはメソッド・リクエストIDと一緒にログに出す。
+debugが有効なときだけ、パニックの内容とスタックトレースをDebugInfoとしてクライアントにも返す。
+同じrecovererをチェーンの2か所に置く(main.goのコメントを参照)。
+一番外側ではまだリクエストIDが決まっていないので、recovererが自分でIDを決めてコンテキストに入れ、パニックのログに付ける。
+ハンドラが自分で起動したgoroutineのパニックはインターセプタでは拾えないので、
+Recvを別のgoroutineで呼ぶrecvRequestsは、同じrecovererでパニックをエラーに変えてハンドラに返す。
+-------------------------------------------------------------*/
+
+type recoverer struct {
+	// debug がtrueならエラーにDebugInfoを付ける
+	debug  bool
+	panics *prometheus.CounterVec
+}
+
+// newRecoverer はパニックの数を数えるカウンターをregに登録する。regがnilならカウンターは公開しない
+func newRecoverer(reg prometheus.Registerer, debug bool) *recoverer {
+	r := &recoverer{
+		debug: debug,
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_panics_total",
+			Help: "Total number of panics recovered from RPC handlers.",
+		}, []string{"grpc_type", "grpc_service", "grpc_method"}),
+	}
+	if reg != nil {
+		reg.MustRegister(r.panics)
+	}
+	return r
+}
+
+// recovered はrecoverした値を記録し、クライアントに返すエラーを作る
+func (r *recoverer) recovered(ctx context.Context, rpcType, fullMethod string, p interface{}) error {
+	stack := string(debug.Stack())
+	labels := newRPCLabels(rpcType, fullMethod)
+	r.panics.WithLabelValues(labels[:]...).Inc()
+	attrs := append(rpcAttrs(ctx, rpcType, fullMethod), slog.Any("panic", p), slog.String("stack", stack))
+	slog.Default().LogAttrs(ctx, slog.LevelError, "recovered from panic", attrs...)
+
+	if !r.debug {
+		return statusError(codes.Internal, "internal error")
+	}
+	return statusError(codes.Internal, "internal error",
+		&errdetails.DebugInfo{
+			Detail:       fmt.Sprintf("panic: %v", p),
+			StackEntries: strings.Split(strings.TrimSpace(stack), "\n"),
+		},
+	)
+}
+
+func (r *recoverer) unaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res interface{}, err error) {
+		ctx, _ = ensureRequestID(ctx)
+		defer func() {
+			if p := recover(); p != nil {
+				res, err = nil, r.recovered(ctx, "unary", info.FullMethod, p)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+func (r *recoverer) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		if ctx, ok := ensureRequestID(ss.Context()); ok {
+			ss = &requestIDServerStream{ServerStream: ss, ctx: ctx}
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				err = r.recovered(ss.Context(), streamRPCType(info), info.FullMethod, p)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	hellopb "mygrpc/pkg/grpc"
+	"mygrpc/pkg/logging"
+	"mygrpc/pkg/requestid"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// chainUnary はinterceptorsを外側から順に重ねて、handlerを呼ぶ関数を返す
+func chainUnary(handler grpc.UnaryHandler, info *grpc.UnaryServerInfo, interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler
+}
+
+func metricValue(t *testing.T, c prometheus.Collector) float64 {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 1)
+	c.Collect(ch)
+	var m dto.Metric
+	if err := (<-ch).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Gauge != nil {
+		return m.Gauge.GetValue()
+	}
+	return m.Counter.GetValue()
+}
+
+// パニックしたRPCも、外側のメトリクス・アクセスログにINTERNALとして記録される
+func TestRecoveredPanicIsRecordedAsInternal(t *testing.T) {
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	reg := prometheus.NewRegistry()
+	metrics := newServerMetrics(reg)
+	recoverer := newRecoverer(reg, false)
+	info := &grpc.UnaryServerInfo{FullMethod: "/myapp.GreetingService/Hello"}
+	call := chainUnary(func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	}, info,
+		metrics.unaryInterceptor(),
+		loggingUnaryServerInterceptor(logging.PayloadPolicy{}),
+		recoverer.unaryInterceptor(),
+	)
+
+	_, err := call(context.Background(), nil)
+	if got := status.Code(err); got != codes.Internal {
+		t.Fatalf("code = %v, want Internal", got)
+	}
+	l := newRPCLabels("unary", info.FullMethod)
+	if got := metricValue(t, metrics.inFlight.WithLabelValues(l[:]...)); got != 0 {
+		t.Errorf("in flight = %v, want 0", got)
+	}
+	if got := metricValue(t, metrics.handled.WithLabelValues(append(l[:], codes.Internal.String())...)); got != 1 {
+		t.Errorf("handled{grpc_code=Internal} = %v, want 1", got)
+	}
+	if got := metricValue(t, recoverer.panics.WithLabelValues(l[:]...)); got != 1 {
+		t.Errorf("panics = %v, want 1", got)
+	}
+	if !strings.Contains(logs.String(), "code=Internal") {
+		t.Errorf("access log does not record Internal:\n%s", logs.String())
+	}
+}
+
+// panickingRecvStream はRecvMsgでパニックするストリームのラッパー
+type panickingRecvStream struct {
+	grpc.ServerStream
+}
+
+func (s *panickingRecvStream) RecvMsg(m interface{}) error {
+	panic("boom in RecvMsg")
+}
+
+// HelloClientStream・HelloBiStreamsはRecvを別のgoroutineで呼ぶ。そこでのパニックもプロセスを落とさずINTERNALで返す
+func TestRecvPanicIsReturnedAsInternal(t *testing.T) {
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	recoverer := newRecoverer(prometheus.NewRegistry(), false)
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.ChainStreamInterceptor(
+		recoverer.streamInterceptor(),
+		func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return handler(srv, &panickingRecvStream{ServerStream: ss})
+		},
+	))
+	hellopb.RegisterGreetingServiceServer(server, NewMyServer(&config{}, recoverer))
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := hellopb.NewGreetingServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		rpcType string
+		method  string
+		call    func() error
+	}{
+		{"client stream", "client_stream", "/myapp.GreetingService/HelloClientStream", func() error {
+			stream, err := client.HelloClientStream(ctx)
+			if err != nil {
+				return err
+			}
+			_ = stream.Send(&hellopb.HelloRequest{Name: "alice"})
+			_, err = stream.CloseAndRecv()
+			return err
+		}},
+		{"bidi stream", "bidi_stream", "/myapp.GreetingService/HelloBiStreams", func() error {
+			stream, err := client.HelloBiStreams(ctx)
+			if err != nil {
+				return err
+			}
+			_ = stream.Send(&hellopb.HelloRequest{Name: "alice"})
+			_, err = stream.Recv()
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(tt.call()); got != codes.Internal {
+				t.Errorf("code = %v, want Internal", got)
+			}
+			l := newRPCLabels(tt.rpcType, tt.method)
+			if got := metricValue(t, recoverer.panics.WithLabelValues(l[:]...)); got != 1 {
+				t.Errorf("panics = %v, want 1", got)
+			}
+		})
+	}
+}
+
+// DebugInfoはdebugが有効なときだけ返す。Unaryでもストリームでも同じ
+func TestRecoveredDebugInfo(t *testing.T) {
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	calls := map[string]func(r *recoverer) error{
+		"unary": func(r *recoverer) error {
+			_, err := r.unaryInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/myapp.GreetingService/Hello"},
+				func(ctx context.Context, req interface{}) (interface{}, error) { panic("boom") })
+			return err
+		},
+		"stream": func(r *recoverer) error {
+			return r.streamInterceptor()(nil, &fakeServerStream{}, &grpc.StreamServerInfo{FullMethod: "/myapp.GreetingService/HelloServerStream", IsServerStream: true},
+				func(srv interface{}, ss grpc.ServerStream) error { panic("boom") })
+		},
+	}
+	for name, call := range calls {
+		for _, debug := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s debug=%v", name, debug), func(t *testing.T) {
+				r := newRecoverer(prometheus.NewRegistry(), debug)
+				err := call(r)
+				if got := status.Code(err); got != codes.Internal {
+					t.Fatalf("code = %v, want Internal", got)
+				}
+				var info *errdetails.DebugInfo
+				for _, d := range status.Convert(err).Details() {
+					if d, ok := d.(*errdetails.DebugInfo); ok {
+						info = d
+					}
+				}
+				if !debug {
+					if info != nil {
+						t.Errorf("DebugInfo = %v, want none without debug", info)
+					}
+					return
+				}
+				if info == nil || info.GetDetail() != "panic: boom" || len(info.GetStackEntries()) == 0 {
+					t.Errorf("DebugInfo = %v, want the panic and the stack", info)
+				}
+			})
+		}
+	}
+}
+
+// 一番外側のrecovererは、内側のインターセプタのパニックもリクエストID付きで記録する
+func TestOuterRecovererLogsRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	logger, err := logging.New(&logs, "text", &slog.LevelVar{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/myapp.GreetingService/Hello"}
+	var seen string
+	call := chainUnary(func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}, info,
+		newRecoverer(nil, false).unaryInterceptor(),
+		requestIDUnaryServerInterceptor(),
+		// メトリクスなど、内側のrecovererより外側のインターセプタのパニック
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			seen = requestid.FromContext(ctx)
+			panic("boom in interceptor")
+		},
+	)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestid.MetadataKey, "req-1"))
+	if _, err := call(ctx, nil); status.Code(err) != codes.Internal {
+		t.Fatalf("code = %v, want Internal", status.Code(err))
+	}
+	if seen != "req-1" {
+		t.Errorf("request id inside the chain = %q, want req-1", seen)
+	}
+	if !strings.Contains(logs.String(), "request_id=req-1") {
+		t.Errorf("panic log has no request id:\n%s", logs.String())
+	}
+}
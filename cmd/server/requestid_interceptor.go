@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"mygrpc/pkg/requestid"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+/*-------------------------------------------------------------
+リクエストID
+
+クライアントが x-request-id メタデータで送ってきたIDを使い、なければ(または不正なら)サーバーで作る。
+IDはコンテキストに入れるので、このRPCのログにはすべてrequest_idが付く。
+どのRPCの形でも、成功・失敗にかかわらず、同じIDをヘッダーとトレーラーの両方で返す。
+
+ハンドラを呼ぶ前にヘッダーにIDを設定しておくので、エラーで終わるRPCでもヘッダーが送られ、
+ステータスとトレーラーだけのレスポンス(Trailers-Only)にはならない。
+そのため、サーバーが返したエラーはクライアントのservice configのretryPolicyではリトライされない(README参照)。
+-------------------------------------------------------------*/
+
+// incomingRequestID はクライアントから受け取ったリクエストID。なければ作る
+func incomingRequestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(requestid.MetadataKey); len(v) > 0 {
+		if requestid.Valid(v[0]) {
+			return v[0]
+		}
+		slog.DebugContext(ctx, "ignoring invalid request id from the client")
+	}
+	return requestid.New()
+}
+
+// ensureRequestID はコンテキストにリクエストIDがなければincomingRequestIDで決めて入れる
+// IDを入れたときだけtrueを返す。チェーンの一番外側のrecovererが先に決めたIDを、後のインターセプタも使う
+func ensureRequestID(ctx context.Context) (context.Context, bool) {
+	if requestid.FromContext(ctx) != "" {
+		return ctx, false
+	}
+	return requestid.NewContext(ctx, incomingRequestID(ctx)), true
+}
+
+func requestIDUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, _ = ensureRequestID(ctx)
+		md := metadata.Pairs(requestid.MetadataKey, requestid.FromContext(ctx))
+		// ハンドラが設定したヘッダー・トレーラーとは、送るときにまとめられる
+		if err := grpc.SetHeader(ctx, md); err != nil {
+			slog.DebugContext(ctx, "failed to set request id header", "error", err)
+		}
+		if err := grpc.SetTrailer(ctx, md); err != nil {
+			slog.DebugContext(ctx, "failed to set request id trailer", "error", err)
+		}
+		return handler(ctx, req)
+	}
+}
+
+func requestIDStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, _ := ensureRequestID(ss.Context())
+		md := metadata.Pairs(requestid.MetadataKey, requestid.FromContext(ctx))
+		if err := ss.SetHeader(md); err != nil {
+			slog.DebugContext(ctx, "failed to set request id header", "error", err)
+		}
+		ss.SetTrailer(md)
+		return handler(srv, &requestIDServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// requestIDServerStream はリクエストIDを入れたコンテキストを内側のインターセプタとハンドラに渡す
+type requestIDServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDServerStream) Context() context.Context {
+	return s.ctx
+}
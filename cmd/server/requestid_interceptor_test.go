@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"mygrpc/pkg/requestid"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeServerTransportStream はgrpc.SetHeader・SetTrailerで設定されたメタデータを記録する
+type fakeServerTransportStream struct {
+	header, trailer metadata.MD
+}
+
+func (s *fakeServerTransportStream) Method() string { return "/myapp.GreetingService/Hello" }
+
+func (s *fakeServerTransportStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *fakeServerTransportStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *fakeServerTransportStream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+// recordingServerStream はSetHeader・SetTrailerで設定されたメタデータを記録するストリーム
+type recordingServerStream struct {
+	grpc.ServerStream
+	ctx             context.Context
+	header, trailer metadata.MD
+}
+
+func (s *recordingServerStream) Context() context.Context { return s.ctx }
+
+func (s *recordingServerStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *recordingServerStream) SetTrailer(md metadata.MD) {
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+// どのRPCの形でも、成功・失敗にかかわらずIDをヘッダーとトレーラーの両方で返す
+func TestRequestIDServerInterceptors(t *testing.T) {
+	incoming := metadata.Pairs(requestid.MetadataKey, "req-1")
+	// call はインターセプタでRPCを処理し、ハンドラが見たID・ヘッダー・トレーラーを返す
+	calls := map[string]func(handlerErr error) (id string, header, trailer metadata.MD, err error){
+		"unary": func(handlerErr error) (string, metadata.MD, metadata.MD, error) {
+			sts := &fakeServerTransportStream{}
+			ctx := metadata.NewIncomingContext(grpc.NewContextWithServerTransportStream(context.Background(), sts), incoming)
+			var id string
+			_, err := requestIDUnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: sts.Method()},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					id = requestid.FromContext(ctx)
+					return nil, handlerErr
+				})
+			return id, sts.header, sts.trailer, err
+		},
+	}
+	// ストリームの3つの形は同じインターセプタを通る
+	for _, info := range []*grpc.StreamServerInfo{
+		{FullMethod: "/myapp.GreetingService/HelloServerStream", IsServerStream: true},
+		{FullMethod: "/myapp.GreetingService/HelloClientStream", IsClientStream: true},
+		{FullMethod: "/myapp.GreetingService/HelloBiStreams", IsClientStream: true, IsServerStream: true},
+	} {
+		info := info
+		calls[streamRPCType(info)] = func(handlerErr error) (string, metadata.MD, metadata.MD, error) {
+			ss := &recordingServerStream{ctx: metadata.NewIncomingContext(context.Background(), incoming)}
+			var id string
+			err := requestIDStreamServerInterceptor()(nil, ss, info, func(srv interface{}, ss grpc.ServerStream) error {
+				id = requestid.FromContext(ss.Context())
+				return handlerErr
+			})
+			return id, ss.header, ss.trailer, err
+		}
+	}
+
+	for name, call := range calls {
+		for _, handlerErr := range []error{nil, status.Error(codes.Unavailable, "unavailable")} {
+			t.Run(fmt.Sprintf("%s %v", name, status.Code(handlerErr)), func(t *testing.T) {
+				id, header, trailer, err := call(handlerErr)
+				if err != handlerErr {
+					t.Fatalf("err = %v, want %v", err, handlerErr)
+				}
+				if id != "req-1" {
+					t.Errorf("request id in the handler = %q, want req-1", id)
+				}
+				for kind, md := range map[string]metadata.MD{"header": header, "trailer": trailer} {
+					if got := md.Get(requestid.MetadataKey); len(got) != 1 || got[0] != "req-1" {
+						t.Errorf("%s %s = %v, want [req-1]", kind, requestid.MetadataKey, got)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestIncomingRequestIDReplacesInvalidIDs(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestid.MetadataKey, "bad\nid"))
+	if id := incomingRequestID(ctx); id == "bad\nid" || !requestid.Valid(id) {
+		t.Errorf("incomingRequestID() = %q, want a new valid id", id)
+	}
+}
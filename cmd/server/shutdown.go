@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"google.golang.org/grpc"
+
+	hellopb "mygrpc/pkg/grpc"
+)
+
+/*-------------------------------------------------------------
+シャットダウンの通知
+
+GracefulStopはGOAWAYを送って新しいRPCを受け付けなくするが、
+すでに開いているストリームは、ハンドラが自分でreturnするまで待ち続ける。
+そこでストリームのコンテキストを「シャットダウンが始まった」という理由(cause)付きでキャンセルし、
+ハンドラが最後のメッセージを送ってから自分で終了できるようにする。
+-------------------------------------------------------------*/
+
+var errServerShutdown = errors.New("server is shutting down")
+
+// shutdownNotifier はシャットダウンの開始を、処理中のストリームへ伝える
+type shutdownNotifier struct {
+	ch   chan struct{}
+	once sync.Once
+}
+
+func newShutdownNotifier() *shutdownNotifier {
+	return &shutdownNotifier{ch: make(chan struct{})}
+}
+
+// notify は処理中・これから始まるすべてのストリームのコンテキストをキャンセルする
+func (n *shutdownNotifier) notify() {
+	n.once.Do(func() { close(n.ch) })
+}
+
+func (n *shutdownNotifier) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel := context.WithCancelCause(ss.Context())
+		defer cancel(nil)
+		go func() {
+			select {
+			case <-n.ch:
+				cancel(errServerShutdown)
+			case <-ctx.Done():
+			}
+		}()
+		return handler(srv, &shutdownAwareStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// shutdownAwareStream はContextだけを差し替えたストリーム
+// コンテキストがキャンセルされても下のストリーム自体は生きているので、Sendは引き続き使える
+type shutdownAwareStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *shutdownAwareStream) Context() context.Context {
+	return s.ctx
+}
+
+// isShuttingDown はコンテキストがシャットダウンによってキャンセルされたかどうかを返す
+func isShuttingDown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errServerShutdown)
+}
+
+type recvResult struct {
+	req *hellopb.HelloRequest
+	err error
+}
+
+// recvRequests はRecvを別のgoroutineで呼び続け、結果をチャネルで返す
+// Recvはコンテキストのキャンセルでは戻ってこないので、ハンドラがselectでシャットダウンと同時に待てるようにするため
+// このgoroutineはインターセプタのrecoverの外で動くので、Recv(ストリームのラッパーのRecvMsg)がパニックしたら
+// onPanicでエラーに変えてハンドラに渡す
+func recvRequests(ctx context.Context, recv func() (*hellopb.HelloRequest, error), onPanic func(p interface{}) error) <-chan recvResult {
+	ch := make(chan recvResult)
+	go func() {
+		defer close(ch)
+		defer func() {
+			if p := recover(); p != nil {
+				select {
+				case ch <- recvResult{err: onPanic(p)}:
+				case <-ctx.Done():
+				}
+			}
+		}()
+		for {
+			req, err := recv()
+			select {
+			case ch <- recvResult{req: req, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
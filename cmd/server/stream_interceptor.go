@@ -3,7 +3,9 @@ package main
 import (
 	"errors"
 	"io"
-	"log"
+	"log/slog"
+
+	"mygrpc/pkg/logging"
 
 	"google.golang.org/grpc"
 )
@@ -15,10 +17,10 @@ type myServerStreamWrapper1 struct {
 func myStreamServerInterceptor1() grpc.StreamServerInterceptor {
 	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 		// ストリームがopenされたときに行われる前処理
-		log.Println("[pre stream] my stream server interceptor 1: ", info.FullMethod)
+		slog.DebugContext(ss.Context(), "[pre stream] my stream server interceptor 1", "method", info.FullMethod)
 		err := handler(srv, &myServerStreamWrapper1{ss}) // 本来の処理
 		// ストリームがcloseされたときに行われる後処理
-		log.Println("[post stream] my stream server interceptor 1: ", err)
+		slog.DebugContext(ss.Context(), "[post stream] my stream server interceptor 1", "error", err)
 		return err
 	}
 }
@@ -26,7 +28,7 @@ func myStreamServerInterceptor1() grpc.StreamServerInterceptor {
 // レスポンス送信時に行う後処理
 func (s *myServerStreamWrapper1) SendMsg(m interface{}) error {
 	// ハンドラで作成したレスポンスを、ストリームから返信する直前に差し込む後処理
-	log.Println("[post message] my stream server interceptor 1: ", m)
+	slog.DebugContext(s.Context(), "[post message] my stream server interceptor 1", "size", logging.Size(m))
 	return s.ServerStream.SendMsg(m)
 }
 
@@ -35,16 +37,16 @@ func (s *myServerStreamWrapper1) RecvMsg(m interface{}) error {
 	err := s.ServerStream.RecvMsg(m)
 	// クライアントからのリクエストを受け取った直後に差し込む前処理
 	if !errors.Is(err, io.EOF) {
-		log.Println("[pre message] my stream server interceptor 1: ", m)
+		slog.DebugContext(s.Context(), "[pre message] my stream server interceptor 1", "size", logging.Size(m))
 	}
 	return err
 }
 
-func myStreamServerInterceptor2() grpc.StreamServerInterceptor{
+func myStreamServerInterceptor2() grpc.StreamServerInterceptor {
 	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		log.Println("[pre stream] my stream server interceptor 2: ", info.FullMethod)
+		slog.DebugContext(ss.Context(), "[pre stream] my stream server interceptor 2", "method", info.FullMethod)
 		err := handler(srv, &myServerStreamWrapper2{ss}) // 本来のストリーム処理
-		log.Println("[post stream] my stream server interceptor 2: ")
+		slog.DebugContext(ss.Context(), "[post stream] my stream server interceptor 2")
 		return err
 	}
 }
@@ -56,12 +58,12 @@ type myServerStreamWrapper2 struct {
 func (s *myServerStreamWrapper2) RecvMsg(m interface{}) error {
 	err := s.ServerStream.RecvMsg(m)
 	if !errors.Is(err, io.EOF) {
-		log.Println("[pre message] my stream server interceptor 2: ", m)
+		slog.DebugContext(s.Context(), "[pre message] my stream server interceptor 2", "size", logging.Size(m))
 	}
 	return err
 }
 
 func (s *myServerStreamWrapper2) SendMsg(m interface{}) error {
-	log.Println("[post message] my stream server interceptor 2: ", m)
+	slog.DebugContext(s.Context(), "[post message] my stream server interceptor 2", "size", logging.Size(m))
 	return s.ServerStream.SendMsg(m)
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+
+	"mygrpc/pkg/filewatch"
+)
+
+/*-------------------------------------------------------------
+証明書のホットリロード
+
+tls.ConfigのGetConfigForClientはTLSハンドシェイクのたびに呼ばれるので、
+そこで「今有効な証明書・CA」を返すようにしておけば、ファイルを差し替えるだけで
+新しいコネクションから新しい証明書が使われる。
+すでに確立済みのコネクション(開きっぱなしのHelloBiStreamsなど)はハンドシェイクをやり直さないので、
+リロードの影響を受けずにそのまま動き続ける。
+-------------------------------------------------------------*/
+
+// certExpiryWarning より有効期限が近い証明書を使っていたら警告を出す
+// 読み込んだときと、その後certExpiryCheckIntervalごとに確認する
+const (
+	certExpiryWarning       = 7 * 24 * time.Hour
+	certExpiryCheckInterval = time.Hour
+)
+
+// certReloader はサーバー証明書とクライアント検証用のCAを保持し、ファイルの変更に合わせて差し替える
+type certReloader struct {
+	cfg     tlsConfig
+	watcher *filewatch.Watcher
+
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+}
+
+func newCertReloader(c tlsConfig) (*certReloader, error) {
+	paths := []string{c.CertFile, c.KeyFile}
+	if c.CAFile != "" {
+		paths = append(paths, c.CAFile)
+	}
+	// 読む前に状態を記録しておき、最初に読んでから監視が始まるまでの変更も拾う
+	r := &certReloader{cfg: c, watcher: filewatch.New(paths...)}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload はファイルを読み直し、すべて読めた場合だけ差し替える
+// 途中で失敗した場合は、今使っている証明書をそのまま使い続ける
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load server key pair: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("parse server certificate: %w", err)
+		}
+	}
+
+	var pool *x509.CertPool
+	if r.cfg.CAFile != "" {
+		if pool, err = loadCertPool(r.cfg.CAFile); err != nil {
+			return err
+		}
+	}
+
+	r.cert.Store(&cert)
+	r.clientCAs.Store(pool)
+	remaining := time.Until(cert.Leaf.NotAfter)
+	slog.Info("loaded server certificate",
+		"subject", cert.Leaf.Subject.String(),
+		"not_after", cert.Leaf.NotAfter.Format(time.RFC3339),
+		"expires_in", remaining.Round(time.Minute).String())
+	r.warnIfExpiring()
+	return nil
+}
+
+func (r *certReloader) warnIfExpiring() {
+	notAfter := r.NotAfter()
+	if remaining := time.Until(notAfter); remaining < certExpiryWarning {
+		slog.Warn("server certificate expires soon", "not_after", notAfter.Format(time.RFC3339), "expires_in", remaining.Round(time.Minute).String())
+	}
+}
+
+// checkExpiry はctxがキャンセルされるまで、使っている証明書の有効期限が近づいていないか定期的に確認する
+// メトリクスを公開していなくても、リロードされないまま期限が近づいた証明書に気づけるようにする
+func (r *certReloader) checkExpiry(ctx context.Context) {
+	ticker := time.NewTicker(certExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.warnIfExpiring()
+		}
+	}
+}
+
+// NotAfter は今有効なサーバー証明書の有効期限
+func (r *certReloader) NotAfter() time.Time {
+	return r.cert.Load().Leaf.NotAfter
+}
+
+// watch はctxがキャンセルされるまで証明書ファイルを監視し、変更があればリロードする
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	r.watcher.Run(ctx, interval, func() {
+		if err := r.reload(); err != nil {
+			// 証明書と鍵の片方だけ書き換わった瞬間などは失敗しうる。次の変更で再試行される
+			slog.Error("failed to reload TLS certificates, keeping the current ones", "error", err)
+		}
+	})
+}
+
+// credentials はgrpc.Credsに渡すTLSの認証情報を返す
+func (r *certReloader) credentials() credentials.TransportCredentials {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// GetConfigForClientが返したtls.Configには、credentials.NewTLSが設定するALPNが引き継がれないので自分で指定する
+		NextProtos: []string{"h2"},
+	}
+	switch r.cfg.ClientAuth {
+	case "request":
+		// クライアント証明書が送られてきた場合だけ検証する
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		// mTLS: クライアント証明書がなければハンドシェイクを失敗させる
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	tlsCfg := base.Clone()
+	tlsCfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.Certificates = []tls.Certificate{*r.cert.Load()}
+		c.ClientCAs = r.clientCAs.Load()
+		return c, nil
+	}
+	return credentials.NewTLS(tlsCfg)
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in CA file " + path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+
+	"mygrpc/pkg/redact"
+	"mygrpc/pkg/tracing"
+
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/*-------------------------------------------------------------
+OpenTelemetryのトレース
+
+クライアントがメタデータ(traceparent)で送ってきたトレースの続きとして、RPCごとにサーバーのスパンを作る。
+ストリームのメッセージの送受信は、スパンのイベント("message")として記録する。
+リクエストのメタデータは、authorizationなどの値を伏せてからスパンの属性にする。
+トレースIDはレスポンスのトレーラー(x-trace-id)で返す。ログにはpkg/loggingのハンドラが付ける。
+-------------------------------------------------------------*/
+
+// startServerSpan は受信したメタデータからトレースの続きを取り出して、サーバーのスパンを始める
+func startServerSpan(ctx context.Context, fullMethod string, redactor *redact.MetadataRedactor) (context.Context, trace.Span) {
+	ctx = tracing.Extract(ctx)
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(tracing.RPCAttributes(fullMethod)...),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		opts = append(opts, trace.WithAttributes(semconv.NetSockPeerAddr(p.Addr.String())))
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		opts = append(opts, trace.WithAttributes(tracing.RequestMetadataAttributes(redactor.Redact(md))...))
+	}
+	return otel.Tracer(tracing.InstrumentationName).Start(ctx, tracing.SpanName(fullMethod), opts...)
+}
+
+func tracingUnaryServerInterceptor(redactor *redact.MetadataRedactor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, span := startServerSpan(ctx, info.FullMethod, redactor)
+		// トレースIDはエラーで終わった場合も返したいので、ハンドラの前にトレーラーに設定する
+		traceID := tracing.TraceID(ctx)
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(tracing.TraceIDKey, traceID))
+
+		tracing.AddMessageEvent(span, tracing.Received, 1, req)
+		res, err := handler(ctx, req)
+		if err == nil {
+			tracing.AddMessageEvent(span, tracing.Sent, 1, res)
+		}
+		st := status.Convert(err)
+		tracing.EndSpan(span, st.Code(), st.Message())
+		return res, err
+	}
+}
+
+func tracingStreamServerInterceptor(redactor *redact.MetadataRedactor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := startServerSpan(ss.Context(), info.FullMethod, redactor)
+		traceID := tracing.TraceID(ctx)
+		ss.SetTrailer(metadata.Pairs(tracing.TraceIDKey, traceID))
+
+		err := handler(srv, &tracedServerStream{ServerStream: ss, ctx: ctx, span: span})
+		st := status.Convert(err)
+		tracing.EndSpan(span, st.Code(), st.Message())
+		return err
+	}
+}
+
+// tracedServerStream はスパンを持ったコンテキストをハンドラに渡し、メッセージの送受信をスパンに記録する
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx            context.Context
+	span           trace.Span
+	sent, received int
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *tracedServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent++
+		tracing.AddMessageEvent(s.span, tracing.Sent, s.sent, m)
+	}
+	return err
+}
+
+func (s *tracedServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received++
+		tracing.AddMessageEvent(s.span, tracing.Received, s.received, m)
+	}
+	return err
+}
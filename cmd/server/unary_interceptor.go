@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
+
+	"mygrpc/pkg/logging"
 
 	"google.golang.org/grpc"
 )
@@ -11,18 +13,18 @@ import (
 
 func myUnaryServerInterceptor1() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		log.Println("[pre] my unary server interceptor 1: ", info.FullMethod) // ハンドラの前に割り込ませる前処理
-		res, err := handler(ctx, req)                                         // 本来の処理
-		log.Println("[post] my unary server interceptor 1: ", res)            // ハンドラの後に割り込ませる後処理
+		slog.DebugContext(ctx, "[pre] my unary server interceptor 1", "method", info.FullMethod)           // ハンドラの前に割り込ませる前処理
+		res, err := handler(ctx, req)                                                                      // 本来の処理
+		slog.DebugContext(ctx, "[post] my unary server interceptor 1", "response_size", logging.Size(res)) // ハンドラの後に割り込ませる後処理
 		return res, err
 	}
 }
 
 func myUnaryServerInterceptor2() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		log.Println("[pre] my unary server interceptor 2: ", info.FullMethod, req)
+		slog.DebugContext(ctx, "[pre] my unary server interceptor 2", "method", info.FullMethod, "request_size", logging.Size(req))
 		res, err := handler(ctx, req) // 本来の処理
-		log.Println("[post] my unary server interceptor 2: ", res)
+		slog.DebugContext(ctx, "[post] my unary server interceptor 2", "response_size", logging.Size(res))
 		return res, err
 	}
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	hellopb "mygrpc/pkg/grpc"
+)
+
+/*-------------------------------------------------------------
+protoファイルのフィールドオプション (myapp.validate) に書いたルールで、受け取ったリクエストを検証する
+Unary RPCはハンドラを呼ぶ前に、Stream RPCはRecvMsgでメッセージを受け取るたびに検証するので、
+myServerの各メソッドで同じチェックを書く必要はない
+
+patternのルールは起動時にcompileValidationPatternsでまとめてコンパイルし、誤ったパターンがあれば起動を止める。
+リクエストの誤りではないので、起動時にコンパイルされていないパターンに当たったらINTERNALを返す
+-------------------------------------------------------------*/
+
+func validateUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if m, ok := req.(proto.Message); ok {
+			violations, err := validateMessage(m, "")
+			if err != nil {
+				return nil, validatorError(ctx, err)
+			}
+			if len(violations) > 0 {
+				return nil, validationError(violations)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+func validateStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &validatingServerStream{ServerStream: ss, indexed: info.IsClientStream})
+	}
+}
+
+type validatingServerStream struct {
+	grpc.ServerStream
+	// indexed がtrueなら、何番目に受け取ったメッセージかをフィールド名に含める
+	indexed bool
+	n       int
+}
+
+func (s *validatingServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	prefix := ""
+	if s.indexed {
+		prefix = fmt.Sprintf("requests[%d].", s.n)
+	}
+	s.n++
+	if pm, ok := m.(proto.Message); ok {
+		violations, err := validateMessage(pm, prefix)
+		if err != nil {
+			return validatorError(s.Context(), err)
+		}
+		if len(violations) > 0 {
+			// RecvMsgがエラーを返すとハンドラのRecvもエラーになり、ハンドラがそれを返してストリームが終わる
+			return validationError(violations)
+		}
+	}
+	return nil
+}
+
+func validationError(violations []*errdetails.BadRequest_FieldViolation) error {
+	fields := make([]string, 0, len(violations))
+	for _, v := range violations {
+		fields = append(fields, v.GetField())
+	}
+	return invalidArgumentError(reasonInvalidField, fmt.Sprintf("入力内容に誤りがあります(%s)。", strings.Join(fields, ", ")), violations...)
+}
+
+// validatorError はルールを検証できなかったときのエラー。原因はログに出し、クライアントにはINTERNALを返す
+func validatorError(ctx context.Context, err error) error {
+	slog.ErrorContext(ctx, "failed to validate request", "error", err)
+	return statusError(codes.Internal, "internal error")
+}
+
+// validateMessage はメッセージのフィールドをオプションのルールで検証し、違反をすべて返す
+// メッセージ型のフィールドは中まで再帰的に検証する
+// ルール自体を適用できなかったときだけerrを返す
+func validateMessage(m proto.Message, prefix string) ([]*errdetails.BadRequest_FieldViolation, error) {
+	var violations []*errdetails.BadRequest_FieldViolation
+	msg := m.ProtoReflect()
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		path := prefix + string(fd.Name())
+
+		if rules := fieldRules(fd); rules != nil {
+			vs, err := validateField(msg, fd, rules, path)
+			if err != nil {
+				return nil, err
+			}
+			violations = append(violations, vs...)
+		}
+		if fd.Kind() == protoreflect.MessageKind && !fd.IsList() && !fd.IsMap() && msg.Has(fd) {
+			vs, err := validateMessage(msg.Get(fd).Message().Interface(), path+".")
+			if err != nil {
+				return nil, err
+			}
+			violations = append(violations, vs...)
+		}
+	}
+	return violations, nil
+}
+
+// fieldRules はフィールドの(myapp.validate)オプション。なければnil
+func fieldRules(fd protoreflect.FieldDescriptor) *hellopb.FieldRules {
+	rules, _ := proto.GetExtension(fd.Options(), hellopb.E_Validate).(*hellopb.FieldRules)
+	return rules
+}
+
+func validateField(msg protoreflect.Message, fd protoreflect.FieldDescriptor, rules *hellopb.FieldRules, path string) ([]*errdetails.BadRequest_FieldViolation, error) {
+	violation := func(format string, args ...interface{}) *errdetails.BadRequest_FieldViolation {
+		return &errdetails.BadRequest_FieldViolation{Field: path, Description: fmt.Sprintf(format, args...)}
+	}
+
+	if fd.Kind() != protoreflect.StringKind || fd.IsList() || fd.IsMap() {
+		// 文字列以外で意味のあるルールはrequiredだけ
+		if rules.GetRequired() && !msg.Has(fd) {
+			return []*errdetails.BadRequest_FieldViolation{violation("is required")}, nil
+		}
+		return nil, nil
+	}
+
+	v := msg.Get(fd).String()
+	if v == "" {
+		if rules.GetRequired() {
+			return []*errdetails.BadRequest_FieldViolation{violation("is required")}, nil
+		}
+		// 任意項目が空なら、長さやパターンのルールは適用しない
+		return nil, nil
+	}
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	n := utf8.RuneCountInString(v)
+	if min := rules.GetMinLen(); min > 0 && n < int(min) {
+		violations = append(violations, violation("must be at least %d characters, got %d", min, n))
+	}
+	if max := rules.GetMaxLen(); max > 0 && n > int(max) {
+		violations = append(violations, violation("must be at most %d characters, got %d", max, n))
+	}
+	if pattern := rules.GetPattern(); pattern != "" {
+		re, ok := validationPatterns[pattern]
+		if !ok {
+			return nil, fmt.Errorf("%s: pattern %q was not compiled at startup", fd.FullName(), pattern)
+		}
+		if !re.MatchString(v) {
+			violations = append(violations, violation("must match the pattern %q", pattern))
+		}
+	}
+	return violations, nil
+}
+
+// validationPatterns はcompileValidationPatternsでコンパイルしたパターン。起動時に作り、その後は読むだけ
+var validationPatterns = map[string]*regexp.Regexp{}
+
+// compileValidationPatterns はfilesに登録されたすべてのメッセージ(入れ子のメッセージも含む)から
+// (myapp.validate)のpatternを集めてコンパイルする。誤ったパターンはすべてまとめてエラーにする
+func compileValidationPatterns(files *protoregistry.Files) error {
+	var errs []error
+	files.RangeFiles(func(f protoreflect.FileDescriptor) bool {
+		errs = append(errs, compileMessagePatterns(f.Messages()))
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+func compileMessagePatterns(messages protoreflect.MessageDescriptors) error {
+	var errs []error
+	for i := 0; i < messages.Len(); i++ {
+		md := messages.Get(i)
+		fields := md.Fields()
+		for j := 0; j < fields.Len(); j++ {
+			fd := fields.Get(j)
+			pattern := fieldRules(fd).GetPattern()
+			if pattern == "" {
+				continue
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid validation pattern %q: %w", fd.FullName(), pattern, err))
+				continue
+			}
+			validationPatterns[pattern] = re
+		}
+		errs = append(errs, compileMessagePatterns(md.Messages()))
+	}
+	return errors.Join(errs...)
+}
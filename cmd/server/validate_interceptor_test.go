@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+
+	hellopb "mygrpc/pkg/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestValidateUnaryServerInterceptor(t *testing.T) {
+	if err := compileValidationPatterns(protoregistry.GlobalFiles); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		req  *hellopb.HelloRequest
+		code codes.Code
+	}{
+		{"valid", &hellopb.HelloRequest{Name: "alice"}, codes.OK},
+		{"required", &hellopb.HelloRequest{}, codes.InvalidArgument},
+		{"pattern", &hellopb.HelloRequest{Name: "ali\x00ce"}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateUnaryServerInterceptor()(context.Background(), tt.req, &grpc.UnaryServerInfo{FullMethod: "/myapp.GreetingService/Hello"},
+				func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+			if got := status.Code(err); got != tt.code {
+				t.Errorf("code = %v, want %v (%v)", got, tt.code, err)
+			}
+		})
+	}
+}
+
+// 起動時にコンパイルされていないパターンはリクエストの誤りではないので、INTERNALにする
+func TestValidateUncompiledPatternIsInternal(t *testing.T) {
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	prev := validationPatterns
+	validationPatterns = map[string]*regexp.Regexp{}
+	t.Cleanup(func() {
+		slog.SetDefault(prevLogger)
+		validationPatterns = prev
+	})
+
+	_, err := validateUnaryServerInterceptor()(context.Background(), &hellopb.HelloRequest{Name: "alice"}, &grpc.UnaryServerInfo{FullMethod: "/myapp.GreetingService/Hello"},
+		func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+	if got := status.Code(err); got != codes.Internal {
+		t.Errorf("code = %v, want Internal", got)
+	}
+}
+
+func TestCompileValidationPatternsRejectsInvalidPatterns(t *testing.T) {
+	field := func(name, pattern string) *descriptorpb.FieldDescriptorProto {
+		opts := &descriptorpb.FieldOptions{}
+		proto.SetExtension(opts, hellopb.E_Validate, &hellopb.FieldRules{Pattern: pattern})
+		return &descriptorpb.FieldDescriptorProto{
+			Name:    proto.String(name),
+			Number:  proto.Int32(1),
+			Type:    descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			Label:   descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Options: opts,
+		}
+	}
+	// 入れ子のメッセージのパターンも、リクエストが来る前にコンパイルする
+	f, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("bad.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name:       proto.String("Outer"),
+			Field:      []*descriptorpb.FieldDescriptorProto{field("ok", "^a+$")},
+			NestedType: []*descriptorpb.DescriptorProto{{Name: proto.String("Inner"), Field: []*descriptorpb.FieldDescriptorProto{field("bad", "(")}}},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := &protoregistry.Files{}
+	if err := files.RegisterFile(f); err != nil {
+		t.Fatal(err)
+	}
+
+	err = compileValidationPatterns(files)
+	if err == nil || !strings.Contains(err.Error(), "test.Outer.Inner.bad") {
+		t.Errorf("err = %v, want an error for test.Outer.Inner.bad", err)
+	}
+}
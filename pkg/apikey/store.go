@@ -0,0 +1,340 @@
+// Package apikey はx-api-keyメタデータで送るAPIキーを発行・検証する
+//
+// キーの値は "mgk_<id>_<secret>" の形で、サーバーのファイルにはsecretのSHA-256しか保存しない。
+// secretは32バイトの乱数なので、パスワードのような遅いハッシュは要らない。
+// 発行・無効化・ローテーションはすぐにファイルに書き、最終使用時刻はFlushでまとめて書く。
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix はキーの値の先頭に付ける文字列。ログやリポジトリに紛れ込んだキーを見つけやすくする
+const prefix = "mgk_"
+
+var (
+	// ErrInvalidKey はキーの形式が正しくないか、存在しないか、無効にされていることを表す
+	// どれに当たるかは呼び出し元に知らせない
+	ErrInvalidKey = errors.New("invalid API key")
+	// ErrExpiredKey はキーの有効期限が切れていることを表す
+	ErrExpiredKey = errors.New("API key has expired")
+	// ErrNotFound は管理操作で指定したIDのキーがないことを表す
+	ErrNotFound = errors.New("API key not found")
+	// ErrRevoked は無効にしたキーを操作しようとしたことを表す
+	ErrRevoked = errors.New("API key has been revoked")
+)
+
+// Key はAPIキーの情報。時刻のゼロ値は「未設定」を表す
+type Key struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Hash         string    `json:"hash"`
+	Scopes       []string  `json:"scopes"`
+	CreateTime   time.Time `json:"create_time"`
+	ExpireTime   time.Time `json:"expire_time"`
+	LastUsedTime time.Time `json:"last_used_time"`
+	RevokeTime   time.Time `json:"revoke_time"`
+}
+
+// Revoked はキーが無効にされているかどうか
+func (k *Key) Revoked() bool {
+	return !k.RevokeTime.IsZero()
+}
+
+// Allows はキーのスコープでfullMethodを呼べるかどうか
+// スコープは "/package.Service/Method"、"/package.Service/*" または "*"
+func (k *Key) Allows(fullMethod string) bool {
+	for _, s := range k.Scopes {
+		if s == "*" || s == fullMethod {
+			return true
+		}
+		if service, ok := strings.CutSuffix(s, "*"); ok && strings.HasPrefix(fullMethod, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateScope はスコープの書き方が正しいかどうかを確認する
+func ValidateScope(s string) error {
+	if s != "*" && (!strings.HasPrefix(s, "/") || strings.Count(s, "/") != 2) {
+		return fmt.Errorf("scope %q is not /package.Service/Method, /package.Service/* or *", s)
+	}
+	return nil
+}
+
+// Store はキーをJSONファイルに保存する
+type Store struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[string]*Key
+	// dirty は最終使用時刻がファイルにまだ書かれていないことを表す
+	dirty bool
+}
+
+// Open はpathのファイルからキーを読み込む。ファイルがなければ空のStoreを返し、最初の発行で作る
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, keys: make(map[string]*Key)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read API key store: %w", err)
+	}
+	var file struct {
+		Keys []*Key `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("parse API key store %s: %w", path, err)
+	}
+	for _, k := range file.Keys {
+		s.keys[k.ID] = k
+	}
+	return s, nil
+}
+
+// Len は無効にしたものも含めたキーの数
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+// Create は新しいキーを発行し、キーの情報とキーの値を返す。ttlが0なら期限なし
+func (s *Store) Create(name string, scopes []string, ttl time.Duration) (Key, string, error) {
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return Key{}, "", err
+	}
+	secret, hash, err := newSecret(id)
+	if err != nil {
+		return Key{}, "", err
+	}
+	now := time.Now().UTC()
+	k := &Key{ID: id, Name: name, Hash: hash, Scopes: slices.Clone(scopes), CreateTime: now}
+	if ttl > 0 {
+		k.ExpireTime = now.Add(ttl)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[id] = k
+	if err := s.save(); err != nil {
+		delete(s.keys, id)
+		return Key{}, "", err
+	}
+	return *k, secret, nil
+}
+
+// List は発行した順にキーを返す。includeRevokedがfalseなら無効にしたキーを除く
+func (s *Store) List(includeRevoked bool) []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		if includeRevoked || !k.Revoked() {
+			keys = append(keys, *k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreateTime.Before(keys[j].CreateTime) })
+	return keys
+}
+
+// Revoke はキーを無効にする
+func (s *Store) Revoke(id string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	if k.Revoked() {
+		return Key{}, ErrRevoked
+	}
+	k.RevokeTime = time.Now().UTC()
+	if err := s.save(); err != nil {
+		k.RevokeTime = time.Time{}
+		return Key{}, err
+	}
+	return *k, nil
+}
+
+// Rotate はキーの値を新しくする。ttlが0なら今の有効期限を引き継ぐ
+func (s *Store) Rotate(id string, ttl time.Duration) (Key, string, error) {
+	secret, hash, err := newSecret(id)
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return Key{}, "", ErrNotFound
+	}
+	if k.Revoked() {
+		return Key{}, "", ErrRevoked
+	}
+	old := *k
+	k.Hash = hash
+	if ttl > 0 {
+		k.ExpireTime = time.Now().UTC().Add(ttl)
+	}
+	if err := s.save(); err != nil {
+		*k = old
+		return Key{}, "", err
+	}
+	return *k, secret, nil
+}
+
+// Authenticate はキーの値を検証してキーの情報を返し、最終使用時刻を記録する
+func (s *Store) Authenticate(value string) (Key, error) {
+	id, _, ok := parse(value)
+	if !ok {
+		return Key{}, ErrInvalidKey
+	}
+	hash := hashSecret(value)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok || k.Revoked() || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) != 1 {
+		return Key{}, ErrInvalidKey
+	}
+	now := time.Now().UTC()
+	if !k.ExpireTime.IsZero() && now.After(k.ExpireTime) {
+		return Key{}, ErrExpiredKey
+	}
+	k.LastUsedTime = now
+	s.dirty = true
+	return *k, nil
+}
+
+// Flush はまだ書いていない最終使用時刻をファイルに書く
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// FlushEvery はctxがキャンセルされるまでintervalごとにFlushする
+// 呼び出し元をブロックするので、goroutineで実行すること
+func (s *Store) FlushEvery(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Flush(); err != nil {
+			onError(err)
+		}
+	}
+}
+
+// save はすべてのキーをファイルに書く。s.muを持った状態で呼ぶこと
+// 書き込みの途中で落ちても壊れたファイルが残らないよう、一時ファイルに書いてからrenameする
+func (s *Store) save() error {
+	file := struct {
+		Keys []*Key `json:"keys"`
+	}{Keys: make([]*Key, 0, len(s.keys))}
+	for _, k := range s.keys {
+		file.Keys = append(file.Keys, k)
+	}
+	sort.Slice(file.Keys, func(i, j int) bool { return file.Keys[i].CreateTime.Before(file.Keys[j].CreateTime) })
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("write API key store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write API key store: %w", err)
+	}
+	// ハッシュしか入っていないが、他のユーザーには読ませない
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write API key store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write API key store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("write API key store: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// newSecret はidのキーの値と、保存するハッシュを作る
+func newSecret(id string) (value, hash string, err error) {
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", "", err
+	}
+	value = prefix + id + "_" + secret
+	return value, hashSecret(value), nil
+}
+
+func hashSecret(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// parse はキーの値 "mgk_<id>_<secret>" をidとsecretに分ける
+func parse(value string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(rest, "_")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate random bytes: %w", err)
+	}
+	return encode(b), nil
+}
+
+type keyContextKey struct{}
+
+// NewContext は認証に使ったキーの情報を入れたコンテキストを返す
+func NewContext(ctx context.Context, k Key) context.Context {
+	return context.WithValue(ctx, keyContextKey{}, k)
+}
+
+// FromContext はNewContextで入れたキーの情報を取り出す
+func FromContext(ctx context.Context) (Key, bool) {
+	k, ok := ctx.Value(keyContextKey{}).(Key)
+	return k, ok
+}
@@ -0,0 +1,133 @@
+package apikey
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		method string
+		want   bool
+	}{
+		{"exact method", []string{"/myapp.GreetingService/Hello"}, "/myapp.GreetingService/Hello", true},
+		{"other method", []string{"/myapp.GreetingService/Hello"}, "/myapp.GreetingService/HelloBiStreams", false},
+		{"service", []string{"/myapp.GreetingService/*"}, "/myapp.GreetingService/HelloBiStreams", true},
+		{"service prefix is not another service", []string{"/myapp.GreetingService/*"}, "/myapp.GreetingServiceV2/Hello", false},
+		{"any of the scopes", []string{"/myapp.GreetingService/Hello", "/myapp.ApiKeyAdminService/*"}, "/myapp.ApiKeyAdminService/ListApiKeys", true},
+		{"everything", []string{"*"}, "/myapp.ApiKeyAdminService/CreateApiKey", true},
+		{"no scopes", nil, "/myapp.GreetingService/Hello", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &Key{Scopes: tt.scopes}
+			if got := k.Allows(tt.method); got != tt.want {
+				t.Errorf("Allows(%s) with %v = %v, want %v", tt.method, tt.scopes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	for _, s := range []string{"*", "/myapp.GreetingService/*", "/myapp.GreetingService/Hello"} {
+		if err := ValidateScope(s); err != nil {
+			t.Errorf("ValidateScope(%q) = %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "Hello", "myapp.GreetingService/Hello", "/myapp.GreetingService", "/myapp/GreetingService/Hello"} {
+		if err := ValidateScope(s); err == nil {
+			t.Errorf("ValidateScope(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestStoreLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, value, err := s.Create("ci", []string{"/myapp.GreetingService/*"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(value, prefix+k.ID+"_") {
+		t.Errorf("value %q does not start with %s%s_", value, prefix, k.ID)
+	}
+
+	got, err := s.Authenticate(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != k.ID || got.LastUsedTime.IsZero() {
+		t.Errorf("Authenticate() = %+v, want %s with the last used time", got, k.ID)
+	}
+	for _, bad := range []string{"", "mgk_", value + "x", prefix + k.ID + "_wrong", "xyz_" + strings.TrimPrefix(value, prefix)} {
+		if _, err := s.Authenticate(bad); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Authenticate(%q) = %v, want ErrInvalidKey", bad, err)
+		}
+	}
+
+	// ローテーションした後は古い値が使えない
+	_, rotated, err := s.Rotate(k.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(value); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("old value after Rotate: err = %v, want ErrInvalidKey", err)
+	}
+	if _, err := s.Authenticate(rotated); err != nil {
+		t.Errorf("new value after Rotate: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ファイルから読み直しても同じキーで認証できる
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Authenticate(rotated); err != nil {
+		t.Errorf("Authenticate after reopening: %v", err)
+	}
+
+	if _, err := s.Revoke(k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(rotated); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Authenticate after Revoke: err = %v, want ErrInvalidKey", err)
+	}
+	if _, err := s.Revoke(k.ID); !errors.Is(err, ErrRevoked) {
+		t.Errorf("second Revoke: err = %v, want ErrRevoked", err)
+	}
+	if _, _, err := s.Rotate("missing", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rotate(missing): err = %v, want ErrNotFound", err)
+	}
+	if got := len(s.List(false)); got != 0 {
+		t.Errorf("List(false) has %d keys, want the revoked key hidden", got)
+	}
+	if got := len(s.List(true)); got != 1 {
+		t.Errorf("List(true) has %d keys, want 1", got)
+	}
+}
+
+func TestStoreExpiredKey(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, value, err := s.Create("short", []string{"*"}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.Authenticate(value); !errors.Is(err, ErrExpiredKey) {
+		t.Errorf("Authenticate() = %v, want ErrExpiredKey", err)
+	}
+}
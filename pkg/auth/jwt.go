@@ -0,0 +1,269 @@
+// Package auth はJWTのBearerトークンを検証し、検証済みのクレームをコンテキストで運ぶ
+//
+// 署名の鍵は、HMACの共有鍵のファイルか、ローカルのJWKSファイル(RSA・ECDSA・HMACの鍵)から読む。
+// 署名に加えて exp・nbf・aud・iss を確認する。インターセプタ自体はcmd/serverにある。
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/metadata"
+)
+
+// ErrMissingToken はauthorizationメタデータがないことを表す
+var ErrMissingToken = errors.New("missing bearer token")
+
+// ErrMalformedHeader はauthorizationメタデータが "Bearer <token>" の形でないことを表す
+var ErrMalformedHeader = errors.New(`authorization metadata must be "Bearer <token>"`)
+
+// Claims は検証済みのトークンのクレーム
+type Claims struct {
+	jwt.RegisteredClaims
+	// Roles は呼び出し元に与えられたロール(独自クレーム)
+	Roles []string `json:"roles,omitempty"`
+	// Scope はスペース区切りのスコープ(RFC 8693)
+	Scope string `json:"scope,omitempty"`
+}
+
+type Config struct {
+	// HMACSecretFile はHS256/HS384/HS512の共有鍵を書いたファイル。末尾の改行は無視する
+	HMACSecretFile string
+	// JWKSFile は検証に使う公開鍵のJWK Set(RFC 7517)のファイル
+	JWKSFile string
+	// Issuer・Audience は空でなければ、トークンのiss・audと一致することを確認する
+	Issuer   string
+	Audience string
+	// Leeway はexp・nbfを確認するときに許す時計のずれ
+	Leeway time.Duration
+}
+
+// Verifier はトークンの署名とクレームを検証する
+type Verifier struct {
+	keyfunc jwt.Keyfunc
+	parser  *jwt.Parser
+}
+
+// NewVerifier はcfgの鍵を読み込んでVerifierを作る。HMACSecretFileとJWKSFileはどちらか一方を指定する
+func NewVerifier(cfg Config) (*Verifier, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+
+	v := &Verifier{}
+	switch {
+	case cfg.HMACSecretFile != "" && cfg.JWKSFile != "":
+		return nil, errors.New("set either an HMAC secret file or a JWKS file, not both")
+	case cfg.HMACSecretFile != "":
+		b, err := os.ReadFile(cfg.HMACSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("read HMAC secret: %w", err)
+		}
+		secret := bytes.TrimRight(b, "\r\n")
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("HMAC secret file %s is empty", cfg.HMACSecretFile)
+		}
+		// alg: none や公開鍵をHMACの鍵として使わせる攻撃を防ぐため、アルゴリズムを限定する
+		opts = append(opts, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}))
+		v.keyfunc = func(*jwt.Token) (interface{}, error) { return secret, nil }
+	case cfg.JWKSFile != "":
+		keys, err := loadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keyfunc = keys.keyfunc
+	default:
+		return nil, errors.New("no HMAC secret file or JWKS file")
+	}
+	v.parser = jwt.NewParser(opts...)
+	return v, nil
+}
+
+// Verify はトークンを検証してクレームを返す
+// エラーはjwt.ErrTokenExpiredなどをラップしているので、errors.Isで理由を判別できる
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.keyfunc); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// BearerToken は受信したメタデータの authorization: Bearer <token> からトークンを取り出す
+func BearerToken(md metadata.MD) (string, error) {
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", ErrMissingToken
+	}
+	scheme, token, ok := strings.Cut(values[0], " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", ErrMalformedHeader
+	}
+	return strings.TrimSpace(token), nil
+}
+
+type claimsKey struct{}
+
+// NewContext は検証済みのクレームを入れたコンテキストを返す
+func NewContext(ctx context.Context, c *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, c)
+}
+
+// FromContext はNewContextで入れたクレームを取り出す
+func FromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(claimsKey{}).(*Claims)
+	return c, ok
+}
+
+// jwks はkidごとの検証鍵
+type jwks map[string]interface{}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct(HMAC)
+	K string `json:"k"`
+}
+
+func loadJWKS(path string) (jwks, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read JWKS: %w", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("parse JWKS %s: %w", path, err)
+	}
+	keys := make(jwks, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("parse JWKS %s: keys[%d]: %w", path, i, err)
+		}
+		if _, dup := keys[k.Kid]; dup {
+			return nil, fmt.Errorf("parse JWKS %s: duplicate kid %q", path, k.Kid)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("parse JWKS %s: no signing keys", path)
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("k: invalid base64url value")
+		}
+		return secret, nil
+	}
+	return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid base64url value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keyfunc はトークンのkidに対応する鍵を返す。鍵が1つだけならkidがなくてもその鍵を使う
+// 鍵の種類とトークンのalgが合わなければ拒否する
+func (keys jwks) keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := keys[kid]
+	if !ok && kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if _, ok := t.Method.(*jwt.SigningMethodECDSA); ok {
+			return key, nil
+		}
+	case []byte:
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("alg %s cannot be used with a %T key", t.Method.Alg(), key)
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/metadata"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func writeFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func validClaims() *Claims {
+	now := time.Now()
+	return &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "alice",
+			Issuer:    "https://issuer.example",
+			Audience:  jwt.ClaimStrings{"greeting"},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+		Roles: []string{"admin"},
+	}
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	// 末尾の改行は鍵に含めない
+	v, err := NewVerifier(Config{
+		HMACSecretFile: writeFile(t, "secret", append(testSecret, '\n')),
+		Issuer:         "https://issuer.example",
+		Audience:       "greeting",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := v.Verify(sign(t, jwt.SigningMethodHS256, testSecret, "", validClaims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "alice" || len(claims.Roles) != 1 || claims.Roles[0] != "admin" {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	expired := validClaims()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	noExp := validClaims()
+	noExp.ExpiresAt = nil
+	otherIssuer := validClaims()
+	otherIssuer.Issuer = "https://other.example"
+	otherAudience := validClaims()
+	otherAudience.Audience = jwt.ClaimStrings{"other"}
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"expired", sign(t, jwt.SigningMethodHS256, testSecret, "", expired), jwt.ErrTokenExpired},
+		{"no exp", sign(t, jwt.SigningMethodHS256, testSecret, "", noExp), jwt.ErrTokenRequiredClaimMissing},
+		{"other issuer", sign(t, jwt.SigningMethodHS256, testSecret, "", otherIssuer), jwt.ErrTokenInvalidIssuer},
+		{"other audience", sign(t, jwt.SigningMethodHS256, testSecret, "", otherAudience), jwt.ErrTokenInvalidAudience},
+		{"wrong secret", sign(t, jwt.SigningMethodHS256, []byte("wrong"), "", validClaims()), jwt.ErrTokenSignatureInvalid},
+		{"alg none", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", validClaims()), jwt.ErrTokenSignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := v.Verify(tt.token); !errors.Is(err, tt.want) {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func encodeInt(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestVerifyJWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec-1", "use": "sig", "crv": "P-256", "x": encodeInt(ecKey.X.Bytes()), "y": encodeInt(ecKey.Y.Bytes())},
+		{"kty": "oct", "kid": "hmac-1", "k": encodeInt(testSecret)},
+		// 暗号化用の鍵は読み飛ばす
+		{"kty": "RSA", "kid": "enc-1", "use": "enc"},
+	}}
+	b, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier(Config{JWKSFile: writeFile(t, "jwks.json", b)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		wantOK bool
+	}{
+		{"ecdsa", sign(t, jwt.SigningMethodES256, ecKey, "ec-1", validClaims()), true},
+		{"hmac", sign(t, jwt.SigningMethodHS256, testSecret, "hmac-1", validClaims()), true},
+		{"unknown kid", sign(t, jwt.SigningMethodES256, ecKey, "ec-2", validClaims()), false},
+		// 鍵が複数あるときはkidが必要
+		{"no kid", sign(t, jwt.SigningMethodES256, ecKey, "", validClaims()), false},
+		// 鍵の種類とalgが合わなければ拒否する
+		{"hmac with the ec kid", sign(t, jwt.SigningMethodHS256, testSecret, "ec-1", validClaims()), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.Verify(tt.token)
+			if (err == nil) != tt.wantOK {
+				t.Errorf("Verify() = %v, want ok = %v", err, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNewVerifierRejectsInvalidConfig(t *testing.T) {
+	secret := writeFile(t, "secret", testSecret)
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"no keys", Config{}},
+		{"both", Config{HMACSecretFile: secret, JWKSFile: secret}},
+		{"empty secret", Config{HMACSecretFile: writeFile(t, "empty", []byte("\n"))}},
+		{"no signing keys", Config{JWKSFile: writeFile(t, "jwks.json", []byte(`{"keys": []}`))}},
+		{"bad curve", Config{JWKSFile: writeFile(t, "jwks.json", []byte(`{"keys": [{"kty": "EC", "crv": "P-192", "x": "AQ", "y": "AQ"}]}`))}},
+		{"point not on curve", Config{JWKSFile: writeFile(t, "jwks.json", []byte(`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`))}},
+		{"duplicate kid", Config{JWKSFile: writeFile(t, "jwks.json", []byte(`{"keys": [{"kty": "oct", "kid": "a", "k": "AQ"}, {"kty": "oct", "kid": "a", "k": "Ag"}]}`))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewVerifier(tt.cfg); err == nil {
+				t.Error("NewVerifier() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		md      metadata.MD
+		want    string
+		wantErr error
+	}{
+		{"bearer", metadata.Pairs("authorization", "Bearer abc"), "abc", nil},
+		{"case insensitive scheme", metadata.Pairs("authorization", "bearer abc"), "abc", nil},
+		{"missing", metadata.MD{}, "", ErrMissingToken},
+		{"basic", metadata.Pairs("authorization", "Basic abc"), "", ErrMalformedHeader},
+		{"no token", metadata.Pairs("authorization", "Bearer "), "", ErrMalformedHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BearerToken(tt.md)
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("BearerToken() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
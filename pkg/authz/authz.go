@@ -0,0 +1,165 @@
+// Package authz はメソッドごとの認可ポリシーを評価する
+//
+// ポリシーはYAMLファイルに書いたルールの並びで、上から順にメソッド名(FullMethod)と呼び出し元を照合し、
+// 最初に一致したルールのeffect(allow / deny)で決まる。どのルールにも一致しなければdefaultに従う。
+//
+//	default: deny
+//	rules:
+//	  - name: bidi-for-admins
+//	    methods: ["/myapp.GreetingService/HelloBiStreams"]
+//	    roles: [admin]
+//	  - name: greeting-for-everyone
+//	    methods: ["/myapp.GreetingService/*"]
+//
+// 呼び出し元の条件(subjects・roles・sans・api_keys)は、どれか1つに一致すればよい。
+// 条件を1つも書かないルールは、認証されていない呼び出し元も含めて誰にでも一致する。
+package authz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Principal はルールと照合する呼び出し元の情報
+type Principal struct {
+	// Subject・Roles はJWTのsub・rolesクレーム
+	Subject string
+	Roles   []string
+	// SANs はmTLSのクライアント証明書のSAN(DNS名・URI・メールアドレス)
+	SANs []string
+	// APIKey はx-api-keyで認証された鍵のID
+	APIKey string
+}
+
+type Policy struct {
+	// Default はどのルールにも一致しなかったときのeffect。省略時はdeny
+	Default string `yaml:"default"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+type Rule struct {
+	// Name はログやエラーの詳細に出すルールの名前
+	Name string `yaml:"name"`
+	// Methods は "/package.Service/Method"、サービス全体なら "/package.Service/*"、すべてなら "*"
+	Methods []string `yaml:"methods"`
+	// Effect は allow / deny のいずれか。省略時はallow
+	Effect string `yaml:"effect"`
+
+	Subjects []string `yaml:"subjects"`
+	Roles    []string `yaml:"roles"`
+	// SANs はpath.Matchのパターン("spiffe://example.org/ns/*/sa/client" など)
+	SANs    []string `yaml:"sans"`
+	APIKeys []string `yaml:"api_keys"`
+}
+
+// Decision は評価の結果
+type Decision struct {
+	Allowed bool
+	// Rule は決め手になったルールの名前。defaultで決まったときは空
+	Rule string
+}
+
+// Load はポリシーファイルを読み込んで検証する
+func Load(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy file: %w", err)
+	}
+	p := &Policy{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("parse policy %s: %w", path, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	var errs []error
+	if p.Default == "" {
+		p.Default = "deny"
+	}
+	if p.Default != "allow" && p.Default != "deny" {
+		errs = append(errs, fmt.Errorf("default: unknown effect %q (want allow or deny)", p.Default))
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rules[%d]", i)
+		}
+		if r.Effect == "" {
+			r.Effect = "allow"
+		}
+		if r.Effect != "allow" && r.Effect != "deny" {
+			errs = append(errs, fmt.Errorf("%s: unknown effect %q (want allow or deny)", r.Name, r.Effect))
+		}
+		if len(r.Methods) == 0 {
+			errs = append(errs, fmt.Errorf("%s: methods must not be empty", r.Name))
+		}
+		for _, m := range r.Methods {
+			if m != "*" && (!strings.HasPrefix(m, "/") || strings.Count(m, "/") != 2) {
+				errs = append(errs, fmt.Errorf("%s: method %q is not /package.Service/Method, /package.Service/* or *", r.Name, m))
+			}
+		}
+		for _, san := range r.SANs {
+			if _, err := path.Match(san, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s: san %q: %w", r.Name, san, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Evaluate はfullMethodをprincipalが呼んでよいかどうかを判定する
+func (p *Policy) Evaluate(fullMethod string, principal Principal) Decision {
+	for _, r := range p.Rules {
+		if r.matchMethod(fullMethod) && r.matchPrincipal(principal) {
+			return Decision{Allowed: r.Effect == "allow", Rule: r.Name}
+		}
+	}
+	return Decision{Allowed: p.Default == "allow"}
+}
+
+func (r *Rule) matchMethod(fullMethod string) bool {
+	for _, m := range r.Methods {
+		if m == "*" || m == fullMethod {
+			return true
+		}
+		if service, ok := strings.CutSuffix(m, "*"); ok && strings.HasPrefix(fullMethod, service) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchPrincipal(pr Principal) bool {
+	if len(r.Subjects) == 0 && len(r.Roles) == 0 && len(r.SANs) == 0 && len(r.APIKeys) == 0 {
+		return true
+	}
+	if pr.Subject != "" && slices.Contains(r.Subjects, pr.Subject) {
+		return true
+	}
+	for _, role := range pr.Roles {
+		if slices.Contains(r.Roles, role) {
+			return true
+		}
+	}
+	for _, pattern := range r.SANs {
+		for _, san := range pr.SANs {
+			if ok, _ := path.Match(pattern, san); ok {
+				return true
+			}
+		}
+	}
+	return pr.APIKey != "" && slices.Contains(r.APIKeys, pr.APIKey)
+}
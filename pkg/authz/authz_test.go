@@ -0,0 +1,142 @@
+package authz
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadPolicy(t *testing.T, content string) (*Policy, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+const testPolicy = `
+rules:
+  - name: no-bidi-for-guests
+    methods: ["/myapp.GreetingService/HelloBiStreams"]
+    effect: deny
+    roles: [guest]
+  - name: bidi-for-admins
+    methods: ["/myapp.GreetingService/HelloBiStreams"]
+    roles: [admin]
+  - name: batch-jobs
+    methods: ["/myapp.GreetingService/HelloClientStream"]
+    subjects: [batch]
+    sans: ["spiffe://example.org/ns/*/sa/batch"]
+    api_keys: [key-batch]
+  - name: greeting-for-everyone
+    methods: ["/myapp.GreetingService/Hello"]
+  - name: admins-everywhere
+    methods: ["*"]
+    roles: [admin]
+`
+
+func TestEvaluate(t *testing.T) {
+	p, err := loadPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		hello        = "/myapp.GreetingService/Hello"
+		bidi         = "/myapp.GreetingService/HelloBiStreams"
+		clientStream = "/myapp.GreetingService/HelloClientStream"
+		serverStream = "/myapp.GreetingService/HelloServerStream"
+	)
+	tests := []struct {
+		name      string
+		method    string
+		principal Principal
+		want      Decision
+	}{
+		{"anyone may call Hello", hello, Principal{}, Decision{Allowed: true, Rule: "greeting-for-everyone"}},
+		{"admin role", bidi, Principal{Subject: "alice", Roles: []string{"user", "admin"}}, Decision{Allowed: true, Rule: "bidi-for-admins"}},
+		// 上のルールが先に一致する
+		{"deny rule first", bidi, Principal{Roles: []string{"guest", "admin"}}, Decision{Allowed: false, Rule: "no-bidi-for-guests"}},
+		{"subject", clientStream, Principal{Subject: "batch"}, Decision{Allowed: true, Rule: "batch-jobs"}},
+		{"san pattern", clientStream, Principal{SANs: []string{"spiffe://example.org/ns/prod/sa/batch"}}, Decision{Allowed: true, Rule: "batch-jobs"}},
+		{"san pattern does not cross segments", clientStream, Principal{SANs: []string{"spiffe://example.org/ns/a/b/sa/batch"}}, Decision{}},
+		{"api key", clientStream, Principal{APIKey: "key-batch"}, Decision{Allowed: true, Rule: "batch-jobs"}},
+		{"other api key", clientStream, Principal{APIKey: "key-other"}, Decision{}},
+		{"wildcard method", serverStream, Principal{Roles: []string{"admin"}}, Decision{Allowed: true, Rule: "admins-everywhere"}},
+		// どのルールにも一致しなければdefault(省略時はdeny)
+		{"default", serverStream, Principal{Subject: "alice"}, Decision{}},
+		{"unauthenticated", bidi, Principal{}, Decision{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Evaluate(tt.method, tt.principal); got != tt.want {
+				t.Errorf("Evaluate(%s, %+v) = %+v, want %+v", tt.method, tt.principal, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchMethod(t *testing.T) {
+	tests := []struct {
+		pattern string
+		method  string
+		want    bool
+	}{
+		{"/myapp.GreetingService/Hello", "/myapp.GreetingService/Hello", true},
+		{"/myapp.GreetingService/Hello", "/myapp.GreetingService/HelloBiStreams", false},
+		{"/myapp.GreetingService/*", "/myapp.GreetingService/HelloBiStreams", true},
+		{"/myapp.GreetingService/*", "/myapp.GreetingServiceV2/Hello", false},
+		{"*", "/grpc.health.v1.Health/Check", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.method, func(t *testing.T) {
+			r := Rule{Methods: []string{tt.pattern}}
+			if got := r.matchMethod(tt.method); got != tt.want {
+				t.Errorf("matchMethod() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultAllow(t *testing.T) {
+	p, err := loadPolicy(t, `
+default: allow
+rules:
+  - methods: ["/myapp.GreetingService/HelloBiStreams"]
+    effect: deny
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Evaluate("/myapp.GreetingService/Hello", Principal{}); !got.Allowed || got.Rule != "" {
+		t.Errorf("Evaluate(Hello) = %+v, want allowed by default", got)
+	}
+	// 名前のないルールは位置で呼ぶ
+	if got := p.Evaluate("/myapp.GreetingService/HelloBiStreams", Principal{}); got.Allowed || got.Rule != "rules[0]" {
+		t.Errorf("Evaluate(HelloBiStreams) = %+v, want denied by rules[0]", got)
+	}
+}
+
+func TestLoadRejectsInvalidPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown default", "default: maybe\n", `default: unknown effect "maybe"`},
+		{"unknown effect", "rules:\n  - name: r\n    methods: [\"*\"]\n    effect: permit\n", `r: unknown effect "permit"`},
+		{"no methods", "rules:\n  - name: r\n", "r: methods must not be empty"},
+		{"bad method", "rules:\n  - name: r\n    methods: [Hello]\n", `method "Hello" is not`},
+		{"bad san", "rules:\n  - name: r\n    methods: [\"*\"]\n    sans: [\"[\"]\n", `r: san "["`},
+		{"unknown field", "rules:\n  - name: r\n    methods: [\"*\"]\n    role: [admin]\n", "field role not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadPolicy(t, tt.content)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
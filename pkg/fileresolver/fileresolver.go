@@ -0,0 +1,225 @@
+// Package fileresolver はJSONファイルに書いたエンドポイントを返すgRPCのリゾルバーを提供する
+//
+// パッケージをインポートすると file スキームのリゾルバーが登録され、ターゲットにファイルのパスを指定できる。
+//
+//	grpc.Dial("file:///etc/mygrpc/endpoints.json", ...)
+//
+// ファイルには接続先のアドレスと、その属性(重み・ゾーン)を書く。weight は 1 から lb.MaxWeight まで、省略すると 1 になる。
+//
+//	{"endpoints": [
+//	  {"address": "localhost:8081", "weight": 2, "zone": "a"},
+//	  {"address": "localhost:8082", "zone": "b"}
+//	]}
+//
+// 重みは lb.Weight で、ゾーンは Zone で取り出せる属性として、アドレスのBalancerAttributesに入れる。
+// ファイルが変わるとClientConnに新しいアドレスを渡す。読めない・壊れているときはClientConn.ReportErrorでエラーを報告し、
+// バランサーはそれまでのアドレスを使い続ける。
+package fileresolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"mygrpc/pkg/filewatch"
+	"mygrpc/pkg/lb"
+
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme はターゲットのスキーム
+const Scheme = "file"
+
+// Interval はファイルの変更を確認する間隔
+const Interval = time.Second
+
+var logger = grpclog.Component("file-resolver")
+
+func init() {
+	resolver.Register(builder{})
+}
+
+// Endpoint はファイルに書く接続先1つ分
+type Endpoint struct {
+	Address string `json:"address"`
+	Weight  uint32 `json:"weight,omitempty"`
+	Zone    string `json:"zone,omitempty"`
+}
+
+type endpointsFile struct {
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// Load はエンドポイントのファイルを読み、内容を確認する
+func Load(path string) ([]Endpoint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read endpoints file: %w", err)
+	}
+	var f endpointsFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("parse endpoints file %s: %w", path, err)
+	}
+	if len(f.Endpoints) == 0 {
+		return nil, fmt.Errorf("endpoints file %s: no endpoints", path)
+	}
+
+	var errs []error
+	seen := make(map[string]bool)
+	for i := range f.Endpoints {
+		e := &f.Endpoints[i]
+		if _, _, err := net.SplitHostPort(e.Address); err != nil {
+			errs = append(errs, fmt.Errorf("endpoints[%d]: address %q: %w", i, e.Address, err))
+			continue
+		}
+		if seen[e.Address] {
+			errs = append(errs, fmt.Errorf("endpoints[%d]: duplicate address %q", i, e.Address))
+		}
+		seen[e.Address] = true
+		if e.Weight > lb.MaxWeight {
+			errs = append(errs, fmt.Errorf("endpoints[%d]: weight %d exceeds the maximum of %d", i, e.Weight, lb.MaxWeight))
+		}
+		if e.Weight == 0 {
+			e.Weight = 1
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("endpoints file %s: %w", path, err)
+	}
+	return f.Endpoints, nil
+}
+
+type zoneKey struct{}
+
+// Zone はこのリゾルバーが返したアドレスのゾーンを返す。ゾーンがなければ空文字列
+func Zone(addr resolver.Address) string {
+	zone, _ := addr.BalancerAttributes.Value(zoneKey{}).(string)
+	return zone
+}
+
+// Addresses はエンドポイントをClientConnに渡すアドレスにする
+func Addresses(endpoints []Endpoint) []resolver.Address {
+	addrs := make([]resolver.Address, len(endpoints))
+	for i, e := range endpoints {
+		a := lb.SetWeight(resolver.Address{Addr: e.Address}, e.Weight)
+		if e.Zone != "" {
+			a.BalancerAttributes = a.BalancerAttributes.WithValue(zoneKey{}, e.Zone)
+		}
+		addrs[i] = a
+	}
+	return addrs
+}
+
+type builder struct{}
+
+func (builder) Scheme() string {
+	return Scheme
+}
+
+// Build はファイルを読んで最初のアドレスを渡し、変更の監視を始める
+// ファイルが読めなくてもエラーは返さず、ReportErrorで報告する。後からファイルができれば、そこで接続先が決まる
+func (builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	if target.URL.Host != "" {
+		return nil, fmt.Errorf("file resolver: unexpected host %q in target %q (want file:///path/to/endpoints.json)", target.URL.Host, target.URL.String())
+	}
+	// file:///abs/path はPathに、file:rel/path はOpaqueに入る
+	path := target.URL.Path
+	if path == "" {
+		path = target.URL.Opaque
+	}
+	if path == "" {
+		return nil, fmt.Errorf("file resolver: no path in target %q", target.URL.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &fileResolver{
+		path:       path,
+		cc:         cc,
+		resolveNow: make(chan struct{}, 1),
+		cancel:     cancel,
+	}
+	// 読む前に状態を記録しておき、最初に読んでから監視が始まるまでの変更も拾う
+	watcher := filewatch.New(path)
+	r.resolve()
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		watcher.Run(ctx, Interval, r.resolve)
+	}()
+	go func() {
+		defer r.wg.Done()
+		r.watchResolveNow(ctx)
+	}()
+	return r, nil
+}
+
+type fileResolver struct {
+	path       string
+	cc         resolver.ClientConn
+	resolveNow chan struct{}
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+
+	mu sync.Mutex
+	// last は最後にClientConnに渡したエンドポイント。同じ内容なら渡し直さない
+	last []Endpoint
+}
+
+// resolve はファイルを読み直し、変わっていればClientConnに渡す
+func (r *fileResolver) resolve() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endpoints, err := Load(r.path)
+	if err != nil {
+		logger.Warningf("%v", err)
+		r.cc.ReportError(err)
+		// 直った後は、前と同じ内容でもエラーを消すために渡し直す
+		r.last = nil
+		return
+	}
+	if slices.Equal(endpoints, r.last) {
+		return
+	}
+	r.last = endpoints
+	logger.Infof("resolved %d endpoints from %s", len(endpoints), r.path)
+	if err := r.cc.UpdateState(resolver.State{Addresses: Addresses(endpoints)}); err != nil {
+		// gRPCがResolveNowで読み直しを頼んでくるので、そのときは同じ内容でも渡し直す
+		logger.Warningf("endpoints from %s were rejected: %v", r.path, err)
+		r.last = nil
+	}
+}
+
+// watchResolveNow はResolveNowで頼まれた読み直しを行う
+func (r *fileResolver) watchResolveNow(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.resolveNow:
+			r.resolve()
+		}
+	}
+}
+
+// ResolveNow はバックエンドにつながらないときなどにgRPCから呼ばれる。すでに頼まれていれば何もしない
+func (r *fileResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *fileResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
@@ -0,0 +1,174 @@
+package fileresolver
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mygrpc/pkg/lb"
+
+	"google.golang.org/grpc/resolver"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []Endpoint
+		wantErr string
+	}{
+		{
+			name:    "weights and zones",
+			content: `{"endpoints": [{"address": "localhost:8081", "weight": 3, "zone": "a"}, {"address": "localhost:8082"}]}`,
+			want:    []Endpoint{{Address: "localhost:8081", Weight: 3, Zone: "a"}, {Address: "localhost:8082", Weight: 1}},
+		},
+		{
+			name:    "maximum weight",
+			content: `{"endpoints": [{"address": "localhost:8081", "weight": 100}]}`,
+			want:    []Endpoint{{Address: "localhost:8081", Weight: 100}},
+		},
+		{name: "weight too large", content: `{"endpoints": [{"address": "localhost:8081", "weight": 4000000000}]}`, wantErr: "exceeds the maximum"},
+		{name: "missing port", content: `{"endpoints": [{"address": "localhost"}]}`, wantErr: "missing port"},
+		{name: "duplicate", content: `{"endpoints": [{"address": "localhost:8081"}, {"address": "localhost:8081"}]}`, wantErr: "duplicate address"},
+		{name: "unknown field", content: `{"endpoints": [{"address": "localhost:8081", "wieght": 2}]}`, wantErr: `unknown field "wieght"`},
+		{name: "no endpoints", content: `{"endpoints": []}`, wantErr: "no endpoints"},
+		{name: "broken JSON", content: `{"endpoints": [`, wantErr: "parse endpoints file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "endpoints.json")
+			writeFile(t, path, tt.content)
+			got, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Load() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("endpoints[%d] = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAddressesCarryAttributes(t *testing.T) {
+	addrs := Addresses([]Endpoint{{Address: "localhost:8081", Weight: 3, Zone: "a"}, {Address: "localhost:8082", Weight: 1}})
+	if got := lb.Weight(addrs[0]); got != 3 {
+		t.Errorf("weight = %d, want 3", got)
+	}
+	if got := Zone(addrs[0]); got != "a" {
+		t.Errorf("zone = %q, want a", got)
+	}
+	if got := Zone(addrs[1]); got != "" {
+		t.Errorf("zone = %q, want empty", got)
+	}
+}
+
+// fakeClientConn はリゾルバーから渡された状態とエラーを記録する
+type fakeClientConn struct {
+	resolver.ClientConn
+
+	mu     sync.Mutex
+	states []resolver.State
+	errs   []error
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.states = append(cc.states, s)
+	return nil
+}
+
+func (cc *fakeClientConn) ReportError(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.errs = append(cc.errs, err)
+}
+
+func (cc *fakeClientConn) counts() (states, errs int) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return len(cc.states), len(cc.errs)
+}
+
+func (cc *fakeClientConn) lastAddrs() []string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	var addrs []string
+	for _, a := range cc.states[len(cc.states)-1].Addresses {
+		addrs = append(addrs, a.Addr)
+	}
+	return addrs
+}
+
+// waitFor はcondが満たされるまで、ファイルの確認間隔の数倍だけ待つ
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * Interval)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestResolverWatchesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	writeFile(t, path, `{"endpoints": [{"address": "localhost:8081"}]}`)
+
+	cc := &fakeClientConn{}
+	r, err := builder{}.Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: path}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if states, _ := cc.counts(); states != 1 {
+		t.Fatalf("states after Build = %d, want 1", states)
+	}
+
+	writeFile(t, path, `{"endpoints": [{"address": "localhost:8081"}, {"address": "localhost:8082", "weight": 2}]}`)
+	waitFor(t, "the new endpoints", func() bool { states, _ := cc.counts(); return states == 2 })
+	if got := strings.Join(cc.lastAddrs(), ","); got != "localhost:8081,localhost:8082" {
+		t.Errorf("addresses = %s", got)
+	}
+
+	// 壊れたファイルはエラーとして報告し、状態は更新しない
+	writeFile(t, path, `{"endpoints": [`)
+	waitFor(t, "the resolver error", func() bool { _, errs := cc.counts(); return errs == 1 })
+	if states, _ := cc.counts(); states != 2 {
+		t.Errorf("states after a broken file = %d, want 2", states)
+	}
+
+	// 直れば、前と同じ内容でも渡し直す
+	writeFile(t, path, `{"endpoints": [{"address": "localhost:8081"}, {"address": "localhost:8082", "weight": 2}]}`)
+	waitFor(t, "the fixed endpoints", func() bool { states, _ := cc.counts(); return states == 3 })
+}
+
+func TestBuildRejectsHost(t *testing.T) {
+	target := resolver.Target{URL: url.URL{Scheme: Scheme, Host: "host", Path: "/endpoints.json"}}
+	if _, err := (builder{}).Build(target, &fakeClientConn{}, resolver.BuildOptions{}); err == nil {
+		t.Fatal("Build() with a host succeeded, want an error")
+	}
+}
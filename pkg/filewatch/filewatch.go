@@ -0,0 +1,73 @@
+// Package filewatch は設定ファイルや証明書ファイルの変更をポーリングで検知する
+//
+// fsnotifyのようなイベント通知ではなく、一定間隔でstatした結果(更新時刻とサイズ)を比べる。
+// Kubernetesのsecretのようにシンボリックリンクの差し替えで更新されるファイルも、
+// os.Statがリンク先をたどるのでそのまま検知できる。
+package filewatch
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func stat(path string) fileState {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{modTime: fi.ModTime(), size: fi.Size(), exists: true}
+}
+
+// Watcher はファイルの状態を覚えておき、変わっていれば知らせる
+type Watcher struct {
+	paths []string
+	last  []fileState
+}
+
+// New はpathsの今の状態を記録したWatcherを返す
+// ファイルを読む前に作っておけば、読んでからRunが始まるまでの間の変更も見逃さない
+func New(paths ...string) *Watcher {
+	w := &Watcher{paths: paths, last: make([]fileState, len(paths))}
+	for i, p := range paths {
+		w.last[i] = stat(p)
+	}
+	return w
+}
+
+// Run はctxがキャンセルされるまでintervalごとにファイルを確認し、
+// いずれかのファイルがNewか前回の確認から変わっていればonChangeを1回呼び出す
+// 呼び出し元をブロックするので、goroutineで実行すること
+func (w *Watcher) Run(ctx context.Context, interval time.Duration, onChange func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed := false
+		for i, p := range w.paths {
+			if s := stat(p); s != w.last[i] {
+				w.last[i] = s
+				changed = true
+			}
+		}
+		if changed {
+			onChange()
+		}
+	}
+}
+
+// Watch はNew(paths...).Runと同じ。呼び出した時点の状態から変更を検知する
+func Watch(ctx context.Context, paths []string, interval time.Duration, onChange func()) {
+	New(paths...).Run(ctx, interval, onChange)
+}
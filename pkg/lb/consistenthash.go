@@ -0,0 +1,281 @@
+// Package lb はクライアント側の負荷分散ポリシーを提供する
+//
+// consistent_hash_by_name は、RPCごとのハッシュキー(Helloなら名前)から、コンシステントハッシュで接続先を選ぶ。
+// 同じキーの呼び出しは同じバックエンドに届き、バックエンドが増減しても移動するキーは一部だけで済む。
+// キーはWithHashKeyでコンテキストに入れる。キーがなければ接続済みのバックエンドからラウンドロビンで選ぶ。
+// SetWeightでアドレスに重みを付けると、リングに重みの数だけ多く置き、その分多くのキーを受け持たせる。
+//
+// パッケージをインポートするとポリシーが登録され、service configの loadBalancingConfig で指定できる。
+//
+//	{"loadBalancingConfig": [{"consistent_hash_by_name": {}}]}
+package lb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+)
+
+// ConsistentHashName はservice configで指定するポリシーの名前
+const ConsistentHashName = "consistent_hash_by_name"
+
+// replicas は重み1のバックエンドをリングに置く数。多いほど偏りが小さくなる
+const replicas = 100
+
+// MaxWeight は重みの上限。リングの大きさはバックエンドごとに replicas*重み になるので、大きすぎる重みは切り詰める
+const MaxWeight = 100
+
+var logger = grpclog.Component(ConsistentHashName)
+
+func init() {
+	balancer.Register(ringBuilder{})
+}
+
+type hashKey struct{}
+
+// WithHashKey はバックエンドを選ぶためのキーを入れたコンテキストを返す
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// HashKeyFromContext はWithHashKeyで入れたキーを取り出す
+func HashKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKey{}).(string)
+	return key, ok
+}
+
+type weightKey struct{}
+
+// SetWeight はアドレスに重みを付ける。リゾルバーが返すアドレスに使う
+func SetWeight(addr resolver.Address, weight uint32) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(weightKey{}, weight)
+	return addr
+}
+
+// Weight はSetWeightで付けた重みを返す。付いていなければ1、MaxWeightを超えていればMaxWeight
+func Weight(addr resolver.Address) uint32 {
+	w, _ := addr.BalancerAttributes.Value(weightKey{}).(uint32)
+	switch {
+	case w == 0:
+		return 1
+	case w > MaxWeight:
+		return MaxWeight
+	}
+	return w
+}
+
+type ringBuilder struct{}
+
+func (ringBuilder) Name() string {
+	return ConsistentHashName
+}
+
+func (ringBuilder) Build(cc balancer.ClientConn, _ balancer.BuildOptions) balancer.Balancer {
+	return &ringBalancer{cc: cc, subConns: make(map[string]*subConn)}
+}
+
+// subConn はバックエンド1つ分のコネクションと、その状態
+type subConn struct {
+	addr   string
+	weight uint32
+	sc     balancer.SubConn
+	state  connectivity.State
+}
+
+// ringBalancer はリゾルバーから受け取ったすべてのバックエンドに接続し、状態が変わるたびにピッカーを作り直す
+// リングには接続中のバックエンドも含める。接続済みのものだけで作ると、
+// 起動直後のように一部しかつながっていないときに、同じキーが別のバックエンドに届いてしまう
+type ringBalancer struct {
+	cc balancer.ClientConn
+
+	mu       sync.Mutex
+	subConns map[string]*subConn
+	// resolverErr は最後にリゾルバーが報告したエラー。バックエンドがないときのピッカーのエラーに使う
+	resolverErr error
+}
+
+func (b *ringBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(s.ResolverState.Addresses) == 0 {
+		b.resolverErr = errors.New("resolver returned no addresses")
+		b.updatePickerLocked()
+		return balancer.ErrBadResolverState
+	}
+	b.resolverErr = nil
+
+	seen := make(map[string]bool)
+	for _, a := range s.ResolverState.Addresses {
+		seen[a.Addr] = true
+		if s, ok := b.subConns[a.Addr]; ok {
+			s.weight = Weight(a)
+			continue
+		}
+		b.newSubConnLocked(a)
+	}
+	for addr, sc := range b.subConns {
+		if !seen[addr] {
+			sc.sc.Shutdown()
+			delete(b.subConns, addr)
+		}
+	}
+	b.updatePickerLocked()
+	return nil
+}
+
+func (b *ringBalancer) newSubConnLocked(a resolver.Address) {
+	s := &subConn{addr: a.Addr, weight: Weight(a), state: connectivity.Idle}
+	sc, err := b.cc.NewSubConn([]resolver.Address{a}, balancer.NewSubConnOptions{
+		HealthCheckEnabled: true,
+		StateListener:      func(st balancer.SubConnState) { b.updateSubConnState(s, st) },
+	})
+	if err != nil {
+		logger.Warningf("failed to create SubConn for %s: %v", a.Addr, err)
+		return
+	}
+	s.sc = sc
+	b.subConns[a.Addr] = s
+	// キーがどのバックエンドに当たってもすぐ送れるよう、最初からすべてに接続しておく
+	sc.Connect()
+}
+
+func (b *ringBalancer) updateSubConnState(s *subConn, st balancer.SubConnState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if st.ConnectivityState == connectivity.Shutdown {
+		return
+	}
+	s.state = st.ConnectivityState
+	if s.state == connectivity.Idle {
+		// アイドルで切れたコネクションはつなぎ直す
+		s.sc.Connect()
+	}
+	b.updatePickerLocked()
+}
+
+func (b *ringBalancer) ResolverError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resolverErr = err
+	// 使えるバックエンドがあるうちは、リゾルバーのエラーがあってもそのまま使い続ける
+	if len(b.subConns) == 0 {
+		b.updatePickerLocked()
+	}
+}
+
+func (b *ringBalancer) UpdateSubConnState(sc balancer.SubConn, st balancer.SubConnState) {
+	logger.Errorf("UpdateSubConnState(%v, %+v) called unexpectedly", sc, st)
+}
+
+func (b *ringBalancer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for addr, sc := range b.subConns {
+		sc.sc.Shutdown()
+		delete(b.subConns, addr)
+	}
+}
+
+// updatePickerLocked は今のバックエンドの状態からピッカーを作ってClientConnに渡す。b.muを持った状態で呼ぶこと
+func (b *ringBalancer) updatePickerLocked() {
+	if len(b.subConns) == 0 {
+		err := b.resolverErr
+		if err == nil {
+			err = balancer.ErrNoSubConnAvailable
+		}
+		b.cc.UpdateState(balancer.State{ConnectivityState: connectivity.TransientFailure, Picker: errPicker{err}})
+		return
+	}
+	p := &ringPicker{}
+	var connecting bool
+	for _, s := range b.subConns {
+		// ピッカーは状態の写しを持つ。状態が変わればピッカーごと作り直される
+		e := ringEntry{subConn: *s}
+		for i := 0; i < replicas*int(s.weight); i++ {
+			e.hash = hash(s.addr + "#" + strconv.Itoa(i))
+			p.ring = append(p.ring, e)
+		}
+		switch s.state {
+		case connectivity.Ready:
+			p.ready = append(p.ready, s.sc)
+		case connectivity.Idle, connectivity.Connecting:
+			connecting = true
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		if p.ring[i].hash != p.ring[j].hash {
+			return p.ring[i].hash < p.ring[j].hash
+		}
+		return p.ring[i].addr < p.ring[j].addr
+	})
+
+	state := connectivity.TransientFailure
+	switch {
+	case len(p.ready) > 0:
+		state = connectivity.Ready
+	case connecting:
+		state = connectivity.Connecting
+	}
+	b.cc.UpdateState(balancer.State{ConnectivityState: state, Picker: p})
+}
+
+type ringEntry struct {
+	subConn
+	hash uint64
+}
+
+type ringPicker struct {
+	ring  []ringEntry
+	ready []balancer.SubConn
+	next  atomic.Uint32
+}
+
+func (p *ringPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	key, ok := HashKeyFromContext(info.Ctx)
+	if !ok {
+		if len(p.ready) == 0 {
+			return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+		}
+		n := p.next.Add(1) - 1
+		return balancer.PickResult{SubConn: p.ready[int(n)%len(p.ready)]}, nil
+	}
+	h := hash(key)
+	// キーのハッシュ以上で最初の位置から、リングを順にたどる。末尾を超えたら先頭に戻る
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := 0; i < len(p.ring); i++ {
+		e := p.ring[(start+i)%len(p.ring)]
+		switch e.state {
+		case connectivity.Ready:
+			return balancer.PickResult{SubConn: e.sc}, nil
+		case connectivity.Idle, connectivity.Connecting:
+			// つながるのを待つ。ここで別のバックエンドに送ると、同じキーが別の場所に届いてしまう
+			return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+		}
+		// 接続に失敗しているバックエンドは飛ばして、リングの次のバックエンドに送る
+	}
+	return balancer.PickResult{}, balancer.ErrTransientFailure
+}
+
+type errPicker struct {
+	err error
+}
+
+func (p errPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	return balancer.PickResult{}, p.err
+}
+
+// hash はリング上の位置。"addr#0"・"addr#1" のように似た文字列も散らばるよう、SHA-256の先頭8バイトを使う
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,210 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeSubConn struct {
+	balancer.SubConn
+	addr     string
+	listener func(balancer.SubConnState)
+}
+
+func (sc *fakeSubConn) Connect()  {}
+func (sc *fakeSubConn) Shutdown() {}
+
+// fakeClientConn はバランサーが作ったSubConnと、最後に渡されたピッカーを記録する
+type fakeClientConn struct {
+	balancer.ClientConn
+	subConns map[string]*fakeSubConn
+	state    balancer.State
+}
+
+func newFakeClientConn() *fakeClientConn {
+	return &fakeClientConn{subConns: make(map[string]*fakeSubConn)}
+}
+
+func (cc *fakeClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	sc := &fakeSubConn{addr: addrs[0].Addr, listener: opts.StateListener}
+	cc.subConns[sc.addr] = sc
+	return sc, nil
+}
+
+func (cc *fakeClientConn) UpdateState(s balancer.State) {
+	cc.state = s
+}
+
+// setState はaddrのSubConnの状態が変わったことをバランサーに伝える
+func (cc *fakeClientConn) setState(addr string, state connectivity.State) {
+	cc.subConns[addr].listener(balancer.SubConnState{ConnectivityState: state})
+}
+
+// pick はkeyで選ばれたバックエンドのアドレスを返す
+func (cc *fakeClientConn) pick(key string) (string, error) {
+	res, err := cc.state.Picker.Pick(balancer.PickInfo{Ctx: WithHashKey(context.Background(), key)})
+	if err != nil {
+		return "", err
+	}
+	return res.SubConn.(*fakeSubConn).addr, nil
+}
+
+// newReadyBalancer はaddrsのすべてにつながった状態のバランサーを作る
+func newReadyBalancer(t *testing.T, addrs ...resolver.Address) (balancer.Balancer, *fakeClientConn) {
+	t.Helper()
+	cc := newFakeClientConn()
+	b := ringBuilder{}.Build(cc, balancer.BuildOptions{})
+	updateAddresses(t, b, cc, addrs...)
+	return b, cc
+}
+
+func updateAddresses(t *testing.T, b balancer.Balancer, cc *fakeClientConn, addrs ...resolver.Address) {
+	t.Helper()
+	if err := b.UpdateClientConnState(balancer.ClientConnState{ResolverState: resolver.State{Addresses: addrs}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		cc.setState(a.Addr, connectivity.Ready)
+	}
+}
+
+func addresses(addrs ...string) []resolver.Address {
+	out := make([]resolver.Address, len(addrs))
+	for i, a := range addrs {
+		out[i] = resolver.Address{Addr: a}
+	}
+	return out
+}
+
+// assignments は名前ごとに選ばれたバックエンドを返す
+func assignments(t *testing.T, cc *fakeClientConn, n int) map[string]string {
+	t.Helper()
+	got := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		addr, err := cc.pick(key)
+		if err != nil {
+			t.Fatalf("pick(%s): %v", key, err)
+		}
+		got[key] = addr
+	}
+	return got
+}
+
+func TestRingKeepsKeysWhenBackendsChange(t *testing.T) {
+	const keys = 2000
+	b, cc := newReadyBalancer(t, addresses("a:1", "b:1", "c:1")...)
+	before := assignments(t, cc, keys)
+
+	// 同じキーは何度選んでも同じバックエンドに届く
+	for key, addr := range assignments(t, cc, keys) {
+		if before[key] != addr {
+			t.Fatalf("%s moved from %s to %s without any change", key, before[key], addr)
+		}
+	}
+
+	// バックエンドを足すと、移動するキーは新しいバックエンドに移るものだけ
+	updateAddresses(t, b, cc, addresses("a:1", "b:1", "c:1", "d:1")...)
+	moved := 0
+	for key, addr := range assignments(t, cc, keys) {
+		if before[key] == addr {
+			continue
+		}
+		moved++
+		if addr != "d:1" {
+			t.Errorf("%s moved from %s to %s, want only moves to d:1", key, before[key], addr)
+		}
+	}
+	if moved == 0 || moved > keys/2 {
+		t.Errorf("%d of %d keys moved after adding a backend, want about a quarter", moved, keys)
+	}
+
+	// バックエンドを外すと、移動するのはそこにあったキーだけ
+	updateAddresses(t, b, cc, addresses("a:1", "c:1")...)
+	for key, addr := range assignments(t, cc, keys) {
+		if before[key] != "b:1" && before[key] != addr {
+			t.Errorf("%s moved from %s to %s after removing b:1", key, before[key], addr)
+		}
+	}
+}
+
+func TestRingWeights(t *testing.T) {
+	const keys = 4000
+	_, cc := newReadyBalancer(t, SetWeight(resolver.Address{Addr: "heavy:1"}, 3), resolver.Address{Addr: "light:1"})
+	counts := make(map[string]int)
+	for _, addr := range assignments(t, cc, keys) {
+		counts[addr]++
+	}
+	// 重み3:1なら、おおよそ3/4のキーが重いほうに届く
+	if share := float64(counts["heavy:1"]) / keys; share < 0.65 || share > 0.85 {
+		t.Errorf("heavy:1 got %.2f of the keys (%v), want about 0.75", share, counts)
+	}
+}
+
+func TestWeight(t *testing.T) {
+	tests := []struct {
+		name string
+		addr resolver.Address
+		want uint32
+	}{
+		{"unset", resolver.Address{Addr: "a:1"}, 1},
+		{"set", SetWeight(resolver.Address{Addr: "a:1"}, 7), 7},
+		{"zero", SetWeight(resolver.Address{Addr: "a:1"}, 0), 1},
+		{"clamped", SetWeight(resolver.Address{Addr: "a:1"}, 4000000000), MaxWeight},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Weight(tt.addr); got != tt.want {
+				t.Errorf("Weight() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRingPickWhileConnecting(t *testing.T) {
+	_, cc := newReadyBalancer(t, addresses("a:1", "b:1", "c:1")...)
+	key := "alice"
+	home, err := cc.pick(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// つながるのを待っている間は、別のバックエンドに送らずに待つ
+	cc.setState(home, connectivity.Connecting)
+	if _, err := cc.pick(key); !errors.Is(err, balancer.ErrNoSubConnAvailable) {
+		t.Errorf("pick while %s is connecting: err = %v, want ErrNoSubConnAvailable", home, err)
+	}
+
+	// 接続に失敗したら、リングの次のバックエンドに送る
+	cc.setState(home, connectivity.TransientFailure)
+	next, err := cc.pick(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == home {
+		t.Errorf("pick after %s failed returned it again", home)
+	}
+
+	// 戻れば元のバックエンドに戻る
+	cc.setState(home, connectivity.Ready)
+	if got, _ := cc.pick(key); got != home {
+		t.Errorf("pick after %s recovered = %s", home, got)
+	}
+}
+
+func TestRingRejectsEmptyAddresses(t *testing.T) {
+	cc := newFakeClientConn()
+	b := ringBuilder{}.Build(cc, balancer.BuildOptions{})
+	if err := b.UpdateClientConnState(balancer.ClientConnState{}); !errors.Is(err, balancer.ErrBadResolverState) {
+		t.Errorf("UpdateClientConnState() = %v, want ErrBadResolverState", err)
+	}
+	if cc.state.ConnectivityState != connectivity.TransientFailure {
+		t.Errorf("state = %v, want TRANSIENT_FAILURE", cc.state.ConnectivityState)
+	}
+}
@@ -0,0 +1,161 @@
+// Package logging はクライアントとサーバーで共通のlog/slogの設定をまとめる
+//
+// ハンドラ(text / json)とレベルの設定、実行中にレベルを変えるためのHTTPハンドラ、
+// ペイロードをログに出すかどうかの判定を提供する。
+// ログ出力時のコンテキストにスパン・リクエストIDがあれば、trace_id・request_idを自動で付ける。
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"mygrpc/pkg/redact"
+	"mygrpc/pkg/requestid"
+	"mygrpc/pkg/tracing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Formats はNewに指定できる出力形式
+var Formats = []string{"text", "json"}
+
+// New はformatの形式でwに書き出すLoggerを作る。レベルはlevelで実行中に変えられる
+func New(w io.Writer, format string, level *slog.LevelVar) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q (want %s)", format, strings.Join(Formats, ", "))
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+// ParseLevel は debug / info / warn / error (大文字小文字を区別しない)をslog.Levelにする
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+	}
+	return l, nil
+}
+
+// contextHandler はログ出力時のコンテキストからtrace_id・request_idを取り出して付ける
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := tracing.TraceID(ctx); id != "" {
+		r.AddAttrs(slog.String("trace_id", id))
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// LevelHandler はレベルを確認・変更するHTTPハンドラ
+//
+//	GET         今のレベルを返す
+//	PUT / POST  ?level=debug のように指定したレベルに変える
+func LevelHandler(level *slog.LevelVar) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			l, err := ParseLevel(r.FormValue("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if old := level.Level(); old != l {
+				level.Set(l)
+				slog.Info("log level changed", "from", old, "to", l)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, level.Level())
+	})
+}
+
+// PayloadModes はPayloadPolicy.Modeに指定できる値
+//
+//	off     ペイロードを出力しない
+//	sampled SampleRateの割合のRPCだけ出力する
+//	full    すべてのRPCで出力する
+var PayloadModes = []string{"off", "sampled", "full"}
+
+// PayloadPolicy はリクエスト・レスポンスの中身をログに出すかどうかを決める
+type PayloadPolicy struct {
+	Mode       string
+	SampleRate float64
+}
+
+// Sample はRPCを1つ始めるときに呼び、そのRPCのペイロードを出力するかどうかを返す
+// ストリームのメッセージは、RPC単位でまとめて出す・出さないが決まる
+func (p PayloadPolicy) Sample() bool {
+	switch p.Mode {
+	case "full":
+		return true
+	case "sampled":
+		return rand.Float64() < p.SampleRate
+	}
+	return false
+}
+
+// Payload はメッセージのsensitiveなフィールドを伏せて、protojsonでエンコードした属性を返す
+func Payload(m interface{}) slog.Attr {
+	pm, ok := m.(proto.Message)
+	if !ok {
+		return slog.String("payload", fmt.Sprintf("<%T>", m))
+	}
+	b, err := protojson.Marshal(redact.Message(pm))
+	if err != nil {
+		return slog.String("payload_error", err.Error())
+	}
+	return slog.String("payload", string(b))
+}
+
+// Size はメッセージのエンコード後のバイト数。protoのメッセージでなければ0
+func Size(m interface{}) int {
+	if pm, ok := m.(proto.Message); ok {
+		return proto.Size(pm)
+	}
+	return 0
+}
+
+// ServerCodeLevel はサーバーでRPCが終わったときのログのレベルを、ステータスコードから決める
+// クライアントの誤りによるものはWarn、サーバー側の問題はErrorにする
+func ServerCodeLevel(code codes.Code) slog.Level {
+	switch code {
+	case codes.OK, codes.Canceled:
+		return slog.LevelInfo
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.PermissionDenied,
+		codes.Unauthenticated, codes.ResourceExhausted, codes.FailedPrecondition, codes.Aborted,
+		codes.OutOfRange, codes.DeadlineExceeded:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
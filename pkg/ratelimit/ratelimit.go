@@ -0,0 +1,145 @@
+// Package ratelimit はトークンバケットによるレート制限を行う
+//
+// バケットは1秒あたりRateトークンずつ、最大Burstトークンまで貯まり、1回の呼び出しで1トークンを使う。
+// Limiterはキー(呼び出し元など)ごとにバケットを持ち、しばらく使われなかったバケットは捨てる。
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit はバケットの大きさと貯まる速さ。Rateが0なら制限しない
+type Limit struct {
+	// Rate は1秒あたりに貯まるトークンの数
+	Rate float64 `yaml:"rate" toml:"rate"`
+	// Burst は貯められるトークンの最大数。0ならRateを切り上げた数(最低1)
+	Burst int `yaml:"burst" toml:"burst"`
+}
+
+// Unlimited は制限しないかどうか
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%g/s (burst %g)", l.Rate, l.burst())
+}
+
+// Bucket は1つのトークンバケット。ゴルーチンから同時に使ってよい
+type Bucket struct {
+	limit Limit
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket は満タンのバケットを作る
+func NewBucket(l Limit) *Bucket {
+	return &Bucket{limit: l, tokens: l.burst(), last: time.Now()}
+}
+
+// Allow はトークンを1つ使えればtrueを返す
+// 使えなければfalseと、次にトークンが1つ貯まるまでの時間を返す
+func (b *Bucket) Allow() (bool, time.Duration) {
+	return b.allow(time.Now())
+}
+
+func (b *Bucket) allow(now time.Time) (bool, time.Duration) {
+	if b.limit.Unlimited() {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.limit.burst(), b.tokens+elapsed.Seconds()*b.limit.Rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// idle はnowの時点でバケットが満タンに戻っているかどうか。満タンのバケットは捨てても作り直しと同じ
+func (b *Bucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= b.limit.burst()
+}
+
+// Limiter はキーごとのバケットを持つ
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: make(map[string]*Bucket)}
+}
+
+// Allow はkeyのバケットからトークンを1つ使う。バケットがなければlimitで作る
+// 同じkeyには同じLimitを渡すこと(Limitが変わったときは、バケットが捨てられた後に反映される)
+func (l *Limiter) Allow(key string, limit Limit) (bool, time.Duration) {
+	if limit.Unlimited() {
+		return true, 0
+	}
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(limit)
+		l.buckets[key] = b
+	}
+	l.mu.Unlock()
+	return b.Allow()
+}
+
+// Len は今持っているバケットの数
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// Sweep は満タンに戻ったバケットを捨てる。呼び出し元が増え続けてもメモリを使い切らないようにする
+func (l *Limiter) Sweep() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.idle(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// SweepEvery はctxがキャンセルされるまでintervalごとにSweepする
+// 呼び出し元をブロックするので、goroutineで実行すること
+func (l *Limiter) SweepEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.Sweep()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	b := NewBucket(Limit{Rate: 2, Burst: 3})
+	start := b.last
+
+	// 満タンの状態からBurstの分だけ続けて通る
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.allow(start); !ok {
+			t.Fatalf("call %d within the burst was rejected", i+1)
+		}
+	}
+	ok, wait := b.allow(start)
+	if ok {
+		t.Fatal("call beyond the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, want 500ms at 2/s", wait)
+	}
+
+	// 1秒あたりRateトークンずつ貯まる
+	if ok, wait := b.allow(start.Add(250 * time.Millisecond)); ok || wait != 250*time.Millisecond {
+		t.Errorf("after 250ms: allow = %v, wait = %v, want false, 250ms", ok, wait)
+	}
+	if ok, _ := b.allow(start.Add(500 * time.Millisecond)); !ok {
+		t.Error("after 500ms the refilled token was not available")
+	}
+
+	// 長く空いてもBurstより多くは貯まらない
+	later := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.allow(later); !ok {
+			t.Fatalf("call %d after an hour was rejected", i+1)
+		}
+	}
+	if ok, _ := b.allow(later); ok {
+		t.Error("bucket held more than the burst after an hour")
+	}
+}
+
+func TestLimitBurst(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		want  float64
+	}{
+		{Limit{Rate: 10, Burst: 4}, 4},
+		{Limit{Rate: 2.5}, 3},
+		{Limit{Rate: 0.1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.limit.String(), func(t *testing.T) {
+			if got := tt.limit.burst(); got != tt.want {
+				t.Errorf("burst() = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	b := NewBucket(Limit{})
+	for i := 0; i < 1000; i++ {
+		if ok, _ := b.Allow(); !ok {
+			t.Fatalf("unlimited bucket rejected call %d", i+1)
+		}
+	}
+	l := NewLimiter()
+	if ok, _ := l.Allow("alice", Limit{}); !ok {
+		t.Error("unlimited Limiter.Allow rejected a call")
+	}
+	if l.Len() != 0 {
+		t.Errorf("Len() = %d, want no bucket for an unlimited key", l.Len())
+	}
+}
+
+func TestLimiterKeys(t *testing.T) {
+	l := NewLimiter()
+	limit := Limit{Rate: 0.001, Burst: 1}
+
+	// キーごとに別のバケットを使う
+	if ok, _ := l.Allow("alice", limit); !ok {
+		t.Fatal("first call for alice was rejected")
+	}
+	if ok, _ := l.Allow("alice", limit); ok {
+		t.Error("second call for alice was allowed")
+	}
+	if ok, _ := l.Allow("bob", limit); !ok {
+		t.Error("bob was limited by alice's bucket")
+	}
+
+	// 使い切ったバケットは満タンに戻るまで捨てない
+	l.Sweep()
+	if l.Len() != 2 {
+		t.Errorf("Len() after Sweep = %d, want 2", l.Len())
+	}
+}
+
+func TestLimiterSweepsIdleBuckets(t *testing.T) {
+	l := NewLimiter()
+	limit := Limit{Rate: 1000, Burst: 1}
+	l.Allow("alice", limit)
+	time.Sleep(5 * time.Millisecond)
+	l.Sweep()
+	if l.Len() != 0 {
+		t.Errorf("Len() after Sweep = %d, want the refilled bucket dropped", l.Len())
+	}
+}
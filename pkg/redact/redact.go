@@ -0,0 +1,176 @@
+// Package redact はログ・監査ログ・トレースに出す前に、外に出したくない値を伏せる
+//
+// メッセージはprotoのフィールドオプション (myapp.sensitive) = true が付いたフィールドを、
+// メタデータは拒否リストに載っているキーの値を、Placeholderに置き換える。
+// どちらも元の値は変更せず、伏せたコピーを返す。
+package redact
+
+import (
+	"strings"
+	"sync"
+
+	hellopb "mygrpc/pkg/grpc"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Placeholder は伏せた値の代わりに出力する文字列
+const Placeholder = "[REDACTED]"
+
+// DefaultMetadataKeys は値を常に伏せるメタデータのキー
+var DefaultMetadataKeys = []string{
+	"authorization",
+	"proxy-authorization",
+	"cookie",
+	"set-cookie",
+	"x-api-key",
+}
+
+// Message はsensitiveなフィールドを伏せたmのコピーを返す
+// 伏せるフィールドがなければm自体を返す
+//
+// 文字列・バイト列はPlaceholderに置き換え、それ以外の型はクリアする。
+// sensitiveでないメッセージ型のフィールドは、その中まで調べる。
+func Message(m proto.Message) proto.Message {
+	if m == nil || !containsSensitive(m.ProtoReflect().Descriptor()) {
+		return m
+	}
+	c := proto.Clone(m)
+	redactMessage(c.ProtoReflect())
+	return c
+}
+
+func isSensitive(fd protoreflect.FieldDescriptor) bool {
+	v, _ := proto.GetExtension(fd.Options(), hellopb.E_Sensitive).(bool)
+	return v
+}
+
+// sensitiveTypes はメッセージ型ごとのcontainsSensitiveの結果のキャッシュ
+var sensitiveTypes sync.Map // protoreflect.FullName -> bool
+
+// containsSensitive は、その型のメッセージに伏せるフィールドがあるかどうか
+func containsSensitive(md protoreflect.MessageDescriptor) bool {
+	if v, ok := sensitiveTypes.Load(md.FullName()); ok {
+		return v.(bool)
+	}
+	found := hasSensitive(md, make(map[protoreflect.FullName]bool))
+	sensitiveTypes.Store(md.FullName(), found)
+	return found
+}
+
+// hasSensitive はmdかその中のメッセージ型にsensitiveなフィールドがあるかどうか
+// 再帰的なメッセージ型で無限にたどらないよう、調べた型はseenに記録する
+func hasSensitive(md protoreflect.MessageDescriptor, seen map[protoreflect.FullName]bool) bool {
+	if seen[md.FullName()] {
+		return false
+	}
+	seen[md.FullName()] = true
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if isSensitive(fd) {
+			return true
+		}
+		if fd.IsMap() {
+			fd = fd.MapValue()
+		}
+		if fd.Message() != nil && hasSensitive(fd.Message(), seen) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactMessage(msg protoreflect.Message) {
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case isSensitive(fd):
+			redactField(msg, fd)
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+					redactMessage(mv.Message())
+					return true
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				for i := 0; i < v.List().Len(); i++ {
+					redactMessage(v.List().Get(i).Message())
+				}
+			}
+		case fd.Message() != nil:
+			redactMessage(v.Message())
+		}
+		return true
+	})
+}
+
+// redactField はフィールドの値をPlaceholderに置き換える。文字列・バイト列以外はクリアする
+func redactField(msg protoreflect.Message, fd protoreflect.FieldDescriptor) {
+	kind := fd.Kind()
+	if fd.IsMap() {
+		kind = fd.MapValue().Kind()
+	}
+	var placeholder protoreflect.Value
+	switch kind {
+	case protoreflect.StringKind:
+		placeholder = protoreflect.ValueOfString(Placeholder)
+	case protoreflect.BytesKind:
+		placeholder = protoreflect.ValueOfBytes([]byte(Placeholder))
+	default:
+		msg.Clear(fd)
+		return
+	}
+	switch {
+	case fd.IsList():
+		l := msg.Mutable(fd).List()
+		for i := 0; i < l.Len(); i++ {
+			l.Set(i, placeholder)
+		}
+	case fd.IsMap():
+		m := msg.Mutable(fd).Map()
+		m.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+			m.Set(k, placeholder)
+			return true
+		})
+	default:
+		msg.Set(fd, placeholder)
+	}
+}
+
+// MetadataRedactor は拒否リストのキーの値を伏せる
+type MetadataRedactor struct {
+	keys map[string]bool
+}
+
+// NewMetadataRedactor はDefaultMetadataKeysにextraを加えた拒否リストで伏せるMetadataRedactorを作る
+// キーは大文字小文字を区別しない
+func NewMetadataRedactor(extra ...string) *MetadataRedactor {
+	r := &MetadataRedactor{keys: make(map[string]bool)}
+	for _, keys := range [][]string{DefaultMetadataKeys, extra} {
+		for _, k := range keys {
+			r.keys[strings.ToLower(k)] = true
+		}
+	}
+	return r
+}
+
+// Redact は拒否リストのキーの値を伏せたmdのコピーを返す
+func (r *MetadataRedactor) Redact(md metadata.MD) metadata.MD {
+	out := make(metadata.MD, len(md))
+	for k, vs := range md {
+		if !r.keys[strings.ToLower(k)] {
+			out[k] = vs
+			continue
+		}
+		redacted := make([]string, len(vs))
+		for i := range redacted {
+			redacted[i] = Placeholder
+		}
+		out[k] = redacted
+	}
+	return out
+}
@@ -0,0 +1,73 @@
+package redact
+
+import (
+	"testing"
+	"time"
+
+	hellopb "mygrpc/pkg/grpc"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestMessage(t *testing.T) {
+	in := &hellopb.HelloRequest{Name: "alice", Count: proto.Uint32(3)}
+	got := Message(in).(*hellopb.HelloRequest)
+	if got.GetName() != Placeholder {
+		t.Errorf("name = %q, want %q", got.GetName(), Placeholder)
+	}
+	if got.GetCount() != 3 {
+		t.Errorf("count = %d, want the field kept", got.GetCount())
+	}
+	// 元のメッセージは変更しない
+	if in.GetName() != "alice" {
+		t.Errorf("original name = %q, want alice", in.GetName())
+	}
+}
+
+func TestMessageNested(t *testing.T) {
+	in := &hellopb.IssuedApiKey{Key: &hellopb.ApiKey{Id: "k1", Name: "ci"}, Secret: "mgk_k1_secret"}
+	got := Message(in).(*hellopb.IssuedApiKey)
+	if got.GetSecret() != Placeholder {
+		t.Errorf("secret = %q, want %q", got.GetSecret(), Placeholder)
+	}
+	if got.GetKey().GetId() != "k1" || got.GetKey().GetName() != "ci" {
+		t.Errorf("key = %v, want the non-sensitive fields kept", got.GetKey())
+	}
+}
+
+func TestMessageWithoutSensitiveFields(t *testing.T) {
+	in := durationpb.New(time.Second)
+	// 伏せるフィールドがなければコピーせずにそのまま返す
+	if got := Message(in); got != proto.Message(in) {
+		t.Errorf("Message() returned a copy for a message without sensitive fields")
+	}
+	if got := Message(nil); got != nil {
+		t.Errorf("Message(nil) = %v, want nil", got)
+	}
+}
+
+func TestMetadataRedactor(t *testing.T) {
+	md := metadata.Pairs(
+		"authorization", "Bearer token",
+		"x-api-key", "mgk_k1_secret",
+		"x-tenant", "acme",
+		"x-request-id", "r1",
+	)
+	r := NewMetadataRedactor("X-Tenant")
+	got := r.Redact(md)
+
+	for _, key := range []string{"authorization", "x-api-key", "x-tenant"} {
+		if vs := got.Get(key); len(vs) != 1 || vs[0] != Placeholder {
+			t.Errorf("%s = %v, want [%s]", key, vs, Placeholder)
+		}
+	}
+	if vs := got.Get("x-request-id"); len(vs) != 1 || vs[0] != "r1" {
+		t.Errorf("x-request-id = %v, want [r1]", vs)
+	}
+	// 元のメタデータは変更しない
+	if vs := md.Get("authorization"); vs[0] != "Bearer token" {
+		t.Errorf("original authorization = %v", vs)
+	}
+}
@@ -0,0 +1,56 @@
+// Package requestid はRPCを識別するリクエストID(x-request-idメタデータ)を作り、コンテキストで運ぶ
+//
+// クライアントはIDを決めてメタデータで送り、サーバーはそれを受け取る(なければ作る)。
+// 同じIDがクライアントとサーバーの両方のログに出るので、1回の呼び出しのログをつなげられる。
+// コンテキストに入れたIDは、pkg/loggingのLoggerがrequest_idとしてログに付ける。
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// MetadataKey はリクエストIDを送るメタデータのキー
+const MetadataKey = "x-request-id"
+
+// maxLen は受け付けるIDの最大の長さ。ログを大きくされないよう制限する
+const maxLen = 128
+
+// New はランダムなID(UUID v4の形式)を作る
+func New() string {
+	var b [16]byte
+	// 乱数を読めなかったとしても、IDは作れればよいので気にしない
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// Valid はクライアントから受け取ったIDをそのまま使ってよいかどうか
+// ログに改行や制御文字を紛れ込ませられないよう、表示できるASCII文字だけを受け付ける
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+type idKey struct{}
+
+// NewContext はリクエストIDを入れたコンテキストを返す
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+// FromContext はNewContextで入れたリクエストIDを取り出す。なければ空文字列
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
@@ -0,0 +1,58 @@
+package requestid
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	uuidV4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := New()
+		if !uuidV4.MatchString(id) {
+			t.Fatalf("New() = %q, want a UUID v4", id)
+		}
+		if !Valid(id) {
+			t.Fatalf("Valid(New()) = false for %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("New() returned %q twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"3f1c2a4e-8b7d-4c1a-9e2f-0a1b2c3d4e5f", true},
+		{"req-123_abc.DEF~", true},
+		{strings.Repeat("a", maxLen), true},
+		{strings.Repeat("a", maxLen+1), false},
+		{"", false},
+		{"has space", false},
+		{"line\nbreak", false},
+		{"tab\t", false},
+		{"ü", false},
+	}
+	for _, tt := range tests {
+		if got := Valid(tt.id); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if got := FromContext(ctx); got != "" {
+		t.Errorf("FromContext(empty) = %q", got)
+	}
+	if got := FromContext(NewContext(ctx, "abc")); got != "abc" {
+		t.Errorf("FromContext() = %q, want abc", got)
+	}
+}
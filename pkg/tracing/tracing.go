@@ -0,0 +1,225 @@
+// Package tracing はクライアントとサーバーで共通のOpenTelemetryの設定をまとめる
+//
+// エクスポーターの選択とTracerProviderの作成、W3C Trace Contextをgrpcのメタデータで運ぶための
+// キャリア、RPCのスパンに付ける属性とメッセージイベントを提供する。
+// インターセプタ自体はcmd/server・cmd/clientにある。
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// InstrumentationName はインターセプタがotel.Tracerに渡す名前
+const InstrumentationName = "mygrpc/pkg/tracing"
+
+// TraceIDKey はトレースIDを返すレスポンスのトレーラーのキー
+const TraceIDKey = "x-trace-id"
+
+// Exporters は Config.Exporter に指定できる値
+//
+//	none   トレースしない
+//	stdout スパンをJSONでWriterに書き出す
+//	otlp   OTLP/gRPCでコレクターに送る
+//	memory スパンをメモリに溜める(テスト用。Provider.Memoryから取り出せる)
+var Exporters = []string{"none", "stdout", "otlp", "memory"}
+
+type Config struct {
+	Exporter    string
+	ServiceName string
+	// Endpoint はotlpのコレクターのアドレス(host:port)
+	Endpoint string
+	// Writer はstdoutのときの出力先。nilならos.Stdout
+	Writer io.Writer
+}
+
+// Provider はSetupで作ったTracerProvider
+type Provider struct {
+	*sdktrace.TracerProvider
+	// Memory はExporterがmemoryのときだけ設定される
+	Memory *tracetest.InMemoryExporter
+}
+
+// Setup はcfgに従ってTracerProviderを作り、W3C Trace Context・Baggageのプロパゲーターとともに
+// グローバルに登録する。終了時にはShutdownを呼んで、溜まっているスパンを送り出すこと
+func Setup(ctx context.Context, cfg Config) (*Provider, error) {
+	p := &Provider{}
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case "stdout":
+		opts := []stdouttrace.Option{stdouttrace.WithPrettyPrint()}
+		if cfg.Writer != nil {
+			opts = append(opts, stdouttrace.WithWriter(cfg.Writer))
+		}
+		exp, err := stdouttrace.New(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("create stdout exporter: %w", err)
+		}
+		exporter = exp
+	case "otlp":
+		// ローカルのコレクターを想定しているので、TLSは使わない
+		exp, err := otlptracegrpc.New(ctx,
+			otlptracegrpc.WithEndpoint(cfg.Endpoint),
+			otlptracegrpc.WithInsecure(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("create OTLP exporter: %w", err)
+		}
+		exporter = exp
+	case "memory":
+		p.Memory = tracetest.NewInMemoryExporter()
+		exporter = p.Memory
+	default:
+		return nil, fmt.Errorf("unknown exporter %q (want %s)", cfg.Exporter, strings.Join(Exporters[1:], ", "))
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("create resource: %w", err)
+	}
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if p.Memory != nil {
+		// テストからすぐに読めるよう、バッチにせず同期的に書き込む
+		opts = append(opts, sdktrace.WithSyncer(exporter))
+	} else {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	p.TracerProvider = sdktrace.NewTracerProvider(opts...)
+
+	otel.SetTracerProvider(p.TracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return p, nil
+}
+
+// MetadataCarrier はgrpcのメタデータをpropagation.TextMapCarrierとして使うためのアダプタ
+// traceparent・tracestate・baggageはメタデータのキーとしてそのまま送られる
+type MetadataCarrier metadata.MD
+
+var _ propagation.TextMapCarrier = MetadataCarrier{}
+
+func (c MetadataCarrier) Get(key string) string {
+	v := metadata.MD(c).Get(key)
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+func (c MetadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c MetadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Inject はctxのスパンの情報を送信するメタデータに加えたコンテキストを返す
+func Inject(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		// 呼び出し元のメタデータを書き換えないようコピーする
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, MetadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// Extract は受信したメタデータから呼び出し元のスパンの情報を取り出したコンテキストを返す
+func Extract(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, MetadataCarrier(md))
+}
+
+// SpanName はFullMethod("/myapp.GreetingService/Hello")からスパン名を作る
+func SpanName(fullMethod string) string {
+	return strings.TrimPrefix(fullMethod, "/")
+}
+
+// RPCAttributes はRPCのスパンに付ける、セマンティック規約に沿った属性
+func RPCAttributes(fullMethod string) []attribute.KeyValue {
+	service, method, _ := strings.Cut(SpanName(fullMethod), "/")
+	return []attribute.KeyValue{
+		semconv.RPCSystemGRPC,
+		semconv.RPCService(service),
+		semconv.RPCMethod(method),
+	}
+}
+
+// RequestMetadataAttributes はリクエストのメタデータをスパンの属性にする
+// (rpc.grpc.request.metadata.<key>)。バイナリ(-bin)のキーは含めない
+// トークンなどが残らないよう、呼び出し側でredactしたメタデータを渡すこと
+func RequestMetadataAttributes(md metadata.MD) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(md))
+	for k, vs := range md {
+		if strings.HasSuffix(k, "-bin") {
+			continue
+		}
+		attrs = append(attrs, attribute.StringSlice("rpc.grpc.request.metadata."+k, vs))
+	}
+	return attrs
+}
+
+// MessageType はメッセージイベントの向き
+type MessageType attribute.KeyValue
+
+var (
+	Sent     = MessageType(semconv.MessageTypeSent)
+	Received = MessageType(semconv.MessageTypeReceived)
+)
+
+// AddMessageEvent はメッセージの送受信をスパンのイベントとして記録する
+// idはストリームの中で向きごとに1から数えた番号
+func AddMessageEvent(span trace.Span, typ MessageType, id int, m interface{}) {
+	attrs := []attribute.KeyValue{
+		attribute.KeyValue(typ),
+		semconv.MessageID(id),
+	}
+	if pm, ok := m.(proto.Message); ok {
+		attrs = append(attrs, semconv.MessageUncompressedSize(proto.Size(pm)))
+	}
+	span.AddEvent("message", trace.WithAttributes(attrs...))
+}
+
+// EndSpan はRPCの結果のステータスコードをスパンに記録して終了する
+func EndSpan(span trace.Span, code grpccodes.Code, msg string) {
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	if code != grpccodes.OK {
+		span.SetStatus(codes.Error, msg)
+	}
+	span.End()
+}
+
+// TraceID はctxのスパンのトレースIDを返す。スパンがなければ空文字列
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}